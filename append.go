@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// Tokenizes the documents in cfg.Files onto the end of the existing index in
+// cfg.Outpath and builds suffix arrays for them as extra chunks. The existing
+// chunks (and the merged suffix array, if any) are left untouched. Readers keep
+// using the old index until the new manifest replaces it: the tokenized corpus
+// only grows past the bytes recorded in the old manifest and the new chunks are
+// written to new files.
+func runAppend(cfg BuildConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	tokenizerHash, err := hashFile(cfg.TokenizerConfig)
+	if err != nil {
+		return err
+	}
+
+	outpath := cfg.Outpath
+	manifest, err := loadManifest(outpath)
+	if err != nil {
+		return err
+	}
+	if !manifest.Complete {
+		return fmt.Errorf("index in %s has not finished building", outpath)
+	}
+	if err := manifest.checkConfig(&cfg, tokenizerHash); err != nil {
+		return err
+	}
+	if err := manifest.checkFiles(outpath); err != nil {
+		return err
+	}
+
+	// drop anything left over from an append that didn't finish
+	outputs := []string{path.Join(outpath, manifest.DataPath), path.Join(outpath, manifest.DocOffsetsPath), path.Join(outpath, manifest.DocSourcesPath)}
+	sizes := []int64{manifest.DataBytes, manifest.NumDocuments * docOffsetSize, manifest.NumDocuments * docSourceSize}
+	if len(manifest.MetadataFields) > 0 {
+		outputs = append(outputs, path.Join(outpath, manifest.MetadataPath), path.Join(outpath, manifest.MetadataOffsetsPath))
+		sizes = append(sizes, manifest.MetadataBytes, manifest.NumDocuments*docOffsetSize)
+	}
+	truncate := func() error {
+		for i, output := range outputs {
+			if err := os.Truncate(output, sizes[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := truncate(); err != nil {
+		return err
+	}
+
+	sources, err := statSources(cfg.Files)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Tokenizing new data to disk")
+	stats, err := buildCorpus(&cfg, len(manifest.Sources), true, nil, nil)
+	if err != nil {
+		return err
+	}
+	if stats.numDocuments == 0 {
+		fmt.Println("No documents to append")
+		return nil
+	}
+
+	updated := *manifest
+	updated.DataBytes += stats.numBytes
+	updated.NumTokens += stats.numBytes / int64(cfg.TokenWidth)
+	updated.NumDocuments += stats.numDocuments
+	updated.MetadataBytes += stats.metadataBytes
+	updated.Sources = append(append([]SourceInfo{}, manifest.Sources...), sources...)
+
+	fmt.Println("Creating suffix array(s) for the new documents")
+	chunkSize := cfg.chunkSize()
+	chunks, err := buildSuffixArrays(outpath, &updated, manifest.DataBytes, len(manifest.Chunks), chunkSize, cfg.MaxMem, cfg.SAWorkers, cfg.ByteLevelSA, cfg.FMSampleRate, cfg.BuildLCP || manifest.hasLCP(), nil)
+	if err != nil {
+		truncate()
+		return err
+	}
+
+	updated.ChunkSize = max(manifest.ChunkSize, chunkSize)
+	updated.Chunks = append(append([]ChunkInfo{}, manifest.Chunks...), chunks...)
+	if err := writeManifest(outpath, &updated); err != nil {
+		return err
+	}
+
+	fmt.Printf("Appended %d document(s) as %d new chunk(s)\n", stats.numDocuments, len(chunks))
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestAppendOffsets(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	docs := randomDocuments(rng, 30, 12, 5)
+	cfg := testBuildConfig(t, docs)
+	cfg.ChunkSize = 200
+	buildTestIndex(t, cfg)
+	before, err := loadManifest(cfg.Outpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// token 7 only occurs in the new documents
+	newDocs := randomDocuments(rng, 30, 12, 5)
+	newDocs[3] = append(newDocs[3], 7)
+	newDocs[29] = append([]uint32{7}, newDocs[29]...)
+	cfg.Files = []string{filepath.Join(t.TempDir(), "new.bin")}
+	writeTokenInput(t, cfg.Files[0], newDocs)
+	if err := runAppend(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := loadManifest(cfg.Outpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(manifest.Chunks[:len(before.Chunks)], before.Chunks) {
+		t.Fatalf("existing chunks changed from %v to %v", before.Chunks, manifest.Chunks)
+	}
+	if len(manifest.Chunks) == len(before.Chunks) {
+		t.Fatal("no chunks were added")
+	}
+	end := before.DataBytes
+	for _, chunk := range manifest.Chunks[len(before.Chunks):] {
+		if chunk.Start != end {
+			t.Fatalf("chunk %v starts at %d, want %d", chunk, chunk.Start, end)
+		}
+		for _, pos := range readSuffixArray(t, filepath.Join(cfg.Outpath, chunk.Path)) {
+			if pos < chunk.Start || pos >= chunk.End {
+				t.Fatalf("chunk %v has an entry at %d", chunk, pos)
+			}
+		}
+		end = chunk.End
+	}
+	allDocs := append(slices.Clone(docs), newDocs...)
+	if end != manifest.DataBytes || manifest.NumDocuments != int64(len(allDocs)) {
+		t.Fatalf("chunks end at %d of %d bytes with %d documents, want %d", end, manifest.DataBytes, manifest.NumDocuments, len(allDocs))
+	}
+
+	m := buildTestIndex(t, cfg)
+	for id, doc := range allDocs {
+		if got, err := m.GetDocument(int64(id)); err != nil || !slices.Equal(got, doc) {
+			t.Fatalf("document %d is %v (%v), want %v", id, got, err, doc)
+		}
+	}
+
+	want := []DocumentMatches{
+		{DocID: int64(len(docs) + 3), Offsets: []int64{int64(len(newDocs[3]) - 1)}},
+		{DocID: int64(len(docs) + 29), Offsets: []int64{0}},
+	}
+	if got, err := m.FindDocuments([]uint32{7}); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("documents with token 7: %v (%v), want %v", got, err, want)
+	}
+}
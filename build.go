@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"runtime/debug"
+	"sync"
+)
+
+// Largest chunk (in bytes) that createTokenSuffixArray can sort: token indices
+// have to fit in an int32.
+func maxTokenChunkSize(tokenWidth int) int64 {
+	return math.MaxInt32 * int64(tokenWidth)
+}
+
+// Limits the total number of bytes held by chunks being built at once.
+type memoryBudget struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	available int64
+}
+
+func newMemoryBudget(total int64) *memoryBudget {
+	budget := &memoryBudget{available: total}
+	budget.cond = sync.NewCond(&budget.mu)
+	return budget
+}
+
+// Blocks until n bytes are available, then reserves them.
+func (b *memoryBudget) acquire(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.available < n {
+		b.cond.Wait()
+	}
+	b.available -= n
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.available += n
+	b.cond.Broadcast()
+}
+
+// A chunk of the tokenized corpus waiting for its suffix array to be built.
+type saJob struct {
+	chunkIdx int
+	chunk    ChunkInfo
+	text     []byte
+	cost     int64 // bytes reserved from the memory budget
+}
+
+// Name of the file holding chunk idx of an index with the given backend.
+func chunkFilename(backend string, idx int) string {
+	if backend == backendFM {
+		return fmt.Sprintf("fm_index_%d.bin", idx)
+	}
+	return fmt.Sprintf("suffix_array_%d.bin", idx)
+}
+
+// Chunks whose suffix arrays have been written, with their number of entries.
+type saResults struct {
+	mu         sync.Mutex
+	firstChunk int
+	chunks     map[int]ChunkInfo
+	numDone    int                     // chunks firstChunk to firstChunk+numDone-1 are all finished
+	progress   func([]ChunkInfo) error // called whenever numDone grows; may be nil
+}
+
+// Records that chunk idx is finished and reports the progress.
+func (r *saResults) finish(idx int, chunk ChunkInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.chunks[idx] = chunk
+	if r.progress == nil {
+		return nil
+	}
+
+	prevDone := r.numDone
+	for {
+		if _, ok := r.chunks[r.firstChunk+r.numDone]; !ok {
+			break
+		}
+		r.numDone++
+	}
+	if r.numDone == prevDone {
+		return nil
+	}
+
+	done := make([]ChunkInfo, r.numDone)
+	for i := range done {
+		done[i] = r.chunks[r.firstChunk+i]
+	}
+	return r.progress(done)
+}
+
+func saWorker(wg *sync.WaitGroup, outpath string, tokenWidth int, byteLevel bool, backend string, fmSampleRate int, buildLCP bool, jobs <-chan saJob, budget *memoryBudget, results *saResults, errs *errorCollector) {
+	defer wg.Done()
+
+	for job := range jobs {
+		if errs.get() == nil {
+			saPath := path.Join(outpath, job.chunk.Path)
+
+			var numEntries int64
+			var lcpFile string
+			var err error
+			if backend == backendFM {
+				tokenSa := createTokenSuffixArray(job.text, tokenWidth)
+				fm := buildFMIndex(job.text, tokenSa, tokenWidth, fmSampleRate, job.chunk.Start)
+				numEntries, err = fm.header.numTokens, writeFMIndexFile(saPath, fm)
+			} else if byteLevel {
+				unalignedSa := createUnalignedSuffixArray(job.text)
+				numEntries, err = writeIndicesToFile(saPath, unalignedSa, job.chunk.Start, tokenWidth)
+			} else {
+				tokenSa := createTokenSuffixArray(job.text, tokenWidth)
+				numEntries, err = writeTokenIndicesToFile(saPath, tokenSa, job.chunk.Start, tokenWidth)
+				if err == nil && buildLCP {
+					lcpFile = lcpPath(job.chunk.Path)
+					err = writeTokenLCPFile(path.Join(outpath, lcpFile), job.text, tokenSa, tokenWidth)
+				}
+			}
+
+			if err == nil {
+				chunk := job.chunk
+				chunk.NumEntries = numEntries
+				chunk.LCPPath = lcpFile
+				err = results.finish(job.chunkIdx, chunk)
+			}
+
+			if err != nil {
+				errs.set(err)
+			} else {
+				fmt.Printf("finished chunk %d\n", job.chunkIdx)
+			}
+		}
+
+		budget.release(job.cost)
+	}
+}
+
+// Creates a suffix array for each chunk of the tokenized corpus described by
+// manifest, starting at byte startOffset, building up to numWorkers chunks at once.
+// The text of each chunk is at most chunkSize bytes and the peak memory of the
+// build, as accounted for by memoryPlan, is kept under maxMem bytes. The chunks are numbered
+// in corpus order starting at firstChunk, no matter which finishes first, so the
+// output doesn't depend on numWorkers. If progress isn't nil, it is called with
+// the finished chunks whenever every chunk up to a later one is finished. The
+// suffix arrays are sorted over tokens, or over bytes if byteLevel is set (slower
+// and uses more memory, but gives the same result). If the manifest's backend is
+// backendFM, an FM-index sampling every fmSampleRate-th token position is written
+// for each chunk instead of its suffix array. If buildLCP is set, the LCP array of
+// each chunk's suffix array is written next to it.
+func buildSuffixArrays(outpath string, manifest *IndexManifest, startOffset int64, firstChunk int, chunkSize, maxMem int64, numWorkers int, byteLevel bool, fmSampleRate int, buildLCP bool, progress func([]ChunkInfo) error) ([]ChunkInfo, error) {
+	tokenWidth := manifest.TokenWidth
+	if !byteLevel && chunkSize > maxTokenChunkSize(tokenWidth) {
+		return nil, fmt.Errorf("chunks of %d bytes have too many tokens to sort: the maximum is %d bytes", chunkSize, maxTokenChunkSize(tokenWidth))
+	}
+
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("a memory budget of %d bytes leaves no room for chunks", maxMem)
+	}
+
+	plan := newMemoryPlan(tokenWidth, manifest.VocabSize, manifest.SentinalVal, byteLevel, manifest.backend(), fmSampleRate)
+	budget := maxMem - buildOverheadBytes - chunkSize
+	if peak := plan.peakMemory(chunkSize, 1); peak > maxMem {
+		return nil, fmt.Errorf("building %d-byte chunks needs %d bytes of memory but the budget is %d bytes", chunkSize, peak, maxMem)
+	}
+
+	// collect garbage before the heap outgrows the budget, so that finished
+	// chunks make room for the next ones
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(maxMem))
+
+	jobs := make(chan saJob)
+	memBudget := newMemoryBudget(budget)
+	results := &saResults{firstChunk: firstChunk, chunks: make(map[int]ChunkInfo), progress: progress}
+	errs := &errorCollector{}
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go saWorker(wg, outpath, tokenWidth, byteLevel, manifest.backend(), fmSampleRate, buildLCP, jobs, memBudget, results, errs)
+	}
+
+	offset := startOffset
+	chunks := make([]ChunkInfo, 0)
+	chunkBuffer := make([]byte, chunkSize)
+	saCallback := func(chunkLength int) error {
+		if err := errs.get(); err != nil {
+			return err
+		}
+
+		currChunk := firstChunk + len(chunks)
+		fmt.Printf("making chunk %d of size %d\n", currChunk, chunkLength)
+
+		cost := plan.chunkCost(int64(chunkLength))
+		memBudget.acquire(cost)
+
+		// the chunk buffer is reused for the next chunk, so each job gets a copy
+		text := make([]byte, chunkLength)
+		copy(text, chunkBuffer[:chunkLength])
+
+		chunk := ChunkInfo{
+			Path:  chunkFilename(manifest.backend(), currChunk),
+			Start: offset,
+			End:   offset + int64(chunkLength),
+		}
+		chunks = append(chunks, chunk)
+		offset += int64(chunkLength)
+
+		jobs <- saJob{chunkIdx: currChunk, chunk: chunk, text: text, cost: cost}
+
+		return nil
+	}
+
+	dataPath := path.Join(outpath, manifest.DataPath)
+	iterErr := documentIter(dataPath, startOffset, manifest.DataBytes, manifest.SentinalSize, manifest.SentinalVal, tokenWidth, chunkBuffer, saCallback)
+
+	close(jobs)
+	wg.Wait()
+
+	if iterErr != nil {
+		return nil, iterErr
+	}
+	if err := errs.get(); err != nil {
+		return nil, err
+	}
+
+	for i := range chunks {
+		chunks[i].NumEntries = results.chunks[firstChunk+i].NumEntries
+		chunks[i].LCPPath = results.chunks[firstChunk+i].LCPPath
+	}
+
+	return chunks, nil
+}
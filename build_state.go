@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+)
+
+// Version of the build state format. A build state with a different version is
+// ignored and the build starts over.
+const buildStateVersion = 2
+
+const buildStateFilename = "build_state.json"
+
+// Number of bytes of input tokenized between checkpoints.
+const tokenizeCheckpointInterval = 64 * 1024 * 1024
+
+// Progress of tokenizing the input: every document before InputOffset of input
+// file InputFile has been written to the tokenized corpus, which is DataBytes long.
+type tokenizeCheckpoint struct {
+	InputFile    int   `json:"input_file"`   // index of the input file being read
+	InputOffset  int64 `json:"input_offset"` // bytes of the input file consumed, after decompression
+	InputLines   int64 `json:"input_lines"`  // records of the input file consumed, including skipped ones
+	DataBytes    int64 `json:"data_bytes"`
+	NumDocuments int64 `json:"num_documents"`
+
+	MetadataBytes int64 `json:"metadata_bytes,omitempty"` // size of the metadata, if it is kept
+}
+
+// Returns whether the tokenized data in outpath extends at least up to the checkpoint.
+func (c *tokenizeCheckpoint) hasFiles(outpath string) bool {
+	dataInfo, err := os.Stat(path.Join(outpath, "data.bin"))
+	if err != nil || dataInfo.Size() < c.DataBytes {
+		return false
+	}
+	docsInfo, err := os.Stat(path.Join(outpath, docOffsetsFilename))
+	if err != nil || docsInfo.Size() < c.NumDocuments*docOffsetSize {
+		return false
+	}
+	sourcesInfo, err := os.Stat(path.Join(outpath, docSourcesFilename))
+	if err != nil || sourcesInfo.Size() < c.NumDocuments*docSourceSize {
+		return false
+	}
+	if c.MetadataBytes == 0 {
+		return true
+	}
+
+	metadataInfo, err := os.Stat(path.Join(outpath, metadataFilename))
+	if err != nil || metadataInfo.Size() < c.MetadataBytes {
+		return false
+	}
+	offsetsInfo, err := os.Stat(path.Join(outpath, metadataOffsetsFilename))
+	return err == nil && offsetsInfo.Size() >= c.NumDocuments*docOffsetSize
+}
+
+// Progress of an index build that hasn't finished yet, so that an interrupted
+// build can continue from its last checkpoint instead of starting over. It is
+// replaced atomically at every checkpoint and removed once the index is complete.
+type buildState struct {
+	Version int `json:"version"`
+
+	// settings the tokenization was started with; resuming with different
+	// settings starts over
+	Inputs        []SourceInfo `json:"inputs"`
+	InputFormat   string       `json:"input_format"`
+	LineSplit     string       `json:"line_split"`
+	TextField     string       `json:"text_field"`
+	TokenizerHash string       `json:"tokenizer_sha256"`
+	TokenWidth    int          `json:"token_width"`
+	SentinalVal   int          `json:"sentinal_val"`
+	SentinalSize  int          `json:"sentinal_size"`
+
+	MetadataFields []string `json:"metadata_fields,omitempty"`
+
+	InputTokenWidth int `json:"input_token_width,omitempty"`
+	DocSeparator    int `json:"doc_separator"`
+
+	Tokenized *tokenizeCheckpoint `json:"tokenized,omitempty"` // nil until the first checkpoint
+
+	ChunkSize int64       `json:"chunk_size"`
+	Chunks    []ChunkInfo `json:"chunks"` // finished suffix array chunks, in order from chunk 0
+}
+
+// Create the build state for tokenizing cfg.Files from the start.
+func newBuildState(cfg *BuildConfig, tokenizerHash string) (*buildState, error) {
+	inputs, err := statSources(cfg.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &buildState{
+		Version:       buildStateVersion,
+		Inputs:        inputs,
+		InputFormat:   cfg.InputFormat,
+		LineSplit:     cfg.LineSplit,
+		TextField:     cfg.TextField,
+		TokenizerHash: tokenizerHash,
+		TokenWidth:    cfg.TokenWidth,
+		SentinalVal:   cfg.SentinalVal,
+		SentinalSize:  cfg.SentinalSize,
+
+		MetadataFields: cfg.MetadataFields,
+
+		InputTokenWidth: cfg.InputTokenWidth,
+		DocSeparator:    cfg.DocSeparator,
+	}, nil
+}
+
+// Returns whether both states tokenize the same input with the same settings.
+func (s *buildState) sameSettings(other *buildState) bool {
+	return slices.Equal(s.Inputs, other.Inputs) &&
+		s.InputFormat == other.InputFormat &&
+		s.LineSplit == other.LineSplit &&
+		s.TextField == other.TextField &&
+		s.TokenizerHash == other.TokenizerHash &&
+		s.TokenWidth == other.TokenWidth &&
+		s.SentinalVal == other.SentinalVal &&
+		s.SentinalSize == other.SentinalSize &&
+		slices.Equal(s.MetadataFields, other.MetadataFields) &&
+		s.InputTokenWidth == other.InputTokenWidth &&
+		s.DocSeparator == other.DocSeparator
+}
+
+// Returns the finished chunks that a suffix array build of chunkSize-byte chunks
+// can keep: the recorded chunks, up to the first one that doesn't continue where
+// the previous one ended or whose file doesn't match it.
+func (s *buildState) finishedChunks(outpath string, manifest *IndexManifest, chunkSize int64) []ChunkInfo {
+	if s.ChunkSize != chunkSize {
+		return []ChunkInfo{}
+	}
+
+	expectedStart := int64(0)
+	for i, chunk := range s.Chunks {
+		if chunk.Start != expectedStart || chunk.End > manifest.DataBytes {
+			return s.Chunks[:i]
+		}
+
+		if checkChunkFile(outpath, chunk, manifest) != nil {
+			return s.Chunks[:i]
+		}
+
+		expectedStart = chunk.End
+	}
+	return s.Chunks
+}
+
+// Checks that the file of chunk exists and matches it.
+func checkChunkFile(outpath string, chunk ChunkInfo, manifest *IndexManifest) error {
+	chunkPath := path.Join(outpath, chunk.Path)
+	if manifest.backend() == backendFM {
+		header, err := readFMHeader(chunkPath)
+		if err != nil {
+			return err
+		}
+		return header.checkChunk(chunk, manifest.TokenWidth)
+	}
+
+	sa, err := makeMMappedSA(chunkPath)
+	if err != nil {
+		return err
+	}
+	defer sa.close()
+	if err := sa.header.checkChunk(chunk, manifest.TokenWidth); err != nil {
+		return err
+	}
+
+	if chunk.LCPPath != "" {
+		return sa.openLCP(path.Join(outpath, chunk.LCPPath))
+	}
+	return nil
+}
+
+func buildStatePath(outpath string) string {
+	return path.Join(outpath, buildStateFilename)
+}
+
+// Loads the build state in outpath. Returns nil if there is none or if it was
+// written by a different version.
+func loadBuildState(outpath string) (*buildState, error) {
+	stateStr, err := readStringFromFile(buildStatePath(outpath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := &buildState{}
+	if err := json.Unmarshal([]byte(stateStr), state); err != nil {
+		return nil, fmt.Errorf("invalid build state %s: %w", buildStatePath(outpath), err)
+	}
+
+	if state.Version != buildStateVersion {
+		fmt.Printf("Ignoring build state with version %d\n", state.Version)
+		return nil, nil
+	}
+
+	return state, nil
+}
+
+func writeBuildState(outpath string, state *buildState) error {
+	stateBytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(buildStatePath(outpath), append(stateBytes, '\n'))
+}
+
+func removeBuildState(outpath string) error {
+	err := os.Remove(buildStatePath(outpath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeTokenizationFromCheckpoint(t *testing.T) {
+	docs := randomDocuments(rand.New(rand.NewSource(1)), 40, 12, 5)
+	filenames := []string{"data.bin", docOffsetsFilename, docSourcesFilename}
+
+	// the files of an uninterrupted build
+	complete := testBuildConfig(t, docs)
+	buildTestIndex(t, complete)
+	want := make(map[string][]byte)
+	for _, filename := range filenames {
+		data, err := os.ReadFile(filepath.Join(complete.Outpath, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[filename] = data
+	}
+
+	// a build interrupted after the checkpoint at document 15, whose files go on
+	// past it. Every token before the checkpoint is replaced by 5, so the resumed
+	// build only keeps them if it doesn't tokenize them again.
+	cfg := testBuildConfig(t, docs)
+	numBytes := int64(0)
+	for _, doc := range docs[:15] {
+		numBytes += int64(len(doc)+1) * 2
+	}
+	checkpoint := &tokenizeCheckpoint{InputOffset: numBytes, InputLines: 15, DataBytes: numBytes, NumDocuments: 15}
+
+	tokenized := bytes.Clone(want["data.bin"][:numBytes])
+	for i := 0; i < len(tokenized); i += 2 {
+		if tokenized[i] != 0 {
+			tokenized[i] = 5
+		}
+	}
+	want["data.bin"] = append(bytes.Clone(tokenized), want["data.bin"][numBytes:]...)
+
+	interrupted := map[string][]byte{
+		"data.bin":         tokenized,
+		docOffsetsFilename: want[docOffsetsFilename][:15*docOffsetSize],
+		docSourcesFilename: want[docSourcesFilename][:15*docSourceSize],
+	}
+	if err := os.MkdirAll(cfg.Outpath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range filenames {
+		data := append(bytes.Clone(interrupted[filename]), 9, 9, 9, 9)
+		if err := os.WriteFile(filepath.Join(cfg.Outpath, filename), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokenizerHash, err := hashFile(cfg.TokenizerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := newBuildState(&cfg, tokenizerHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Tokenized = checkpoint
+	if err := writeBuildState(cfg.Outpath, state); err != nil {
+		t.Fatal(err)
+	}
+
+	buildTestIndex(t, cfg)
+	for _, filename := range filenames {
+		data, err := os.ReadFile(filepath.Join(cfg.Outpath, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want[filename]) {
+			t.Errorf("%s is %v after resuming, want %v", filename, data, want[filename])
+		}
+	}
+	if _, err := os.Stat(buildStatePath(cfg.Outpath)); !os.IsNotExist(err) {
+		t.Errorf("build state is left behind (%v)", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// One of the indices combined by a composite model.
+type indexMember struct {
+	name     string // index directory
+	model    *ModelData
+	offset   int64 // where the member's tokenized corpus starts in the composite's
+	firstDoc int64 // composite id of the member's first document
+}
+
+// Token arrays placed one after the other.
+type concatTokenArray struct {
+	parts   []TokenArray
+	offsets []int64 // offsets[i] is where part i starts; the last entry is the total length
+}
+
+func newConcatTokenArray(parts []TokenArray) *concatTokenArray {
+	offsets := make([]int64, len(parts)+1)
+	for i, part := range parts {
+		offsets[i+1] = offsets[i] + part.length()
+	}
+	return &concatTokenArray{parts: parts, offsets: offsets}
+}
+
+// Returns the part containing byte pos.
+func (ca *concatTokenArray) partAt(pos int64) int {
+	return sort.Search(len(ca.parts), func(i int) bool {
+		return ca.offsets[i+1] > pos
+	})
+}
+
+func (ca *concatTokenArray) getSlice(start int64, end int64) []byte {
+	if end > ca.length() {
+		panic(fmt.Sprintf("[:%d] is out of bounds", end))
+	}
+
+	part := ca.partAt(start)
+	if part < len(ca.parts) && end <= ca.offsets[part+1] {
+		return ca.parts[part].getSlice(start-ca.offsets[part], end-ca.offsets[part])
+	}
+
+	// the slice spans several parts
+	dest := make([]byte, 0, end-start)
+	for pos := start; pos < end; part++ {
+		stop := min(end, ca.offsets[part+1])
+		dest = append(dest, ca.parts[part].getSlice(pos-ca.offsets[part], stop-ca.offsets[part])...)
+		pos = stop
+	}
+	return dest
+}
+
+func (ca *concatTokenArray) length() int64 {
+	return ca.offsets[len(ca.offsets)-1]
+}
+
+// Wrapper around the suffix arrays of several indices, each over its own
+// tokenized corpus. Will sum over the results of each index. Byte positions are
+// in the concatenation of the members' tokenized corpora; the corpus passed to
+// each method is ignored, as every member searches its own.
+type CompositeSuffixArray struct {
+	members []*indexMember
+}
+
+func (csa *CompositeSuffixArray) retrieveNum(vec TokenArray, query []byte) int {
+	numResults := 0
+	for _, count := range csa.retrieveNumByMember(query) {
+		numResults += count
+	}
+	return numResults
+}
+
+// Retrieve the number of continuations in each member.
+func (csa *CompositeSuffixArray) retrieveNumByMember(query []byte) []int {
+	counts := make([]int, len(csa.members))
+	for i, member := range csa.members {
+		counts[i] = member.model.suffixArray.retrieveNum(member.model.bytesData, query)
+	}
+	return counts
+}
+
+// Retrieve the continuations in every index, or a sample of them if sample isn't
+// nil. The sample is drawn from the ranges of every index together.
+func (csa *CompositeSuffixArray) retrieveSubstrings(vec TokenArray, query []byte, extend int64, sample *supportSample) [][]byte {
+	return sample.substrings(csa.matchRanges(vec, query), int64(len(query))+extend*int64(csa.members[0].model.tokenWidth))
+}
+
+func (csa *CompositeSuffixArray) matchRanges(vec TokenArray, query []byte) []matchRange {
+	ranges := make([]matchRange, 0)
+	for _, member := range csa.members {
+		ranges = append(ranges, member.model.suffixArray.matchRanges(member.model.bytesData, query)...)
+	}
+	return ranges
+}
+
+func (csa *CompositeSuffixArray) retrieveNextTokenCounts(vec TokenArray, query []byte) map[uint32]int64 {
+	counts := make(map[uint32]int64)
+	for _, member := range csa.members {
+		for token, count := range member.model.suffixArray.retrieveNextTokenCounts(member.model.bytesData, query) {
+			counts[token] += count
+		}
+	}
+	return counts
+}
+
+func (csa *CompositeSuffixArray) retrievePositions(vec TokenArray, query []byte) ([]int64, error) {
+	results := make([]int64, 0)
+	for _, member := range csa.members {
+		positions, err := member.model.suffixArray.retrievePositions(member.model.bytesData, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, pos := range positions {
+			results = append(results, member.offset+pos)
+		}
+	}
+	return results, nil
+}
+
+// Opens the complete indices in outpaths as one model over the union of their
+// documents. Document ids and token positions follow the order of outpaths:
+// the documents of each index come after those of the indices before it. Every
+// index must use the same tokenizer, token width and sentinals. If tokenizerHash
+// isn't empty, it must be the hash of the indices' tokenizer. verifyChecksums is
+// passed to openModel.
+func openCompositeModel(outpaths []string, tokenizerHash string, verifyChecksums bool) (*ModelData, error) {
+	if len(outpaths) == 0 {
+		return nil, errors.New("no indices to combine")
+	}
+
+	manifests := make([]*IndexManifest, len(outpaths))
+	for i, outpath := range outpaths {
+		manifest, err := loadManifest(outpath)
+		if err != nil {
+			return nil, err
+		}
+		if !manifest.Complete {
+			return nil, fmt.Errorf("index in %s has not finished building", outpath)
+		}
+		if i > 0 {
+			if err := manifests[0].checkCompatible(manifest); err != nil {
+				return nil, fmt.Errorf("%s and %s can't be combined: %w", outpaths[0], outpath, err)
+			}
+		}
+		manifests[i] = manifest
+	}
+
+	if tokenizerHash != "" && manifests[0].TokenizerHash != tokenizerHash {
+		return nil, fmt.Errorf("indices were built with tokenizer %s (sha256 %s) but the tokenizer has sha256 %s", manifests[0].TokenizerPath, manifests[0].TokenizerHash, tokenizerHash)
+	}
+
+	members := make([]*indexMember, len(outpaths))
+	parts := make([]TokenArray, len(outpaths))
+	offset, firstDoc := int64(0), int64(0)
+	for i, outpath := range outpaths {
+		model, err := openModel(outpath, manifests[i], verifyChecksums)
+		if err != nil {
+			return nil, err
+		}
+
+		members[i] = &indexMember{name: outpath, model: model, offset: offset, firstDoc: firstDoc}
+		parts[i] = model.bytesData
+		offset += model.bytesData.length()
+		firstDoc += model.docs.numDocs
+	}
+
+	return &ModelData{
+		suffixArray:  &CompositeSuffixArray{members: members},
+		bytesData:    newConcatTokenArray(parts),
+		vocabSize:    manifests[0].VocabSize,
+		tokenWidth:   manifests[0].TokenWidth,
+		sentinalSize: manifests[0].SentinalSize,
+		members:      members,
+	}, nil
+}
+
+// Parses a comma separated list of index directories.
+func parseIndexDirs(dirList string) []string {
+	dirs := make([]string, 0)
+	for _, dir := range strings.Split(dirList, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// Returns the number of documents of the model.
+func (m *ModelData) numDocs() int64 {
+	if m.members == nil {
+		return m.docs.numDocs
+	}
+
+	last := m.members[len(m.members)-1]
+	return last.firstDoc + last.model.docs.numDocs
+}
+
+// Returns the member of a composite model holding document docID, and the id of
+// the document within that member.
+func (m *ModelData) memberOfDoc(docID int64) (*indexMember, int64, error) {
+	if docID < 0 || docID >= m.numDocs() {
+		return nil, -1, fmt.Errorf("document %d does not exist: the index has %d documents", docID, m.numDocs())
+	}
+
+	idx := sort.Search(len(m.members), func(i int) bool {
+		return m.members[i].firstDoc > docID
+	}) - 1
+	return m.members[idx], docID - m.members[idx].firstDoc, nil
+}
+
+// Number of occurrences of a query in one index of a model.
+type IndexCount struct {
+	Index string // index directory
+	Count int
+}
+
+// Returns the number of occurrences of queryIds in each index of a composite
+// model, in the order the indices were given. A model over a single index has a
+// single count, with an empty Index.
+func (m *ModelData) CountByIndex(queryIds []uint32) ([]IndexCount, error) {
+	queryEnc, err := intToByte(queryIds, m.tokenWidth)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.members == nil {
+		return []IndexCount{{Count: m.suffixArray.retrieveNum(m.bytesData, queryEnc)}}, nil
+	}
+
+	counts := m.suffixArray.(*CompositeSuffixArray).retrieveNumByMember(queryEnc)
+	result := make([]IndexCount, len(m.members))
+	for i, member := range m.members {
+		result[i] = IndexCount{Index: member.name, Count: counts[i]}
+	}
+	return result, nil
+}
+
+// Number of times each token follows a query in one index of a model.
+type IndexTokenCounts struct {
+	Index  string           // index directory
+	Counts map[uint32]int64 // occurrences of the query followed by each token
+	Total  int64            // occurrences of the query followed by any token
+}
+
+// Returns the number of times each token follows queryIds in each index of a
+// composite model, in the order the indices were given. For the suffix used by
+// NextTokenDistribution, the counts add up to those of its prediction. A model
+// over a single index has a single distribution, with an empty Index.
+func (m *ModelData) NextTokenCountsByIndex(queryIds []uint32) ([]IndexTokenCounts, error) {
+	queryEnc, err := intToByte(queryIds, m.tokenWidth)
+	if err != nil {
+		return nil, err
+	}
+
+	members := m.members
+	if members == nil {
+		members = []*indexMember{{model: m}}
+	}
+
+	result := make([]IndexTokenCounts, len(members))
+	for i, member := range members {
+		result[i] = IndexTokenCounts{Index: member.name, Counts: member.model.suffixArray.retrieveNextTokenCounts(member.model.bytesData, queryEnc)}
+		for _, count := range result[i].Counts {
+			result[i].Total += count
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"maps"
+	"math/rand"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// Tokens of the tokenized corpus of docs, each document ending with a sentinal 0.
+func corpusTokens(docs [][]uint32) []uint32 {
+	tokens := make([]uint32, 0)
+	for _, doc := range docs {
+		tokens = append(append(tokens, doc...), 0)
+	}
+	return tokens
+}
+
+// Number of times each token follows query in tokens, by brute force.
+func naiveNextTokenCounts(tokens, query []uint32) map[uint32]int64 {
+	counts := make(map[uint32]int64)
+	for _, pos := range naiveOccurrences(tokens, query, 1) {
+		if next := int(pos) + len(query); next < len(tokens) {
+			counts[tokens[next]]++
+		}
+	}
+	return counts
+}
+
+func TestCompositeModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// token 7 only occurs in the second index
+	docs := [][][]uint32{randomDocuments(rng, 30, 12, 5), randomDocuments(rng, 20, 12, 5)}
+	docs[1][4] = append(docs[1][4], 7)
+	memberTokens := [][]uint32{corpusTokens(docs[0]), corpusTokens(docs[1])}
+
+	outpaths := make([]string, len(docs))
+	members := make([]*ModelData, len(docs))
+	for i := range docs {
+		// a single chunk each, as continuations don't cross the end of a chunk
+		cfg := testBuildConfig(t, docs[i])
+		members[i] = buildTestIndex(t, cfg)
+		outpaths[i] = cfg.Outpath
+	}
+
+	m, err := openCompositeModel(outpaths, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allTokens := append(slices.Clone(memberTokens[0]), memberTokens[1]...)
+	for _, query := range testQueries(rng, allTokens, []uint32{1, 2, 3, 4, 7}) {
+		// counts are summed over the indices
+		want := int64(0)
+		for i := range members {
+			count, err := members[i].Count(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want += count
+		}
+		if got, err := m.Count(query); err != nil || got != want {
+			t.Fatalf("query %v: %d occurrences (%v), the indices have %d", query, got, err, want)
+		}
+
+		indexCounts, err := m.CountByIndex(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, count := range indexCounts {
+			if wantCount := len(naiveOccurrences(memberTokens[i], query, 1)); count.Index != outpaths[i] || count.Count != wantCount {
+				t.Fatalf("query %v: index %d count %+v, want %d in %s", query, i, count, wantCount, outpaths[i])
+			}
+		}
+
+		// and so are continuations, which never cross from one index to the next
+		prediction, err := m.NextTokenDistribution(query, 1, 1, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prediction.effectiveN < 0 {
+			continue
+		}
+		suffix := query[len(query)-prediction.effectiveN:]
+		byIndex, err := m.NextTokenCountsByIndex(suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := make(map[uint32]int64)
+		for i, indexCounts := range byIndex {
+			wantCounts := naiveNextTokenCounts(memberTokens[i], suffix)
+			if indexCounts.Index != outpaths[i] || !maps.Equal(indexCounts.Counts, wantCounts) {
+				t.Fatalf("query %v: index %d next tokens %+v, want %v after %v", query, i, indexCounts, wantCounts, suffix)
+			}
+			for token, count := range wantCounts {
+				total[token] += count
+			}
+		}
+		if !maps.Equal(prediction.counts, total) {
+			t.Fatalf("query %v: next tokens %v, the indices have %v", query, prediction.counts, total)
+		}
+	}
+
+	// the second index's documents and tokens come after the first's
+	firstTokens := int64(len(memberTokens[0]))
+	firstDocs := int64(len(docs[0]))
+	for id, doc := range docs[1] {
+		got, err := m.GetDocument(firstDocs + int64(id))
+		if err != nil || !slices.Equal(got, doc) {
+			t.Fatalf("document %d is %v (%v), want %v", firstDocs+int64(id), got, err, doc)
+		}
+
+		start, end, err := m.DocumentSpan(firstDocs + int64(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		memberStart, memberEnd, err := members[1].DocumentSpan(int64(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if start != firstTokens+memberStart || end != firstTokens+memberEnd {
+			t.Fatalf("document %d spans [%d, %d), want [%d, %d)", firstDocs+int64(id), start, end, firstTokens+memberStart, firstTokens+memberEnd)
+		}
+
+		if docID, offset, err := m.Locate(end - 1); err != nil || docID != firstDocs+int64(id) || offset != int64(len(doc)-1) {
+			t.Fatalf("token %d is at %d of document %d (%v), want %d of %d", end-1, offset, docID, err, len(doc)-1, firstDocs+int64(id))
+		}
+	}
+	for _, docID := range []int64{-1, firstDocs + int64(len(docs[1]))} {
+		if _, err := m.GetDocument(docID); err == nil {
+			t.Fatalf("document %d of %d exists", docID, m.numDocs())
+		}
+	}
+
+	want := []DocumentMatches{{DocID: firstDocs + 4, Offsets: []int64{int64(len(docs[1][4]) - 1)}}}
+	if got, err := m.FindDocuments([]uint32{7}); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("documents with token 7: %v (%v), want %v", got, err, want)
+	}
+
+	// slices across the end of the first index join both corpora
+	for start := firstTokens - 3; start <= firstTokens; start++ {
+		for end := start; end <= firstTokens+3; end++ {
+			got := m.bytesData.getSlice(start*2, end*2)
+			if wantSlice := encodeTokens(t, allTokens[start:end], 2); !slices.Equal(got, wantSlice) {
+				t.Fatalf("tokens [%d, %d) are %v, want %v", start, end, got, wantSlice)
+			}
+		}
+	}
+}
+
+func TestCompositeModelRejectsIncompatibleIndices(t *testing.T) {
+	docs := randomDocuments(rand.New(rand.NewSource(1)), 10, 12, 5)
+	base := testBuildConfig(t, docs)
+	buildTestIndex(t, base)
+
+	tests := []struct {
+		name   string
+		change func(cfg *BuildConfig)
+	}{
+		{"token width", func(cfg *BuildConfig) { cfg.TokenWidth = 4 }},
+		{"sentinal size", func(cfg *BuildConfig) { cfg.SentinalSize = 2 }},
+		{"vocab size", func(cfg *BuildConfig) { cfg.VocabSize = 2000 }},
+	}
+	for _, tt := range tests {
+		cfg := testBuildConfig(t, docs)
+		tt.change(&cfg)
+		buildTestIndex(t, cfg)
+
+		if _, err := openCompositeModel([]string{base.Outpath, cfg.Outpath}, "", true); err == nil {
+			t.Errorf("%s: combined indices that differ", tt.name)
+		}
+	}
+
+	if _, err := openCompositeModel([]string{base.Outpath, base.Outpath}, "0123", true); err == nil {
+		t.Error("combined indices built with another tokenizer")
+	}
+}
@@ -36,6 +36,7 @@ func loadMemArray(filepath string) (*MemArray, error) {
 // Access the tokenized corpus from a memory-mapped file.
 type MMappedArray struct {
 	mReader *mmap.ReaderAt
+	size    int64 // bytes of the file that belong to the corpus
 }
 
 func loadMMappedArray(filepath string) (*MMappedArray, error) {
@@ -43,10 +44,30 @@ func loadMMappedArray(filepath string) (*MMappedArray, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MMappedArray{mReader: mReader}, nil
+	return &MMappedArray{mReader: mReader, size: int64(mReader.Len())}, nil
+}
+
+// Same as loadMMappedArray, but only the first size bytes of the file are part
+// of the array. Anything after them (e.g., from an append that is still running)
+// is ignored.
+func loadMMappedArrayPrefix(filepath string, size int64) (*MMappedArray, error) {
+	ma, err := loadMMappedArray(filepath)
+	if err != nil {
+		return nil, err
+	}
+	if size > ma.size {
+		ma.mReader.Close()
+		return nil, fmt.Errorf("%s has %d bytes but %d are expected", filepath, ma.size, size)
+	}
+	ma.size = size
+	return ma, nil
 }
 
 func (ma *MMappedArray) getSlice(start int64, end int64) []byte {
+	if end > ma.size {
+		panic(fmt.Sprintf("[:%d] is out of bounds", end))
+	}
+
 	dest := make([]byte, end-start)
 
 	_, err := ma.mReader.ReadAt(dest, start)
@@ -68,5 +89,5 @@ func (ma *MMappedArray) getSlice(start int64, end int64) []byte {
 }
 
 func (ma *MMappedArray) length() int64 {
-	return int64(ma.mReader.Len())
+	return ma.size
 }
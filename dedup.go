@@ -0,0 +1,342 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// Number of spans collected before overlapping spans are merged.
+const dedupMergeInterval = 1 << 20
+
+// Number of suffix array entries between updates of the progress bar.
+const dedupProgressInterval = 1 << 16
+
+// Byte range [start, end) of the tokenized corpus.
+type corpusSpan struct {
+	start int64
+	end   int64
+}
+
+// Collects spans, merging the ones that overlap or touch every so often so that
+// memory use depends on the number of separate duplicated regions.
+type spanSet struct {
+	spans     []corpusSpan
+	numMerged int // number of spans (at the start of spans) that are already merged
+}
+
+func (s *spanSet) add(start, end int64) {
+	s.spans = append(s.spans, corpusSpan{start, end})
+	if len(s.spans)-s.numMerged >= dedupMergeInterval {
+		s.merge()
+	}
+}
+
+// Sorts the spans and merges the ones that overlap or touch.
+func (s *spanSet) merge() []corpusSpan {
+	slices.SortFunc(s.spans, func(a, b corpusSpan) int {
+		return cmp.Compare(a.start, b.start)
+	})
+
+	merged := s.spans[:0]
+	for _, span := range s.spans {
+		if len(merged) > 0 && span.start <= merged[len(merged)-1].end {
+			last := &merged[len(merged)-1]
+			last.end = max(last.end, span.end)
+			continue
+		}
+		merged = append(merged, span)
+	}
+
+	s.spans = merged
+	s.numMerged = len(merged)
+	return merged
+}
+
+// Result of deduplicating an index.
+type dedupReport struct {
+	minTokens     int
+	numTokens     int64 // tokens in the documents that aren't deleted, not counting the sentinals
+	removedTokens int64
+	numSpans      int
+	docsAffected  int64 // documents with at least one duplicated span
+	docsRemoved   int64 // documents that are duplicated in their entirety
+}
+
+// Finds every span of at least minTokens tokens of the index in outpath that
+// occurs more than once, as in ExactSubstr (Lee et al., 2022): neighbouring
+// suffixes in each suffix array that share a prefix of at least minTokens tokens
+// are both marked, up to the end of their documents. Every copy of a repeated
+// span is marked, including repeats within a document. Documents are only compared
+// against the documents in the same suffix array, so runDedup needs the chunks to
+// be merged into one. Deleted documents are ignored. The shared prefixes are read
+// from the LCP array of the suffix array if it has one, and compared in the corpus
+// otherwise. Returns the duplicated spans, sorted and merged.
+func findDuplicateSpans(outpath string, manifest *IndexManifest, vec TokenArray, docs *docIndex, deleted *tombstones, minTokens int) ([]corpusSpan, error) {
+	tokenWidth := int64(manifest.TokenWidth)
+	minBytes := int64(minTokens) * tokenWidth
+	sentinalBytes := int64(manifest.SentinalSize) * tokenWidth
+
+	// end of the tokens of the document containing pos, before its sentinals
+	docEnd := func(pos int64) int64 {
+		id, _ := docs.locate(pos)
+		return docs.end(id) - sentinalBytes
+	}
+
+	spans := &spanSet{}
+	for i, chunk := range manifest.searchChunks() {
+		saPath := path.Join(outpath, chunk.Path)
+		sa, err := makeMMappedSA(saPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := sa.header.checkChunk(chunk, manifest.TokenWidth); err != nil {
+			sa.close()
+			return nil, fmt.Errorf("%s: %w", saPath, err)
+		}
+
+		if chunk.LCPPath != "" {
+			if err := sa.openLCP(path.Join(outpath, chunk.LCPPath)); err != nil {
+				sa.close()
+				return nil, err
+			}
+		}
+
+		bar := progressbar.Default(sa.length(), fmt.Sprintf("finding duplicates (%d)", i))
+
+		// with an LCP array, the LCP of two suffixes with deleted ones between them
+		// is the smallest LCP of the entries in between
+		prevPos, minLCP := int64(-1), int64(math.MaxInt64)
+		for idx := int64(0); idx < sa.length(); idx++ {
+			if idx%dedupProgressInterval == 0 {
+				bar.Add64(min(dedupProgressInterval, sa.length()-idx))
+			}
+			if sa.hasLCP() {
+				minLCP = min(minLCP, sa.lcp(idx))
+			}
+
+			pos := sa.get(idx)
+			if deleted != nil && deleted.isDeleted(pos) {
+				continue
+			}
+
+			if prevPos >= 0 {
+				var lcp int64
+				if sa.hasLCP() {
+					lcp = minLCP * tokenWidth
+				} else {
+					// each suffix stops at the end of its chunk, which is how it was sorted
+					lcp = commonPrefixLength(vec, prevPos, manifest.chunkEnd(prevPos), pos, manifest.chunkEnd(pos))
+					lcp -= lcp % tokenWidth
+				}
+
+				if lcp >= minBytes {
+					lcp = min(lcp, docEnd(prevPos)-prevPos, docEnd(pos)-pos)
+				}
+				if lcp >= minBytes {
+					spans.add(prevPos, prevPos+lcp)
+					spans.add(pos, pos+lcp)
+				}
+			}
+			prevPos, minLCP = pos, math.MaxInt64
+		}
+
+		bar.Finish()
+		sa.close()
+	}
+
+	return spans.merge(), nil
+}
+
+// Summarizes how much of the corpus the duplicated spans cover.
+func makeDedupReport(manifest *IndexManifest, docs *docIndex, deleted *tombstones, spans []corpusSpan, minTokens int) *dedupReport {
+	tokenWidth := int64(manifest.TokenWidth)
+	sentinalSize := int64(manifest.SentinalSize)
+
+	report := &dedupReport{
+		minTokens: minTokens,
+		numTokens: manifest.NumTokens - manifest.NumDocuments*sentinalSize,
+		numSpans:  len(spans),
+	}
+	if deleted != nil {
+		report.numTokens -= deleted.deletedBytes(0, manifest.DataBytes)/tokenWidth - int64(len(deleted.ranges))*sentinalSize
+	}
+
+	// the spans of a document are next to each other, as they are sorted
+	currentDoc, currentRemoved := int64(-1), int64(0)
+	finishDoc := func() {
+		if currentDoc < 0 {
+			return
+		}
+		report.docsAffected++
+		if currentRemoved == (docs.end(currentDoc)-docs.start(currentDoc))/tokenWidth-sentinalSize {
+			report.docsRemoved++
+		}
+	}
+
+	for _, span := range spans {
+		length := (span.end - span.start) / tokenWidth
+		report.removedTokens += length
+
+		id, _ := docs.locate(span.start)
+		if id != currentDoc {
+			finishDoc()
+			currentDoc, currentRemoved = id, 0
+		}
+		currentRemoved += length
+	}
+	finishDoc()
+
+	return report
+}
+
+func (r *dedupReport) print() {
+	fmt.Printf("spans of at least %d tokens that occur more than once: %d\n", r.minTokens, r.numSpans)
+
+	fraction := 0.0
+	if r.numTokens > 0 {
+		fraction = float64(r.removedTokens) / float64(r.numTokens)
+	}
+	fmt.Printf("duplicated tokens: %d of %d (%.2f%%)\n", r.removedTokens, r.numTokens, 100*fraction)
+	fmt.Printf("documents with duplicates: %d, entirely duplicated: %d\n", r.docsAffected, r.docsRemoved)
+}
+
+// Writes the documents of the tokenized corpus without the duplicated spans to
+// filename as raw little endian token ids, each document followed by separator, so
+// that it can be indexed again with the tokens input format. Documents that are
+// deleted or entirely duplicated are left out.
+func writeDedupCorpus(filename string, manifest *IndexManifest, vec TokenArray, docs *docIndex, deleted *tombstones, spans []corpusSpan, separator int) error {
+	separatorBytes := make([]byte, manifest.TokenWidth)
+	if err := putByte(separatorBytes, uint32(separator), 0, manifest.TokenWidth); err != nil {
+		return err
+	}
+
+	out, err := openBufferedFile(filename+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	sentinalBytes := int64(manifest.SentinalSize * manifest.TokenWidth)
+	writeDocs := func() error {
+		next := 0 // first span that doesn't end before the current document
+		for id := int64(0); id < docs.numDocs; id++ {
+			start, end := docs.start(id), docs.end(id)-sentinalBytes
+			if deleted != nil && deleted.isDeleted(start) {
+				continue
+			}
+
+			for next < len(spans) && spans[next].end <= start {
+				next++
+			}
+
+			written := false
+			pos := start
+			for ; next < len(spans) && spans[next].start < end; next++ {
+				if spans[next].start > pos {
+					if err := out.write(vec.getSlice(pos, spans[next].start)); err != nil {
+						return err
+					}
+					written = true
+				}
+				pos = spans[next].end
+			}
+			if pos < end {
+				if err := out.write(vec.getSlice(pos, end)); err != nil {
+					return err
+				}
+				written = true
+			}
+
+			if written {
+				if err := out.write(separatorBytes); err != nil {
+					return err
+				}
+			}
+		}
+		return out.sync()
+	}
+
+	err = writeDocs()
+	if closeErr := out.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename + ".tmp")
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// Finds the spans of at least minTokens tokens that occur more than once in the
+// index in outpath and prints how much of the corpus they cover. If corpusPath
+// isn't empty, the corpus without the duplicated spans is written there, with
+// every document ending in separator.
+func runDedup(outpath string, minTokens int, corpusPath string, separator int) error {
+	if minTokens < 1 {
+		return fmt.Errorf("minimum duplicate length must be at least 1 token, got %d", minTokens)
+	}
+
+	manifest, err := loadManifest(outpath)
+	if err != nil {
+		return err
+	}
+	if !manifest.Complete {
+		return fmt.Errorf("index in %s has not finished building", outpath)
+	}
+	if err := manifest.checkFiles(outpath); err != nil {
+		return err
+	}
+	if err := manifest.checkSuffixArrays("deduplication"); err != nil {
+		return err
+	}
+	if numArrays := len(manifest.searchChunks()); numArrays > 1 {
+		return fmt.Errorf("index in %s has %d suffix arrays and duplicates across them wouldn't be found: merge them with --mode merge first", outpath, numArrays)
+	}
+	if corpusPath != "" {
+		if separator < 0 {
+			return errors.New("writing the deduplicated corpus needs a document separator token")
+		}
+		if err := checkTokenValue(uint64(separator), manifest.TokenWidth); err != nil {
+			return err
+		}
+	}
+
+	vec, err := manifest.openCorpus(outpath)
+	if err != nil {
+		return err
+	}
+
+	docs, err := openDocIndex(outpath, manifest)
+	if err != nil {
+		return err
+	}
+	defer docs.close()
+
+	deleted, _, err := loadTombstones(outpath, manifest)
+	if err != nil {
+		return err
+	}
+
+	spans, err := findDuplicateSpans(outpath, manifest, vec, docs, deleted, minTokens)
+	if err != nil {
+		return err
+	}
+
+	makeDedupReport(manifest, docs, deleted, spans, minTokens).print()
+
+	if corpusPath != "" {
+		fmt.Println("Writing deduplicated corpus to", corpusPath)
+		if err := writeDedupCorpus(corpusPath, manifest, vec, docs, deleted, spans, separator); err != nil {
+			return err
+		}
+		fmt.Printf("Index it with --input_format %s --input_token_width %d --doc_separator %d\n", inputTokens, manifest.TokenWidth, separator)
+	}
+
+	return nil
+}
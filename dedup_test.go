@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Marks the tokens of every span of at least minTokens tokens that occurs more
+// than once in the documents that aren't deleted, by comparing every pair of
+// positions.
+func naiveDuplicates(docs [][]uint32, isDeleted map[int]bool, minTokens int) []bool {
+	// the corpus and where the document of each of its tokens ends
+	tokens, docEnds := make([]uint32, 0), make([]int, 0)
+	for id, doc := range docs {
+		end := len(tokens) + len(doc)
+		for range len(doc) + 1 {
+			if isDeleted[id] {
+				docEnds = append(docEnds, -1)
+			} else {
+				docEnds = append(docEnds, end)
+			}
+		}
+		tokens = append(append(tokens, doc...), 0)
+	}
+
+	duplicated := make([]bool, len(tokens))
+	for p := range tokens {
+		longest := 0
+		for q := range tokens {
+			if p == q || docEnds[p] < 0 || docEnds[q] < 0 {
+				continue
+			}
+			length := 0
+			for p+length < docEnds[p] && q+length < docEnds[q] && tokens[p+length] == tokens[q+length] {
+				length++
+			}
+			longest = max(longest, length)
+		}
+		if longest >= minTokens {
+			for i := p; i < p+longest; i++ {
+				duplicated[i] = true
+			}
+		}
+	}
+	return duplicated
+}
+
+func TestDedupMatchesNaive(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 5; trial++ {
+		docs := randomDocuments(rng, 40, 12, 3)
+		// copies of whole documents and of their ends
+		for i := 0; i < 5; i++ {
+			doc := docs[rng.Intn(len(docs))]
+			docs = append(docs, slices.Clone(doc[rng.Intn(len(doc)):]))
+		}
+		cfg := testBuildConfig(t, docs)
+		cfg.ChunkSize = 200
+		// the LCP arrays, when built, replace comparing the suffixes
+		cfg.BuildLCP = trial%2 == 1
+		buildTestIndex(t, cfg)
+
+		if err := runDedup(cfg.Outpath, 3, "", -1); err == nil {
+			t.Fatal("deduplicated the chunks without merging them")
+		}
+		if err := runMerge(cfg.Outpath); err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := loadManifest(cfg.Outpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasLCP := manifest.searchChunks()[0].LCPPath != ""; hasLCP != cfg.BuildLCP {
+			t.Fatalf("trial %d: merged chunk has an LCP array: %v, want %v", trial, hasLCP, cfg.BuildLCP)
+		}
+
+		isDeleted := make(map[int]bool)
+		ids := []int64{rng.Int63n(int64(len(docs))), rng.Int63n(int64(len(docs)))}
+		if err := runDelete(cfg.Outpath, ids); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			isDeleted[int(id)] = true
+		}
+
+		for _, minTokens := range []int{1, 3, 5} {
+			want := naiveDuplicates(docs, isDeleted, minTokens)
+			got := make([]bool, len(want))
+			for _, span := range findTestDuplicateSpans(t, cfg.Outpath, minTokens) {
+				for pos := span.start; pos < span.end; pos += 2 {
+					got[pos/2] = true
+				}
+			}
+			if !slices.Equal(got, want) {
+				t.Fatalf("trial %d, deleted %v, %d tokens: duplicated %v, want %v", trial, isDeleted, minTokens, got, want)
+			}
+
+			// the deduplicated corpus keeps the rest of each document that is left
+			corpusPath := filepath.Join(t.TempDir(), "deduped.bin")
+			if err := runDedup(cfg.Outpath, minTokens, corpusPath, testDocSeparator); err != nil {
+				t.Fatal(err)
+			}
+			corpus, err := readBytesFromFile(corpusPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantCorpus := make([]int, 0)
+			pos := 0
+			for id, doc := range docs {
+				kept := make([]int, 0)
+				for i, token := range doc {
+					if !want[pos+i] {
+						kept = append(kept, int(token))
+					}
+				}
+				if !isDeleted[id] && len(kept) > 0 {
+					wantCorpus = append(append(wantCorpus, kept...), testDocSeparator)
+				}
+				pos += len(doc) + 1
+			}
+			if gotCorpus := byteToInt(corpus, 2); !slices.Equal(gotCorpus, wantCorpus) {
+				t.Fatalf("trial %d, deleted %v, %d tokens: deduplicated corpus %v, want %v", trial, isDeleted, minTokens, gotCorpus, wantCorpus)
+			}
+		}
+	}
+}
+
+// Finds the duplicated spans of at least minTokens tokens of the index in outpath.
+func findTestDuplicateSpans(t *testing.T, outpath string, minTokens int) []corpusSpan {
+	t.Helper()
+	manifest, err := loadManifest(outpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vec, err := manifest.openCorpus(outpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := openDocIndex(outpath, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docs.close()
+	deleted, _, err := loadTombstones(outpath, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans, err := findDuplicateSpans(outpath, manifest, vec, docs, deleted, minTokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spans
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+
+	"golang.org/x/exp/mmap"
+)
+
+// The document offsets file holds the byte position in the tokenized corpus where
+// each document starts, as little endian int64s. Document ids are the order of
+// the documents in the tokenized corpus, starting at 0.
+const (
+	docOffsetsFilename = "doc_offsets.bin"
+	docOffsetSize      = 8
+)
+
+func encodeDocOffset(offset int64) []byte {
+	buf := make([]byte, docOffsetSize)
+	binary.LittleEndian.PutUint64(buf, uint64(offset))
+	return buf
+}
+
+// Access the document offsets from a memory-mapped file.
+type docIndex struct {
+	mReader   *mmap.ReaderAt
+	numDocs   int64
+	dataBytes int64 // end of the last document
+}
+
+// Opens the document offsets of the index described by manifest. Offsets past
+// the documents recorded in the manifest (e.g., from an append that is still
+// running) are ignored.
+func openDocIndex(outpath string, manifest *IndexManifest) (*docIndex, error) {
+	docsPath := path.Join(outpath, manifest.DocOffsetsPath)
+	mReader, err := mmap.Open(docsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(mReader.Len()) < manifest.NumDocuments*docOffsetSize {
+		mReader.Close()
+		return nil, fmt.Errorf("%s has %d bytes but %d documents are expected", docsPath, mReader.Len(), manifest.NumDocuments)
+	}
+
+	return &docIndex{mReader: mReader, numDocs: manifest.NumDocuments, dataBytes: manifest.DataBytes}, nil
+}
+
+// Returns the byte position where document id starts.
+func (d *docIndex) start(id int64) int64 {
+	if id < 0 || id >= d.numDocs {
+		panic(fmt.Sprintf("document %d is out of bounds", id))
+	}
+
+	buf := make([]byte, docOffsetSize)
+	if _, err := d.mReader.ReadAt(buf, id*docOffsetSize); err != nil {
+		panic(err)
+	}
+	return int64(binary.LittleEndian.Uint64(buf))
+}
+
+// Returns one past the last byte of document id, including its sentinals.
+func (d *docIndex) end(id int64) int64 {
+	if id == d.numDocs-1 {
+		return d.dataBytes
+	}
+	return d.start(id + 1)
+}
+
+// Returns the id of the document containing byte pos of the tokenized corpus and
+// the byte offset of pos within that document.
+func (d *docIndex) locate(pos int64) (int64, int64) {
+	if pos < 0 || pos >= d.dataBytes {
+		panic(fmt.Sprintf("byte %d is out of bounds", pos))
+	}
+
+	// first document that starts after pos
+	next := sort.Search(int(d.numDocs), func(i int) bool {
+		return d.start(int64(i)) > pos
+	})
+	id := int64(next) - 1
+	return id, pos - d.start(id)
+}
+
+func (d *docIndex) close() error {
+	return d.mReader.Close()
+}
+
+// Occurrences of a query in a single document.
+type DocumentMatches struct {
+	DocID    int64
+	Offsets  []int64         // token offsets of the occurrences within the document, in increasing order
+	Metadata json.RawMessage // metadata fields of the document; nil if the index keeps no metadata
+}
+
+// Returns the id of the document containing token pos of the tokenized corpus
+// and the token offset of pos within that document.
+func (m *ModelData) Locate(pos int64) (int64, int64, error) {
+	bytePos := pos * int64(m.tokenWidth)
+	if pos < 0 || bytePos >= m.bytesData.length() {
+		return -1, -1, fmt.Errorf("token %d is out of bounds", pos)
+	}
+
+	if m.members != nil {
+		member := m.members[m.bytesData.(*concatTokenArray).partAt(bytePos)]
+		id, offset, err := member.model.Locate((bytePos - member.offset) / int64(m.tokenWidth))
+		return member.firstDoc + id, offset, err
+	}
+
+	id, offset := m.docs.locate(bytePos)
+	return id, offset / int64(m.tokenWidth), nil
+}
+
+// Returns the span [start, end) of tokens of document docID in the tokenized
+// corpus, not including the sentinals at the end of the document.
+func (m *ModelData) DocumentSpan(docID int64) (int64, int64, error) {
+	if m.members != nil {
+		member, id, err := m.memberOfDoc(docID)
+		if err != nil {
+			return -1, -1, err
+		}
+		start, end, err := member.model.DocumentSpan(id)
+		memberStart := member.offset / int64(m.tokenWidth)
+		return memberStart + start, memberStart + end, err
+	}
+
+	if docID < 0 || docID >= m.docs.numDocs {
+		return -1, -1, fmt.Errorf("document %d does not exist: the index has %d documents", docID, m.docs.numDocs)
+	}
+
+	tokenWidth := int64(m.tokenWidth)
+	start := m.docs.start(docID) / tokenWidth
+	end := m.docs.end(docID)/tokenWidth - int64(m.sentinalSize)
+	return start, end, nil
+}
+
+// Returns the tokens of document docID, not including the sentinals. Returns an
+// error if the document doesn't exist or was deleted.
+func (m *ModelData) GetDocument(docID int64) ([]uint32, error) {
+	if m.members != nil {
+		member, id, err := m.memberOfDoc(docID)
+		if err != nil {
+			return nil, err
+		}
+		return member.model.GetDocument(id)
+	}
+
+	start, end, err := m.DocumentSpan(docID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenWidth := int64(m.tokenWidth)
+	if m.deleted != nil && m.deleted.isDeleted(start*tokenWidth) {
+		return nil, fmt.Errorf("document %d is deleted", docID)
+	}
+
+	docBytes := m.bytesData.getSlice(start*tokenWidth, end*tokenWidth)
+	return intToUint32(byteToInt(docBytes, m.tokenWidth)), nil
+}
+
+// Returns the metadata fields of document docID as a JSON object, or nil if the
+// index keeps no metadata.
+func (m *ModelData) GetMetadata(docID int64) (json.RawMessage, error) {
+	if m.members != nil {
+		member, id, err := m.memberOfDoc(docID)
+		if err != nil {
+			return nil, err
+		}
+		return member.model.GetMetadata(id)
+	}
+
+	if docID < 0 || docID >= m.docs.numDocs {
+		return nil, fmt.Errorf("document %d does not exist: the index has %d documents", docID, m.docs.numDocs)
+	}
+	if m.metadata == nil {
+		return nil, nil
+	}
+	return m.metadata.get(docID)
+}
+
+// Returns the documents containing queryIds, ordered by document id, along with
+// where it occurs in each of them and their metadata. Occurrences inside deleted
+// documents are skipped.
+func (m *ModelData) FindDocuments(queryIds []uint32) ([]DocumentMatches, error) {
+	if m.members != nil {
+		matches := make([]DocumentMatches, 0)
+		for _, member := range m.members {
+			memberMatches, err := member.model.FindDocuments(queryIds)
+			if err != nil {
+				return nil, err
+			}
+			for _, match := range memberMatches {
+				match.DocID += member.firstDoc
+				matches = append(matches, match)
+			}
+		}
+		return matches, nil
+	}
+
+	queryEnc, err := intToByte(queryIds, m.tokenWidth)
+	if err != nil {
+		return nil, err
+	}
+
+	positions, err := m.suffixArray.retrievePositions(m.bytesData, queryEnc)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(positions)
+
+	matches := make([]DocumentMatches, 0)
+	for _, pos := range positions {
+		id, offset := m.docs.locate(pos)
+		if len(matches) == 0 || matches[len(matches)-1].DocID != id {
+			matches = append(matches, DocumentMatches{DocID: id})
+		}
+
+		last := &matches[len(matches)-1]
+		last.Offsets = append(last.Offsets, offset/int64(m.tokenWidth))
+	}
+
+	for i := range matches {
+		if matches[i].Metadata, err = m.GetMetadata(matches[i].DocID); err != nil {
+			return nil, err
+		}
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Documents of the index built by buildDocsTestIndex. Each ends with two
+// sentinals, so the documents start at tokens 0, 5 and 8.
+var testDocs = [][]uint32{{1, 2, 3}, {4}, {2, 3, 5, 2}}
+
+func buildDocsTestIndex(t *testing.T) *ModelData {
+	t.Helper()
+	cfg := testBuildConfig(t, testDocs)
+	cfg.SentinalSize = 2
+	return buildTestIndex(t, cfg)
+}
+
+func TestDocIndexLocate(t *testing.T) {
+	m := buildDocsTestIndex(t)
+	tests := []struct {
+		pos        int64
+		id, offset int64
+	}{
+		{0, 0, 0},   // first byte of the first document
+		{5, 0, 5},   // inside of a token
+		{6, 0, 6},   // first sentinal of the first document
+		{9, 0, 9},   // last byte of its sentinals
+		{10, 1, 0},  // start of the next document
+		{14, 1, 4},  // sentinal of a one token document
+		{16, 2, 0},  // start of the last document
+		{27, 2, 11}, // last byte of the corpus
+	}
+	for _, test := range tests {
+		if id, offset := m.docs.locate(test.pos); id != test.id || offset != test.offset {
+			t.Errorf("locate(%d) = %d, %d, want %d, %d", test.pos, id, offset, test.id, test.offset)
+		}
+	}
+}
+
+func TestDocumentSpan(t *testing.T) {
+	m := buildDocsTestIndex(t)
+	tests := []struct {
+		docID      int64
+		start, end int64
+		ok         bool
+	}{
+		{0, 0, 3, true},
+		{1, 5, 6, true},
+		{2, 8, 12, true},
+		{3, -1, -1, false},
+		{-1, -1, -1, false},
+	}
+	for _, test := range tests {
+		start, end, err := m.DocumentSpan(test.docID)
+		if (err == nil) != test.ok || start != test.start || end != test.end {
+			t.Errorf("DocumentSpan(%d) = %d, %d (%v), want %d, %d", test.docID, start, end, err, test.start, test.end)
+		}
+	}
+}
+
+func TestFindDocuments(t *testing.T) {
+	m := buildDocsTestIndex(t)
+	tests := []struct {
+		query []uint32
+		want  []DocumentMatches
+	}{
+		{[]uint32{1, 2}, []DocumentMatches{{DocID: 0, Offsets: []int64{0}}}},
+		{[]uint32{5, 2}, []DocumentMatches{{DocID: 2, Offsets: []int64{2}}}},
+		{[]uint32{2}, []DocumentMatches{{DocID: 0, Offsets: []int64{1}}, {DocID: 2, Offsets: []int64{0, 3}}}},
+		// occurrences that start in the sentinals belong to the document before them
+		{[]uint32{0, 4}, []DocumentMatches{{DocID: 0, Offsets: []int64{4}}}},
+		{[]uint32{0, 0}, []DocumentMatches{{DocID: 0, Offsets: []int64{3}}, {DocID: 1, Offsets: []int64{1}}, {DocID: 2, Offsets: []int64{4}}}},
+		{[]uint32{7}, []DocumentMatches{}},
+	}
+	for _, test := range tests {
+		got, err := m.FindDocuments(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("FindDocuments(%v) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
@@ -3,59 +3,68 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
+	"compress/gzip"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
 )
 
-// Writes the even indices into filename with offset added to each value.
-// For writing the suffix array indices to disk: only the even indices align
-// with byte boundaries.
-// Only even indices are written as the tokens are in uint16 format, but the
-// suffix array indices correspond to the location of the bytes.
+// Writes the token-aligned indices into filename with offset added to each value.
+// For writing the suffix array indices to disk: only indices that are a multiple
+// of tokenWidth align with token boundaries.
+// The suffix array indices correspond to the location of the bytes, so the
+// remaining indices point into the middle of a token and are skipped.
 // The offset is needed as suffix arrays are constructed in chunks. But the
-// tokenized corpus is a continguous array.
-func writeIndicesToFile(filename string, indicesOut []int64, offset int64) error {
-	f, err := os.Create(filename)
+// tokenized corpus is a continguous array. Returns the number of indices written.
+func writeIndicesToFile(filename string, indicesOut []int64, offset int64, tokenWidth int) (int64, error) {
+	saWriter, err := createSAFile(filename, tokenWidth, offset, int64(len(indicesOut)))
 	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	// create a buffered writer
-	bufWriter := bufio.NewWriter(f)
-
-	// write placeholder value for the length
-	if err = binary.Write(bufWriter, binary.LittleEndian, int64(0)); err != nil {
-		return err
+		return 0, err
 	}
 
 	// write indices
-	length := 0
 	for _, v := range indicesOut {
-		if v%2 == 0 { // if aligns with byte boundary
-			if err = binary.Write(bufWriter, binary.LittleEndian, v+offset); err != nil {
-				return err
+		if v%int64(tokenWidth) == 0 { // if aligns with token boundary
+			if err = saWriter.write(v + offset); err != nil {
+				saWriter.abort()
+				return 0, err
 			}
-			length++
 		}
 	}
 
-	// flush the buffer to write the data to the file
-	if err = bufWriter.Flush(); err != nil {
-		return err
+	if err = saWriter.close(); err != nil {
+		return 0, err
 	}
 
-	// write the length
-	if _, err = f.Seek(0, io.SeekStart); err != nil {
-		return err
+	return saWriter.header.numEntries, nil
+}
+
+// Writes the suffix array of a chunk sorted over tokens into filename. Each
+// token index is converted to the byte position of the token in the tokenized
+// corpus, where the chunk starts at byte offset. Returns the number of indices written.
+func writeTokenIndicesToFile(filename string, tokenIndices []int32, offset int64, tokenWidth int) (int64, error) {
+	saWriter, err := createSAFile(filename, tokenWidth, offset, int64(len(tokenIndices))*int64(tokenWidth))
+	if err != nil {
+		return 0, err
 	}
-	if err = binary.Write(f, binary.LittleEndian, int64(length)); err != nil {
-		return err
+
+	for _, v := range tokenIndices {
+		if err = saWriter.write(int64(v)*int64(tokenWidth) + offset); err != nil {
+			saWriter.abort()
+			return 0, err
+		}
 	}
 
-	return nil
+	if err = saWriter.close(); err != nil {
+		return 0, err
+	}
+
+	return saWriter.header.numEntries, nil
 }
 
 func readBytesFromFile(filename string) ([]byte, error) {
@@ -71,32 +80,13 @@ func readBytesFromFile(filename string) ([]byte, error) {
 	}
 
 	bytes := make([]byte, info.Size())
-	_, err = f.Read(bytes)
+	_, err = io.ReadFull(f, bytes)
 	if err != nil {
 		return nil, err
 	}
 	return bytes, nil
 }
 
-func readInt64FromFile(filename string) ([]int64, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	var length int64
-	if err = binary.Read(f, binary.LittleEndian, &length); err != nil {
-		return nil, err
-	}
-
-	int64s := make([]int64, length)
-	if err = binary.Read(f, binary.LittleEndian, &int64s); err != nil {
-		return nil, err
-	}
-	return int64s, nil
-}
-
 func makeFolder(folderPath string) error {
 	info, err := os.Stat(folderPath)
 	if err == nil {
@@ -140,8 +130,106 @@ func splitAt(substring string) func(data []byte, atEOF bool) (advance int, token
 	}
 }
 
-func readDocuments(filename, lineSplit string, callback func(*string) error) error {
+// Counts the bytes read through it.
+type countingReader struct {
+	r      io.Reader
+	onRead func(n int)
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.onRead(n)
+	return n, err
+}
+
+// An input file, decompressed if needed.
+type inputReader struct {
+	io.Reader
+	file         *os.File
+	decompressor io.Closer // nil for uncompressed files
+}
+
+func (ir *inputReader) Close() error {
+	if ir.decompressor != nil {
+		ir.decompressor.Close()
+	}
+	return ir.file.Close()
+}
+
+// Returns whether filename is decompressed as it is read.
+func isCompressed(filename string) bool {
+	return strings.HasSuffix(filename, ".gz") || strings.HasSuffix(filename, ".zst")
+}
+
+// Opens filename and positions it at byte start of its contents. Files ending in
+// .gz or .zst are decompressed as they are read, and start is a position in the
+// decompressed contents. If onRead isn't nil, it is called with the number of
+// bytes read from disk (before decompression), including those skipped to get to start.
+func openInput(filename string, start int64, onRead func(n int)) (*inputReader, error) {
 	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	input := &inputReader{Reader: file, file: file}
+
+	compressed := isCompressed(filename)
+	if !compressed {
+		if _, err := file.Seek(start, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if onRead != nil {
+			onRead(int(start))
+		}
+	}
+
+	var raw io.Reader = file
+	if onRead != nil {
+		raw = &countingReader{r: file, onRead: onRead}
+	}
+	raw = bufio.NewReaderSize(raw, 64*1024)
+
+	switch {
+	case strings.HasSuffix(filename, ".gz"):
+		gz, err := gzip.NewReader(raw)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		input.Reader, input.decompressor = gz, gz
+	case strings.HasSuffix(filename, ".zst"):
+		zr, err := zstd.NewReader(raw)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		input.Reader, input.decompressor = zr, zr.IOReadCloser()
+	default:
+		input.Reader = raw
+	}
+
+	if compressed {
+		// compressed streams can't seek, so decompress up to start
+		if _, err := io.CopyN(io.Discard, input, start); err != nil {
+			input.Close()
+			return nil, fmt.Errorf("%s: skipping to byte %d: %w", filename, start, err)
+		}
+	}
+
+	return input, nil
+}
+
+func readDocuments(filename, lineSplit string, callback func(*string) error) error {
+	return readDocumentsFrom(filename, lineSplit, 0, nil, func(lineP *string, end int64) error {
+		return callback(lineP)
+	})
+}
+
+// Same as readDocuments, but starts reading at byte start of filename (see
+// openInput). callback also gets the byte position just past the document and
+// its separator, which is where reading would resume after it.
+func readDocumentsFrom(filename, lineSplit string, start int64, onRead func(n int), callback func(lineP *string, end int64) error) error {
+	file, err := openInput(filename, start, onRead)
 	if err != nil {
 		return err
 	}
@@ -149,7 +237,13 @@ func readDocuments(filename, lineSplit string, callback func(*string) error) err
 
 	scanner := bufio.NewScanner(file)
 
-	scanner.Split(splitAt(lineSplit))
+	offset := start
+	split := splitAt(lineSplit)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := split(data, atEOF)
+		offset += int64(advance)
+		return advance, token, err
+	})
 
 	buf := make([]byte, 0, 64*1024)
 	scanner.Buffer(buf, 16384*1024) // max doc size of ~16mb
@@ -157,7 +251,7 @@ func readDocuments(filename, lineSplit string, callback func(*string) error) err
 	for scanner.Scan() {
 		line := scanner.Text()
 
-		err = callback(&line)
+		err = callback(&line, offset)
 		if err != nil {
 			return err
 		}
@@ -170,6 +264,34 @@ func readDocuments(filename, lineSplit string, callback func(*string) error) err
 	return nil
 }
 
+// Reads the JSON values (e.g., the records of a JSONL file) in filename one at a
+// time, starting at byte start (see openInput). Values may span several lines.
+// callback gets the raw value and the byte position just past it, which is where
+// reading would resume after it.
+func readJSONDocumentsFrom(filename string, start int64, onRead func(n int), callback func(recordP *string, end int64) error) error {
+	file, err := openInput(filename, start, onRead)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: invalid JSON at byte %d: %w", filename, start+decoder.InputOffset(), err)
+		}
+
+		record := string(raw)
+		if err := callback(&record, start+decoder.InputOffset()); err != nil {
+			return err
+		}
+	}
+}
+
 func numLines(filename string, lineBoundary string) (int, error) {
 	counter := 0
 	err := readDocuments(filename, lineBoundary, func(lineP *string) error {
@@ -182,26 +304,25 @@ func numLines(filename string, lineBoundary string) (int, error) {
 // Reads as many documents as possible (delineated by the sentinal) from filename into slice chunk.
 // Will try to read as many documents as possible into chunk, then call callback
 // with the length of the values read. The function callback is called everytime
-// the chunk is full.
-func documentIter(filename string, sentinalSize, sentinalValue int, chunk []byte, callback func(int) error) error {
+// the chunk is full. Each token takes up tokenWidth bytes. Only the bytes in
+// [start, end) of the file are read. The chunk boundaries only depend on the
+// contents of the file and the size of chunk.
+func documentIter(filename string, start, end int64, sentinalSize, sentinalValue, tokenWidth int, chunk []byte, callback func(int) error) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	bufferSize := 1024 * 1024 // 1mb
-	if len(chunk) < bufferSize {
-		return errors.New("chunk smaller than read buffer")
-	}
+	bufferSize := min(1024*1024, len(chunk)) // 1mb
 
-	reader := bufio.NewReader(file)
+	reader := bufio.NewReader(io.NewSectionReader(file, start, end-start))
 	buffer := make([]byte, bufferSize)
 
 	chunkIdx := 0
 
 	callbackReset := func(chunkLength int) error {
-		lastSentinal := findLastSentinal(chunk, chunkLength, sentinalSize, sentinalValue)
+		lastSentinal := findLastSentinal(chunk, chunkLength, sentinalSize, sentinalValue, tokenWidth)
 
 		// sentinal not found which means that there's a document
 		// larger than the chunk size
@@ -209,7 +330,7 @@ func documentIter(filename string, sentinalSize, sentinalValue int, chunk []byte
 			return errors.New("chunk too small")
 		}
 
-		adjustedLength := lastSentinal + sentinalSize*2
+		adjustedLength := lastSentinal + sentinalSize*tokenWidth
 
 		err := callback(adjustedLength)
 		if err != nil {
@@ -232,7 +353,7 @@ func documentIter(filename string, sentinalSize, sentinalValue int, chunk []byte
 					break
 				}
 
-				if !hasSentinal(chunk, chunkIdx, sentinalSize, sentinalValue) {
+				if !hasSentinal(chunk, chunkIdx, sentinalSize, sentinalValue, tokenWidth) {
 					return errors.New("file does not end with sentinal")
 				}
 
@@ -246,27 +367,33 @@ func documentIter(filename string, sentinalSize, sentinalValue int, chunk []byte
 			break
 		}
 
-		if chunkIdx+nread > cap(chunk) {
-			err := callbackReset(chunkIdx)
-			if err != nil {
-				return err
+		// fill the chunk up completely before handing it off
+		readValues := buffer[:nread]
+		for len(readValues) > 0 {
+			if chunkIdx == len(chunk) {
+				err := callbackReset(chunkIdx)
+				if err != nil {
+					return err
+				}
 			}
+
+			ncopied := copy(chunk[chunkIdx:], readValues)
+			chunkIdx += ncopied
+			readValues = readValues[ncopied:]
 		}
-		copy(chunk[chunkIdx:], buffer[:nread])
-		chunkIdx += nread
 	}
 
 	return nil
 }
 
-func hasSentinal(values []byte, length, sentinalSize, sentinalValue int) bool {
-	if length < sentinalSize*2 {
+func hasSentinal(values []byte, length, sentinalSize, sentinalValue, tokenWidth int) bool {
+	if length < sentinalSize*tokenWidth || length%tokenWidth != 0 {
 		return false
 	}
 
-	for j := 2; j <= sentinalSize*2; j += 2 {
-		valInt := binary.LittleEndian.Uint16(values[length-j : length-(j-2)])
-		if valInt != uint16(sentinalValue) {
+	numTokens := length / tokenWidth
+	for j := 1; j <= sentinalSize; j++ {
+		if getToken(values, numTokens-j, tokenWidth) != uint32(sentinalValue) {
 			return false
 		}
 	}
@@ -274,19 +401,22 @@ func hasSentinal(values []byte, length, sentinalSize, sentinalValue int) bool {
 	return true
 }
 
-func findLastSentinal(values []byte, length, sentinalSize, sentinalValue int) int {
-	for i := length - sentinalSize*2; i >= 0; i -= 2 {
+// Returns the byte position of the last run of sentinalSize sentinals within
+// the first length bytes of values, or -1 if there is none. Only positions that
+// align with token boundaries are considered.
+func findLastSentinal(values []byte, length, sentinalSize, sentinalValue, tokenWidth int) int {
+	numTokens := length / tokenWidth
+	for i := numTokens - sentinalSize; i >= 0; i-- {
 		found := true
-		for j := 2; j <= sentinalSize*2; j += 2 {
-			valInt := binary.LittleEndian.Uint16(values[i+j-2 : i+j])
-			if valInt != uint16(sentinalValue) {
+		for j := 0; j < sentinalSize; j++ {
+			if getToken(values, i+j, tokenWidth) != uint32(sentinalValue) {
 				found = false
 				break
 			}
 		}
 
 		if found {
-			return i
+			return i * tokenWidth
 		}
 	}
 
@@ -308,6 +438,31 @@ func writeStringToFile(filename string, data string) error {
 	return nil
 }
 
+// Writes data to filename such that readers either see the old contents or all
+// of the new contents: the data is written to a temporary file, synced to disk,
+// then renamed over filename.
+func writeFileAtomic(filename string, data []byte) error {
+	tmpFilename := filename + ".tmp"
+
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+
+	return os.Rename(tmpFilename, filename)
+}
+
 func readStringFromFile(filename string) (string, error) {
 	dataBytes, err := readBytesFromFile(filename)
 	if err != nil {
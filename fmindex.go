@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math/bits"
+	"os"
+	"path"
+	"sort"
+)
+
+// Index backends: a suffix array per chunk, or an FM-index per chunk.
+const (
+	backendSA = "sa"
+	backendFM = "fm"
+)
+
+// Checks that backend is a known index backend.
+func validateBackend(backend string) error {
+	if backend != backendSA && backend != backendFM {
+		return fmt.Errorf("unknown index backend %q: use %s or %s", backend, backendSA, backendFM)
+	}
+	return nil
+}
+
+// On-disk format of an FM-index file. All values are little endian.
+//
+//	offset  size  field
+//	0       8     magic ("INFGRMFM")
+//	8       4     format version
+//	12      4     token width: bytes per token in the tokenized corpus
+//	16      4     sample rate: every sample rate-th token position is sampled
+//	20      4     alphabet size: number of distinct tokens in the chunk
+//	24      8     number of tokens
+//	32      8     base offset: first byte of the chunk in the tokenized corpus
+//	40      8     span: number of bytes of the tokenized corpus covered by the chunk
+//	48      8     CRC-64 (ECMA) checksum of everything after the header
+//	56      8     reserved (zero)
+//	64      -     alphabet: the tokens of the chunk in byte order, 4 bytes each
+//	-       -     counts: number of BWT symbols smaller than each symbol, 8 bytes each (alphabet size + 2)
+//	-       -     wavelet tree levels: number of zeros (8 bytes), then the bits (8 bytes per 64 rows)
+//	-       -     sampled rows: a bit per row (8 bytes per 64 rows)
+//	-       -     samples: token position within the chunk of each sampled row, in row order, 4 bytes each
+//
+// The BWT has a row per token plus one for the end of the chunk. Symbol 0 is the
+// end of the chunk and symbol s > 0 is token s-1 of the alphabet.
+const (
+	fmMagic      = "INFGRMFM"
+	fmVersion    = 1
+	fmHeaderSize = 64
+)
+
+// Default number of token positions per sampled suffix array entry.
+const defaultFMSampleRate = 32
+
+// Header at the start of every FM-index file.
+type fmHeader struct {
+	version      uint32
+	tokenWidth   int
+	sampleRate   int
+	alphabetSize int
+	numTokens    int64
+	baseOffset   int64
+	span         int64
+	checksum     uint64
+}
+
+func (h *fmHeader) encode() []byte {
+	buf := make([]byte, fmHeaderSize)
+	copy(buf, fmMagic)
+	binary.LittleEndian.PutUint32(buf[8:], h.version)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(h.tokenWidth))
+	binary.LittleEndian.PutUint32(buf[16:], uint32(h.sampleRate))
+	binary.LittleEndian.PutUint32(buf[20:], uint32(h.alphabetSize))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(h.numTokens))
+	binary.LittleEndian.PutUint64(buf[32:], uint64(h.baseOffset))
+	binary.LittleEndian.PutUint64(buf[40:], uint64(h.span))
+	binary.LittleEndian.PutUint64(buf[48:], h.checksum)
+	return buf
+}
+
+func decodeFMHeader(buf []byte) (*fmHeader, error) {
+	if len(buf) < fmHeaderSize || string(buf[:8]) != fmMagic {
+		return nil, errors.New("not an FM-index file")
+	}
+
+	h := &fmHeader{
+		version:      binary.LittleEndian.Uint32(buf[8:]),
+		tokenWidth:   int(binary.LittleEndian.Uint32(buf[12:])),
+		sampleRate:   int(binary.LittleEndian.Uint32(buf[16:])),
+		alphabetSize: int(binary.LittleEndian.Uint32(buf[20:])),
+		numTokens:    int64(binary.LittleEndian.Uint64(buf[24:])),
+		baseOffset:   int64(binary.LittleEndian.Uint64(buf[32:])),
+		span:         int64(binary.LittleEndian.Uint64(buf[40:])),
+		checksum:     binary.LittleEndian.Uint64(buf[48:]),
+	}
+
+	if h.version != fmVersion {
+		return nil, fmt.Errorf("unsupported FM-index version %d (expected %d)", h.version, fmVersion)
+	}
+	if err := validateTokenWidth(h.tokenWidth); err != nil {
+		return nil, err
+	}
+	if h.sampleRate < 1 || h.numTokens < 0 || h.baseOffset < 0 || h.span < 0 {
+		return nil, errors.New("corrupt FM-index header")
+	}
+	return h, nil
+}
+
+// Checks that the header describes the given chunk of a corpus made of
+// tokenWidth-byte tokens.
+func (h *fmHeader) checkChunk(chunk ChunkInfo, tokenWidth int) error {
+	if h.tokenWidth != tokenWidth {
+		return fmt.Errorf("FM-index indexes %d-byte tokens but the corpus uses %d-byte tokens", h.tokenWidth, tokenWidth)
+	}
+	if h.baseOffset != chunk.Start || h.baseOffset+h.span != chunk.End {
+		return fmt.Errorf("FM-index covers bytes [%d, %d) but the chunk covers [%d, %d)", h.baseOffset, h.baseOffset+h.span, chunk.Start, chunk.End)
+	}
+	if h.numTokens != chunk.NumEntries {
+		return fmt.Errorf("FM-index has %d tokens but the chunk has %d", h.numTokens, chunk.NumEntries)
+	}
+	return nil
+}
+
+// Number of bits needed for the BWT symbols of an alphabet of alphabetSize tokens.
+func fmSymbolBits(alphabetSize int) int {
+	return max(bits.Len(uint(alphabetSize)), 1)
+}
+
+// FM-index of a chunk of the tokenized corpus: the BWT of the chunk's tokens in
+// a wavelet tree, which counts the occurrences of a query by backward search,
+// and a sample of the suffix array, from which the position of every occurrence
+// is found by walking the BWT back to a sampled row.
+type FMIndex struct {
+	header   *fmHeader
+	alphabet []uint32 // tokens of the chunk, in byte order
+	keys     []uint32 // byteOrderKey of each token of the alphabet
+	counts   []int64  // counts[s]: number of BWT symbols smaller than s
+	bwt      *waveletTree
+	sampled  *rankBitVector // rows whose suffix array entry is sampled
+	samples  []uint32       // token position within the chunk of each sampled row
+}
+
+// Builds the FM-index of the chunk starting at byte baseOffset of the tokenized
+// corpus, whose tokens are valueBytes and whose suffix array (in token indices,
+// as returned by createTokenSuffixArray) is suffixArray. Every sampleRate-th token
+// position is sampled. Besides the suffix array, this needs a uint32 per token for
+// the BWT and another one while the wavelet tree is built.
+func buildFMIndex(valueBytes []byte, suffixArray []int32, tokenWidth, sampleRate int, baseOffset int64) *FMIndex {
+	numTokens := int64(len(suffixArray))
+	rank, alphabet := rankTokens(valueBytes, tokenWidth)
+
+	symbolAt := func(i int64) uint32 {
+		return uint32(rank[getToken(valueBytes, int(i), tokenWidth)]) + 1
+	}
+
+	// row 0 is the empty suffix at the end of the chunk
+	numRows := numTokens + 1
+	bwt := make([]uint32, numRows)
+	sampled := newRankBitVector(numRows)
+	samples := make([]uint32, 0, numTokens/int64(sampleRate)+1)
+	if numTokens > 0 {
+		bwt[0] = symbolAt(numTokens - 1)
+	}
+	for i, pos := range suffixArray {
+		row := int64(i) + 1
+		if pos > 0 {
+			bwt[row] = symbolAt(int64(pos) - 1)
+		}
+		if int(pos)%sampleRate == 0 {
+			sampled.set(row)
+			samples = append(samples, uint32(pos))
+		}
+	}
+	sampled.finish()
+
+	counts := make([]int64, len(alphabet)+2)
+	for _, s := range bwt {
+		counts[s+1]++
+	}
+	for s := 1; s < len(counts); s++ {
+		counts[s] += counts[s-1]
+	}
+
+	fm := &FMIndex{
+		header: &fmHeader{
+			version:      fmVersion,
+			tokenWidth:   tokenWidth,
+			sampleRate:   sampleRate,
+			alphabetSize: len(alphabet),
+			numTokens:    numTokens,
+			baseOffset:   baseOffset,
+			span:         int64(len(valueBytes)),
+		},
+		alphabet: alphabet,
+		counts:   counts,
+		sampled:  sampled,
+		samples:  samples,
+	}
+	fm.setKeys()
+	fm.bwt = newWaveletTree(bwt, fmSymbolBits(len(alphabet)))
+	return fm
+}
+
+func (fm *FMIndex) setKeys() {
+	fm.keys = make([]uint32, len(fm.alphabet))
+	for i, token := range fm.alphabet {
+		fm.keys[i] = byteOrderKey(token, fm.header.tokenWidth)
+	}
+}
+
+// Returns the BWT symbol of token, or false if the token isn't in the chunk.
+func (fm *FMIndex) symbol(token uint32) (uint32, bool) {
+	key := byteOrderKey(token, fm.header.tokenWidth)
+	idx := sort.Search(len(fm.keys), func(i int) bool {
+		return fm.keys[i] >= key
+	})
+	if idx == len(fm.keys) || fm.keys[idx] != key {
+		return 0, false
+	}
+	return uint32(idx) + 1, true
+}
+
+// Returns the rows [start, end) of the suffixes that start with query (encoded
+// tokens), found by backward search. The empty query matches every token, that is
+// every row but row 0. The search itself starts from every row, as the symbol of
+// row 0 is the last token of the chunk; after the first step, the rows all start
+// with a token, so row 0 is left out.
+func (fm *FMIndex) search(query []byte) (int64, int64) {
+	tokenWidth := fm.header.tokenWidth
+	if len(query) < tokenWidth {
+		return 1, fm.bwt.length
+	}
+
+	start, end := int64(0), fm.bwt.length
+
+	for i := len(query)/tokenWidth - 1; i >= 0 && start < end; i-- {
+		symbol, ok := fm.symbol(getToken(query, i, tokenWidth))
+		if !ok {
+			return 0, 0
+		}
+		start = fm.counts[symbol] + fm.bwt.rank(symbol, start)
+		end = fm.counts[symbol] + fm.bwt.rank(symbol, end)
+	}
+	return start, end
+}
+
+// Returns the byte position in the tokenized corpus of the suffix in row.
+func (fm *FMIndex) locate(row int64) int64 {
+	steps := int64(0)
+	for !fm.sampled.get(row) {
+		symbol, rank := fm.bwt.accessRank(row)
+		row = fm.counts[symbol] + rank
+		steps++
+	}
+
+	tokenPos := int64(fm.samples[fm.sampled.rank1(row)]) + steps
+	return fm.header.baseOffset + tokenPos*int64(fm.header.tokenWidth)
+}
+
+// Writes the FM-index to filename. Like suffix array files, it is written under a
+// temporary name and renamed once it is complete.
+func writeFMIndexFile(filename string, fm *FMIndex) error {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	crc := crc64.New(crcTable)
+	w := bufio.NewWriter(f)
+	body := func(data any) error {
+		if err := binary.Write(crc, binary.LittleEndian, data); err != nil {
+			return err
+		}
+		return binary.Write(w, binary.LittleEndian, data)
+	}
+
+	write := func() error {
+		// placeholder for the header
+		if _, err := w.Write(make([]byte, fmHeaderSize)); err != nil {
+			return err
+		}
+
+		if err := body(fm.alphabet); err != nil {
+			return err
+		}
+		if err := body(fm.counts); err != nil {
+			return err
+		}
+		for l, level := range fm.bwt.levels {
+			if err := body(fm.bwt.zeros[l]); err != nil {
+				return err
+			}
+			if err := body(level.words); err != nil {
+				return err
+			}
+		}
+		if err := body(fm.sampled.words); err != nil {
+			return err
+		}
+		if err := body(fm.samples); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		fm.header.checksum = crc.Sum64()
+		if _, err := f.WriteAt(fm.header.encode(), 0); err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+
+	err = write()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// Reads the header of the FM-index file filename.
+func readFMHeader(filename string) (*fmHeader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, fmHeaderSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("%s: file is too small to be an FM-index", filename)
+	}
+
+	header, err := decodeFMHeader(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return header, nil
+}
+
+// Loads the FM-index in filename into memory and verifies its checksum. The file
+// is decoded as it is read, so only the decoded FM-index is held in memory, not
+// the file's bytes as well.
+func loadFMIndex(filename string) (*FMIndex, error) {
+	fmt.Println("loading FM-index from", filename)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReaderSize(f, 1024*1024)
+	headerBytes := make([]byte, fmHeaderSize)
+	if _, err := io.ReadFull(r, headerBytes); err != nil {
+		return nil, fmt.Errorf("%s: file is too small to be an FM-index", filename)
+	}
+	header, err := decodeFMHeader(headerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	numRows := header.numTokens + 1
+	numWords := (numRows + 63) / 64
+	numBits := fmSymbolBits(header.alphabetSize)
+
+	// checked before anything is allocated, so a corrupt header can't ask for more
+	// memory than the file holds
+	bodySize := info.Size() - fmHeaderSize
+	expectedSize := int64(header.alphabetSize)*4 + int64(header.alphabetSize+2)*8 + int64(numBits)*(8+numWords*8) + numWords*8
+	if bodySize < expectedSize {
+		return nil, fmt.Errorf("%s: file is truncated or corrupt", filename)
+	}
+
+	// the checksum is computed over the body as it is decoded
+	crc := crc64.New(crcTable)
+	body := io.TeeReader(r, crc)
+	buf := make([]byte, 64*1024)
+	var readErr error
+	readValues := func(n int64, width int, decode func(i int64, b []byte)) {
+		for i := int64(0); i < n && readErr == nil; {
+			k := min(n-i, int64(len(buf)/width))
+			if _, readErr = io.ReadFull(body, buf[:k*int64(width)]); readErr != nil {
+				return
+			}
+			for j := int64(0); j < k; j++ {
+				decode(i+j, buf[j*int64(width):])
+			}
+			i += k
+		}
+	}
+	readUint32s := func(n int64) []uint32 {
+		values := make([]uint32, n)
+		readValues(n, 4, func(i int64, b []byte) { values[i] = binary.LittleEndian.Uint32(b) })
+		return values
+	}
+	readUint64s := func(n int64) []uint64 {
+		values := make([]uint64, n)
+		readValues(n, 8, func(i int64, b []byte) { values[i] = binary.LittleEndian.Uint64(b) })
+		return values
+	}
+
+	fm := &FMIndex{header: header}
+	fm.alphabet = readUint32s(int64(header.alphabetSize))
+	for _, count := range readUint64s(int64(header.alphabetSize + 2)) {
+		fm.counts = append(fm.counts, int64(count))
+	}
+
+	fm.bwt = &waveletTree{levels: make([]*rankBitVector, numBits), zeros: make([]int64, numBits), length: numRows}
+	for l := 0; l < numBits; l++ {
+		fm.bwt.zeros[l] = int64(readUint64s(1)[0])
+		fm.bwt.levels[l] = &rankBitVector{words: readUint64s(numWords), length: numRows}
+		fm.bwt.levels[l].finish()
+	}
+
+	fm.sampled = &rankBitVector{words: readUint64s(numWords), length: numRows}
+	fm.sampled.finish()
+	if readErr != nil {
+		return nil, fmt.Errorf("%s: %w", filename, readErr)
+	}
+
+	numSamples := fm.sampled.rank1(numRows)
+	if bodySize-expectedSize != numSamples*4 {
+		return nil, fmt.Errorf("%s: file is truncated or corrupt", filename)
+	}
+	fm.samples = readUint32s(numSamples)
+	if readErr != nil {
+		return nil, fmt.Errorf("%s: %w", filename, readErr)
+	}
+
+	if crc.Sum64() != header.checksum {
+		return nil, fmt.Errorf("%s: checksum mismatch", filename)
+	}
+
+	fm.setKeys()
+	return fm, nil
+}
+
+// Wrapper around the FM-indices of multiple chunks of data. Like
+// MultiSuffixArray, sums over the results of each chunk and skips occurrences
+// inside deleted documents.
+type MultiFMIndex struct {
+	indices    []*FMIndex
+	tokenWidth int
+	deleted    *tombstones // nil if no documents are deleted
+}
+
+// Loads the FM-indices of the chunks of an index in outpath. Each chunk's file
+// must match the chunk's byte range and number of tokens.
+func makeMultiFMIndex(outpath string, chunks []ChunkInfo, tokenWidth int, deleted *tombstones) (*MultiFMIndex, error) {
+	indices := make([]*FMIndex, len(chunks))
+	for i, chunk := range chunks {
+		fmPath := path.Join(outpath, chunk.Path)
+		fm, err := loadFMIndex(fmPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := fm.header.checkChunk(chunk, tokenWidth); err != nil {
+			return nil, fmt.Errorf("%s: %w", fmPath, err)
+		}
+		indices[i] = fm
+	}
+
+	return &MultiFMIndex{indices: indices, tokenWidth: tokenWidth, deleted: deleted}, nil
+}
+
+// Calls callback with the byte position of every occurrence of query in every
+// chunk, skipping those inside deleted documents.
+func (mfm *MultiFMIndex) forEachPosition(query []byte, callback func(pos int64)) {
+	for _, fm := range mfm.indices {
+		start, end := fm.search(query)
+		for row := start; row < end; row++ {
+			pos := fm.locate(row)
+			if mfm.deleted == nil || !mfm.deleted.isDeleted(pos) {
+				callback(pos)
+			}
+		}
+	}
+}
+
+// Retrieve the number of continuations. Only needs to locate the occurrences in
+// chunks with deleted documents, and then only if that is cheaper than scanning
+// the chunk's deleted documents for the query.
+func (mfm *MultiFMIndex) retrieveNum(vec TokenArray, query []byte) int {
+	numResults := 0
+	for _, fm := range mfm.indices {
+		start, end := fm.search(query)
+		numResults += int(end - start)
+		if mfm.deleted == nil || start >= end {
+			continue
+		}
+
+		chunkStart := fm.header.baseOffset
+		chunkEnd := chunkStart + fm.header.span
+		numDeletedTokens := mfm.deleted.deletedBytes(chunkStart, chunkEnd) / int64(mfm.tokenWidth)
+		if numDeletedTokens == 0 {
+			continue
+		}
+
+		if end-start > numDeletedTokens {
+			numResults -= int(mfm.deleted.deletedMatches(vec, query, chunkStart, chunkEnd, chunkEnd, mfm.tokenWidth))
+		} else {
+			for row := start; row < end; row++ {
+				if mfm.deleted.isDeleted(fm.locate(row)) {
+					numResults--
+				}
+			}
+		}
+	}
+
+	fmt.Printf("suffix of size %d has %d total occurrences\n", len(query)/mfm.tokenWidth, numResults)
+
+	return numResults
+}
+
+// Retrieve the continuations in every chunk, or a sample of them if sample isn't
+// nil. Only the occurrences that are retrieved are located.
+func (mfm *MultiFMIndex) retrieveSubstrings(vec TokenArray, query []byte, extend int64, sample *supportSample) [][]byte {
+	return sample.substrings(mfm.matchRanges(vec, query), int64(len(query))+extend*int64(mfm.tokenWidth))
+}
+
+// Retrieve the rows of the occurrences in every chunk that has some.
+func (mfm *MultiFMIndex) matchRanges(vec TokenArray, query []byte) []matchRange {
+	ranges := make([]matchRange, 0)
+	for _, fm := range mfm.indices {
+		start, end := fm.search(query)
+		if start < end {
+			ranges = append(ranges, matchRange{at: fm.locate, start: start, end: end, vec: vec, deleted: mfm.deleted})
+		}
+	}
+	return ranges
+}
+
+// Count the tokens that follow the occurrences in every chunk. Suffixes stop at
+// the end of their chunk, which is the end of the chunk's FM-index.
+func (mfm *MultiFMIndex) retrieveNextTokenCounts(vec TokenArray, query []byte) map[uint32]int64 {
+	counts := make(map[uint32]int64)
+	for _, fm := range mfm.indices {
+		start, end := fm.search(query)
+		if start >= end {
+			continue
+		}
+
+		chunk := ChunkInfo{Start: fm.header.baseOffset, End: fm.header.baseOffset + fm.header.span}
+		atChunkEnd := func(int64) int64 { return chunk.End }
+		countLiveNextTokens(fm.locate, start, end, vec, query, mfm.tokenWidth, chunk, atChunkEnd, mfm.deleted, counts)
+	}
+	return counts
+}
+
+// Retrieve the byte positions of the occurrences in every chunk.
+func (mfm *MultiFMIndex) retrievePositions(vec TokenArray, query []byte) ([]int64, error) {
+	results := make([]int64, 0)
+	mfm.forEachPosition(query, func(pos int64) {
+		results = append(results, pos)
+	})
+	return results, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Builds the FM-index of a chunk at the start of the tokenized corpus.
+func buildTestFMIndex(valueBytes []byte, tokenWidth, sampleRate int) *FMIndex {
+	suffixArray := createTokenSuffixArray(valueBytes, tokenWidth)
+	return buildFMIndex(valueBytes, suffixArray, tokenWidth, sampleRate, 0)
+}
+
+// Returns the sorted byte positions of the rows [start, end) of fm.
+func locateRows(fm *FMIndex, start, end int64) []int64 {
+	positions := make([]int64, 0, end-start)
+	for row := start; row < end; row++ {
+		positions = append(positions, fm.locate(row))
+	}
+	slices.Sort(positions)
+	return positions
+}
+
+func TestFMIndexSearchChunkEnd(t *testing.T) {
+	valueBytes := encodeTokens(t, []uint32{5, 7, 0, 5, 0, 7, 5, 0}, 2)
+	fm := buildTestFMIndex(valueBytes, 2, 1)
+
+	tests := []struct {
+		query     []uint32
+		positions []int64
+	}{
+		{[]uint32{0}, []int64{4, 8, 14}},
+		{[]uint32{5, 0}, []int64{6, 12}},
+		{[]uint32{7, 5, 0}, []int64{10}},
+		{[]uint32{5, 7, 0, 5, 0, 7, 5, 0}, []int64{0}},
+		{[]uint32{0, 0}, []int64{}},
+	}
+	for _, test := range tests {
+		start, end := fm.search(encodeTokens(t, test.query, 2))
+		if positions := locateRows(fm, start, end); !slices.Equal(positions, test.positions) {
+			t.Errorf("search(%v): got positions %v, want %v", test.query, positions, test.positions)
+		}
+	}
+}
+
+func TestFMIndexMatchesSuffixArray(t *testing.T) {
+	valueBytes := encodeTokens(t, []uint32{5, 7, 0, 5, 0, 7, 5, 0, 300, 5, 7, 300, 0}, 2)
+	fm := buildTestFMIndex(valueBytes, 2, 3)
+	sa := buildTestMemSA(valueBytes, 2)
+	vec := &MemArray{data: valueBytes}
+
+	queries := [][]uint32{{}, {0}, {5}, {7}, {300}, {5, 0}, {5, 7}, {300, 0}, {7, 300, 0}, {0, 5}, {1}, {7, 7}}
+	for _, query := range queries {
+		queryEnc := encodeTokens(t, query, 2)
+		want := retrieve(sa, vec, queryEnc)
+		slices.Sort(want)
+
+		start, end := fm.search(queryEnc)
+		if got := locateRows(fm, start, end); !slices.Equal(got, want) {
+			t.Errorf("%v: FM-index has positions %v, suffix array has %v", query, got, want)
+		}
+	}
+}
+
+func TestFMIndexRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, tokenWidth := range []int{2, 4} {
+		vocab := []uint32{1, 2, 3, 255, 256, 300, 1000}
+		if tokenWidth == 4 {
+			vocab = append(vocab, 70000, 1<<24+1)
+		}
+
+		for trial := 0; trial < 20; trial++ {
+			tokens := randomTokens(rng, 1+rng.Intn(300), vocab, trial%2 == 0)
+			valueBytes := encodeTokens(t, tokens, tokenWidth)
+			sampleRate := []int{1, 3, 32}[trial%3]
+
+			built := buildTestFMIndex(valueBytes, tokenWidth, sampleRate)
+			filename := filepath.Join(t.TempDir(), "fm.bin")
+			if err := writeFMIndexFile(filename, built); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := loadFMIndex(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, fm := range []*FMIndex{built, loaded} {
+				for _, query := range testQueries(rng, tokens, vocab) {
+					want := naiveOccurrences(tokens, query, tokenWidth)
+					start, end := fm.search(encodeTokens(t, query, tokenWidth))
+					if got := locateRows(fm, start, end); !slices.Equal(got, want) {
+						t.Fatalf("width %d, tokens %v, query %v: got positions %v, want %v", tokenWidth, tokens, query, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestFMIndexFileRejection(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	dir := t.TempDir()
+	// sampling every position makes the samples longer than one read buffer
+	tokens := randomTokens(rng, 40000, []uint32{1, 2, 3, 300}, true)
+	built := buildTestFMIndex(encodeTokens(t, tokens, 2), 2, 1)
+	filename := filepath.Join(dir, "original.bin")
+	if err := writeFMIndexFile(filename, built); err != nil {
+		t.Fatal(err)
+	}
+	original, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		want    string
+	}{
+		{"truncated header", func(data []byte) []byte {
+			return data[:fmHeaderSize-1]
+		}, "too small"},
+		{"bad magic", func(data []byte) []byte {
+			data[0] = 'X'
+			return data
+		}, "not an FM-index"},
+		{"truncated samples", func(data []byte) []byte {
+			return data[:len(data)-1]
+		}, "truncated or corrupt"},
+		{"truncated levels", func(data []byte) []byte {
+			return data[:fmHeaderSize+100]
+		}, "truncated or corrupt"},
+		{"extra samples", func(data []byte) []byte {
+			return append(data, 0, 0, 0, 0)
+		}, "truncated or corrupt"},
+		{"samples changed", func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}, "checksum mismatch"},
+	}
+	for _, tt := range tests {
+		corrupted := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "_")+".bin")
+		if err := os.WriteFile(corrupted, tt.corrupt(slices.Clone(original)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadFMIndex(corrupted); err == nil || !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), corrupted) {
+			t.Fatalf("%s: loading error %v, want %q in %s", tt.name, err, tt.want, corrupted)
+		}
+	}
+
+	loaded, err := loadFMIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(loaded.samples, built.samples) || !slices.Equal(loaded.sampled.words, built.sampled.words) {
+		t.Fatal("the loaded samples differ from the built ones")
+	}
+	for _, query := range testQueries(rng, tokens, []uint32{1, 2, 3, 300})[:10] {
+		start, end := loaded.search(encodeTokens(t, query, 2))
+		if got, want := locateRows(loaded, start, end), naiveOccurrences(tokens, query, 2); !slices.Equal(got, want) {
+			t.Fatalf("query %v: got positions %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestMultiFMIndexRetrieveNumDeleted(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	vocab := []uint32{1, 2, 3, 300}
+	for trial := 0; trial < 20; trial++ {
+		tokens := randomTokens(rng, 50+rng.Intn(300), vocab, true)
+		valueBytes := encodeTokens(t, tokens, 2)
+		vec := &MemArray{data: valueBytes}
+		deleted := deleteRandomDocuments(rng, tokens, 2)
+		mfm := &MultiFMIndex{indices: []*FMIndex{buildTestFMIndex(valueBytes, 2, 4)}, tokenWidth: 2, deleted: deleted}
+
+		for _, query := range testQueries(rng, tokens, vocab) {
+			want := 0
+			for _, pos := range naiveOccurrences(tokens, query, 2) {
+				if !deleted.isDeleted(pos) {
+					want++
+				}
+			}
+			if got := mfm.retrieveNum(vec, encodeTokens(t, query, 2)); got != want {
+				t.Fatalf("tokens %v, deleted %v, query %v: %d live occurrences, want %d", tokens, deleted.ranges, query, got, want)
+			}
+		}
+	}
+}
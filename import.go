@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+const npyMagic = "\x93NUMPY"
+
+// Where the elements of a .npy file start and how they are stored.
+type npyHeader struct {
+	dataOffset int64 // bytes before the first element
+	width      int   // bytes per element
+	signed     bool
+	length     int64 // number of elements
+}
+
+var (
+	npyDescrRe   = regexp.MustCompile(`'descr':\s*'([<>|=]?)([iu])(\d)'`)
+	npyFortranRe = regexp.MustCompile(`'fortran_order':\s*(True|False)`)
+	npyShapeRe   = regexp.MustCompile(`'shape':\s*\((\d+),?\s*\)`)
+)
+
+// Reads the header of the .npy file filename, which must hold a one-dimensional
+// array of little endian integers.
+func readNpyHeader(filename string) (*npyHeader, error) {
+	input, err := openInput(filename, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	reader := bufio.NewReader(input)
+	prefix := make([]byte, len(npyMagic)+2)
+	if _, err := io.ReadFull(reader, prefix); err != nil || string(prefix[:len(npyMagic)]) != npyMagic {
+		return nil, fmt.Errorf("%s is not a .npy file", filename)
+	}
+
+	// version 1 stores the header length in 2 bytes, later versions in 4
+	major := prefix[len(npyMagic)]
+	lengthBytes := make([]byte, 4)
+	if major == 1 {
+		lengthBytes = lengthBytes[:2]
+	}
+	if _, err := io.ReadFull(reader, lengthBytes); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	headerLen := int64(binary.LittleEndian.Uint16(lengthBytes))
+	if major != 1 {
+		headerLen = int64(binary.LittleEndian.Uint32(lengthBytes))
+	}
+
+	headerBytes := make([]byte, headerLen)
+	if _, err := io.ReadFull(reader, headerBytes); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	header := string(headerBytes)
+
+	descr := npyDescrRe.FindStringSubmatch(header)
+	if descr == nil {
+		return nil, fmt.Errorf("%s: unsupported array type in header %s: must be integers", filename, header)
+	}
+	if descr[1] == ">" {
+		return nil, fmt.Errorf("%s: big endian arrays are not supported", filename)
+	}
+	width, _ := strconv.Atoi(descr[3])
+	if width != 1 && width != 2 && width != 4 && width != 8 {
+		return nil, fmt.Errorf("%s: unsupported integer size of %d bytes", filename, width)
+	}
+
+	if fortran := npyFortranRe.FindStringSubmatch(header); fortran != nil && fortran[1] == "True" {
+		return nil, fmt.Errorf("%s: fortran ordered arrays are not supported", filename)
+	}
+	shape := npyShapeRe.FindStringSubmatch(header)
+	if shape == nil {
+		return nil, fmt.Errorf("%s: array must be one-dimensional, header is %s", filename, header)
+	}
+	length, _ := strconv.ParseInt(shape[1], 10, 64)
+
+	return &npyHeader{
+		dataOffset: int64(len(prefix)+len(lengthBytes)) + headerLen,
+		width:      width,
+		signed:     descr[2] == "i",
+		length:     length,
+	}, nil
+}
+
+// Decodes a little endian integer of len(b) bytes. Returns whether it is negative
+// instead of its value if so.
+func decodeInt(b []byte, signed bool) (uint64, bool) {
+	var value uint64
+	switch len(b) {
+	case 1:
+		value = uint64(b[0])
+	case 2:
+		value = uint64(binary.LittleEndian.Uint16(b))
+	case 4:
+		value = uint64(binary.LittleEndian.Uint32(b))
+	default:
+		value = binary.LittleEndian.Uint64(b)
+	}
+
+	signBit := uint64(1) << (8*len(b) - 1)
+	return value, signed && value&signBit != 0
+}
+
+// Calls callback with the token ids of every document of the pre-tokenized file
+// filename, starting at byte start of its decompressed contents. Documents end
+// with input.docSeparator, which isn't included; tokens after the last separator
+// form a final document. callback also gets the byte position just past the
+// document and its separator, which is where reading would resume after it.
+// onRead is passed to openInput.
+func readTokenDocumentsFrom(filename string, input *inputFormat, start int64, onRead func(n int), callback func(tokens []uint32, end int64) error) error {
+	width, signed, dataOffset, dataEnd := input.inputTokenWidth, false, int64(0), int64(-1)
+	if input.format == inputNpy {
+		header, err := readNpyHeader(filename)
+		if err != nil {
+			return err
+		}
+		width, signed, dataOffset = header.width, header.signed, header.dataOffset
+		dataEnd = dataOffset + header.length*int64(width)
+	}
+	start = max(start, dataOffset)
+
+	file, err := openInput(filename, start, onRead)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 1024*1024)
+	buf := make([]byte, 8)
+	tokens := make([]uint32, 0)
+	offset := start
+	for dataEnd < 0 || offset < dataEnd {
+		n, err := io.ReadFull(reader, buf[:width])
+		if errors.Is(err, io.EOF) {
+			break
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%s ends with a partial token of %d bytes", filename, n)
+		} else if err != nil {
+			return err
+		}
+		offset += int64(width)
+
+		value, negative := decodeInt(buf[:width], signed)
+		if negative {
+			return fmt.Errorf("%s has a negative token id at byte %d", filename, offset-int64(width))
+		}
+		if value > math.MaxUint32 {
+			return fmt.Errorf("%s has token id %d at byte %d, which is too large", filename, value, offset-int64(width))
+		}
+
+		if int64(value) == input.docSeparator {
+			if err := callback(tokens, offset); err != nil {
+				return err
+			}
+			tokens = tokens[:0]
+			continue
+		}
+		tokens = append(tokens, uint32(value))
+	}
+
+	if dataEnd >= 0 && offset < dataEnd {
+		return fmt.Errorf("%s ends after %d bytes but its header expects %d", filename, offset, dataEnd)
+	}
+	if len(tokens) > 0 {
+		return callback(tokens, offset)
+	}
+	return nil
+}
+
+// Writes the documents of the pre-tokenized files to the tokenized corpus in
+// outpath as they are, without running the tokenizer. Each document is followed
+// by sentinalSize copies of sentinalVal and each token takes up tokenWidth bytes.
+// Empty documents are skipped. Token ids must be less than vocabSize. Sources,
+// appendData, resume and checkpoint work as in tokenizeMultiprocess.
+func importTokens(files []string, firstSource int, input *inputFormat, outpath string, vocabSize, sentinalVal, sentinalSize, tokenWidth int, appendData bool, resume *tokenizeCheckpoint, checkpoint func(tokenizeCheckpoint) error) (*corpusStats, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no input files")
+	}
+	if resume == nil {
+		resume = &tokenizeCheckpoint{}
+	}
+
+	cw, rollback, err := startCorpus(outpath, false, appendData, resume)
+	if err != nil {
+		return nil, err
+	}
+
+	sources, err := statSources(files)
+	if err != nil {
+		cw.close()
+		rollback()
+		return nil, err
+	}
+	totalSize := int64(0)
+	for _, source := range sources {
+		totalSize += source.Size
+	}
+
+	fmt.Printf("Num input files: %d (%d bytes)\n", len(files), totalSize)
+
+	bar := progressbar.DefaultBytes(totalSize, "importing")
+	onRead := func(n int) { bar.Add(n) }
+	for _, source := range sources[:min(resume.InputFile, len(sources))] {
+		bar.Add64(source.Size)
+	}
+
+	var readErr error
+	sinceCheckpoint := int64(0) // bytes of input consumed since the last checkpoint
+	for fileIdx := resume.InputFile; fileIdx < len(files) && readErr == nil; fileIdx++ {
+		filename := files[fileIdx]
+
+		start, records := int64(0), int64(0)
+		if fileIdx == resume.InputFile {
+			start, records = resume.InputOffset, resume.InputLines
+		}
+		lastEnd := start
+
+		readErr = readTokenDocumentsFrom(filename, input, start, onRead, func(tokens []uint32, end int64) error {
+			record := records
+			records++
+			sinceCheckpoint += end - lastEnd
+			lastEnd = end
+
+			if len(tokens) > 0 {
+				for _, token := range tokens {
+					if vocabSize > 0 && int(token) >= vocabSize {
+						return fmt.Errorf("%s: document %d has token id %d but the vocabulary has %d tokens", filename, record, token, vocabSize)
+					}
+				}
+
+				dataBytes := make([]byte, (len(tokens)+sentinalSize)*tokenWidth)
+				if err := encodeSequence(dataBytes, tokens, sentinalVal, sentinalSize, tokenWidth); err != nil {
+					return err
+				}
+				if err := cw.write(tokenizedDoc{data: dataBytes, source: firstSource + fileIdx, record: record}); err != nil {
+					return err
+				}
+			}
+
+			if checkpoint != nil && sinceCheckpoint >= tokenizeCheckpointInterval {
+				if err := cw.sync(); err != nil {
+					return err
+				}
+
+				err := checkpoint(tokenizeCheckpoint{
+					InputFile:    fileIdx,
+					InputOffset:  end,
+					InputLines:   records,
+					DataBytes:    cw.offset,
+					NumDocuments: cw.stats.numDocuments,
+				})
+				if err != nil {
+					return err
+				}
+				sinceCheckpoint = 0
+			}
+
+			return nil
+		})
+	}
+	bar.Finish()
+
+	if closeErr := cw.close(); readErr == nil {
+		readErr = closeErr
+	}
+	if readErr != nil {
+		rollback()
+		return nil, readErr
+	}
+
+	return &cw.stats, nil
+}
+
+// Writes the documents in cfg.Files to the tokenized corpus in cfg.Outpath:
+// pre-tokenized inputs are imported as they are and the rest are tokenized.
+// Arguments are as in tokenizeMultiprocess.
+func buildCorpus(cfg *BuildConfig, firstSource int, appendData bool, resume *tokenizeCheckpoint, checkpoint func(tokenizeCheckpoint) error) (*corpusStats, error) {
+	input := cfg.inputFormat()
+	if input.pretokenized() {
+		return importTokens(cfg.Files, firstSource, input, cfg.Outpath, cfg.VocabSize, cfg.SentinalVal, cfg.SentinalSize, cfg.TokenWidth, appendData, resume, checkpoint)
+	}
+	return tokenizeMultiprocess(cfg.Files, firstSource, input, cfg.Outpath, cfg.TokenizerConfig, cfg.SentinalVal, cfg.SentinalSize, cfg.TokenWidth, cfg.NWorkers, appendData, resume, checkpoint)
+}
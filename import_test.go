@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Encodes a .npy file of the given format version holding an array of type descr
+// with the given shape. values are written as little endian integers of width
+// bytes, which may be fewer or more than the shape holds.
+func encodeNpy(major byte, descr, shape string, values []int64, width int) []byte {
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': %s, }", descr, shape)
+	lengthSize := 2
+	if major != 1 {
+		lengthSize = 4
+	}
+	// the header is padded with spaces so that the data is 64-byte aligned
+	prefixSize := len(npyMagic) + 2 + lengthSize
+	header += strings.Repeat(" ", 63-(prefixSize+len(header))%64) + "\n"
+
+	npy := append([]byte(npyMagic), major, 0)
+	if major == 1 {
+		npy = binary.LittleEndian.AppendUint16(npy, uint16(len(header)))
+	} else {
+		npy = binary.LittleEndian.AppendUint32(npy, uint32(len(header)))
+	}
+	npy = append(npy, header...)
+	for _, value := range values {
+		npy = binary.LittleEndian.AppendUint64(npy, uint64(value))[:len(npy)+width]
+	}
+	return npy
+}
+
+// Little endian raw token ids of width bytes.
+func encodeRaw(values []int64, width int) []byte {
+	raw := make([]byte, 0)
+	for _, value := range values {
+		raw = binary.LittleEndian.AppendUint64(raw, uint64(value))[:len(raw)+width]
+	}
+	return raw
+}
+
+func TestReadTokenDocuments(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    string
+		width     int // bytes per token of raw input
+		contents  []byte
+		want      [][]uint32
+		wantError bool
+	}{
+		{"trailing separator", inputTokens, 2, encodeRaw([]int64{1, 2, 99, 3, 99}, 2), [][]uint32{{1, 2}, {3}}, false},
+		{"no trailing separator", inputTokens, 2, encodeRaw([]int64{1, 2, 99, 3}, 2), [][]uint32{{1, 2}, {3}}, false},
+		{"empty document", inputTokens, 4, encodeRaw([]int64{1, 99, 99, 70000}, 4), [][]uint32{{1}, {}, {70000}}, false},
+		{"partial token", inputTokens, 2, []byte{1, 0, 99, 0, 3}, nil, true},
+		{"npy", inputNpy, 0, encodeNpy(1, "<u2", "(5,)", []int64{1, 2, 99, 3, 99}, 2), [][]uint32{{1, 2}, {3}}, false},
+		{"npy version 2", inputNpy, 0, encodeNpy(2, "<i4", "(4,)", []int64{1, 2, 99, 3}, 4), [][]uint32{{1, 2}, {3}}, false},
+		{"npy bytes after the array", inputNpy, 0, encodeNpy(1, "<i8", "(3,)", []int64{1, 99, 2, 3}, 8), [][]uint32{{1}, {2}}, false},
+		{"npy shorter than its header", inputNpy, 0, encodeNpy(1, "<u2", "(6,)", []int64{1, 2, 99, 3}, 2), nil, true},
+		{"npy negative token", inputNpy, 0, encodeNpy(1, "<i2", "(3,)", []int64{1, -1, 99}, 2), nil, true},
+		{"npy two-dimensional", inputNpy, 0, encodeNpy(1, "<u2", "(1, 2)", []int64{1, 99}, 2), nil, true},
+	}
+
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "input")
+		if err := os.WriteFile(filename, test.contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		input := &inputFormat{format: test.format, inputTokenWidth: test.width, docSeparator: 99}
+
+		read := func(start int64) ([][]uint32, []int64, error) {
+			docs, ends := make([][]uint32, 0), make([]int64, 0)
+			err := readTokenDocumentsFrom(filename, input, start, nil, func(tokens []uint32, end int64) error {
+				docs = append(docs, append([]uint32{}, tokens...))
+				ends = append(ends, end)
+				return nil
+			})
+			return docs, ends, err
+		}
+
+		docs, ends, err := read(0)
+		if test.wantError {
+			if err == nil {
+				t.Errorf("%s: read %v, want an error", test.name, docs)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(docs, test.want) {
+			t.Errorf("%s: read %v (%v), want %v", test.name, docs, err, test.want)
+			continue
+		}
+
+		// reading resumes after the first document
+		if docs, _, err := read(ends[0]); err != nil || !reflect.DeepEqual(docs, test.want[1:]) {
+			t.Errorf("%s: resumed at byte %d and read %v (%v), want %v", test.name, ends[0], docs, err, test.want[1:])
+		}
+	}
+}
+
+func TestImportNpy(t *testing.T) {
+	cfg := testBuildConfig(t, nil)
+	cfg.InputFormat = inputNpy
+	cfg.DocSeparator = 99
+	cfg.Files = []string{filepath.Join(t.TempDir(), "input.npy")}
+	values := []int64{5, 6, 7, 99, 99, 8, 99, 9, 10}
+	if err := os.WriteFile(cfg.Files[0], encodeNpy(1, "<i4", fmt.Sprintf("(%d,)", len(values)), values, 4), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := buildTestIndex(t, cfg)
+	// the empty document is skipped
+	want := [][]uint32{{5, 6, 7}, {8}, {9, 10}}
+	if m.docs.numDocs != int64(len(want)) {
+		t.Fatalf("imported %d documents, want %d", m.docs.numDocs, len(want))
+	}
+	for id, doc := range want {
+		if got, err := m.GetDocument(int64(id)); err != nil || !reflect.DeepEqual(got, doc) {
+			t.Errorf("document %d is %v (%v), want %v", id, got, err, doc)
+		}
+	}
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"bufio"
+	"cmp"
 	"flag"
 	"fmt"
 	"os"
-	"path"
+	"slices"
 	"strings"
 
 	"infinigram/tokenizers"
@@ -13,72 +14,104 @@ import (
 
 // Wrapper around infini-gram model data.
 type ModelData struct {
-	suffixArray SuffixArray
-	bytesData   TokenArray
-	vocabSize   int
+	suffixArray  SuffixArray
+	bytesData    TokenArray
+	vocabSize    int
+	tokenWidth   int            // number of bytes per token in bytesData
+	sentinalSize int            // number of sentinals at the end of every document
+	docs         *docIndex      // where each document starts in bytesData
+	deleted      *tombstones    // nil if no documents are deleted
+	metadata     *metadataIndex // nil if no metadata is kept
+	sources      *sourceIndex   // where each document was read from
+	sourceFiles  []SourceInfo   // input files, indexed by sources
+	members      []*indexMember // indices combined by a composite model; nil for a single index
 }
 
 // Wrapper around infini-gram model predictions results.
 type Prediction struct {
-	distribution      []float32 // next-token probability distribution
-	effectiveN        int       // length of the longest suffix used
-	numRetrieved      int       // number of continuations retrieved
-	numExtend         int       // in the retrievedSuffixes, number of additional tokens added
-	retrievedSuffixes [][]int   // raw retrieved suffixes
+	counts            map[uint32]int64 // number of continuations followed by each token; only tokens that follow are present
+	effectiveN        int              // length of the longest suffix used
+	numRetrieved      int              // number of continuations retrieved (or counted)
+	numTotal          int              // number of continuations of the suffix; more than numRetrieved if they were sampled
+	numExtend         int              // in the retrievedSuffixes, number of additional tokens added
+	retrievedSuffixes [][]int          // raw retrieved suffixes; nil if the next tokens were counted without retrieving them
+}
+
+// Returns the probability of token following the suffix, estimated from the
+// continuations that were retrieved.
+func (p *Prediction) prob(token uint32) float32 {
+	if p.numRetrieved == 0 {
+		return 0
+	}
+	return float32(p.counts[token]) / float32(p.numRetrieved)
+}
+
+// Returns the tokens that follow the suffix, from the most to the least
+// frequent. Ties are broken by token id.
+func (p *Prediction) sortedTokens() []uint32 {
+	tokens := make([]uint32, 0, len(p.counts))
+	for token := range p.counts {
+		tokens = append(tokens, token)
+	}
+	slices.SortFunc(tokens, func(a, b uint32) int {
+		if p.counts[a] != p.counts[b] {
+			return cmp.Compare(p.counts[b], p.counts[a])
+		}
+		return cmp.Compare(a, b)
+	})
+	return tokens
 }
 
 // Will return the prediction of the next token distribution corresponding to the
 // longest suffix in queryIds. For a suffix to be considered valid, there must be
 // at least minMatches occurrences of it in the data. The retrieved suffixes will
-// include numExtend extra tokens (set to 1 to just get the next token).
-func (m *ModelData) NextTokenDistribution(queryIds []uint32, numExtend int, minMatches int) *Prediction {
-	vocabSize := m.vocabSize
+// include numExtend extra tokens (set to 1 to just get the next token). If
+// maxSupport is positive and the suffix occurs more often, only a uniform random
+// sample of maxSupport occurrences (drawn using seed) is retrieved, and the
+// distribution is estimated from it; numTotal is still the exact number of
+// continuations. If every sampled occurrence is inside a deleted document, none
+// are retrieved and there are no counts. When only the next token is needed and
+// nothing is sampled, the next tokens are counted with retrieveNextTokenCounts
+// instead, which doesn't retrieve every continuation: its cost depends on the
+// number of distinct next tokens, plus, in each chunk with deleted documents, the
+// smaller of the number of occurrences and the number of deleted tokens. Returns
+// an error if a query token can't be stored in the model's token width.
+func (m *ModelData) NextTokenDistribution(queryIds []uint32, numExtend int, minMatches int, maxSupport int, seed int64) (*Prediction, error) {
 	suffixArray := m.suffixArray
 	dataBytes := m.bytesData
+	tokenWidth := m.tokenWidth
 
-	var bestQueryEnc []byte
-
-	if len(queryIds) == 0 {
-		bestQueryEnc = make([]byte, 0)
-	} else {
-		// perform binary search to find longest suffix
-		left := 0
-		right := len(queryIds) + 1
-
-		for left < right {
-			// the current candidate for the longest suffix length
-			mid := (left + right) / 2
-			queryIdsSuffix := queryIds[len(queryIds)-mid:]
-
-			querySuffixEnc := intToByte(queryIdsSuffix)
-
-			// check if, at this length, we get any matches
-			numMatches := suffixArray.retrieveNum(dataBytes, querySuffixEnc)
-
-			if numMatches >= minMatches {
-				left = mid + 1
-			} else {
-				right = mid
-			}
-		}
+	queryEnc, err := intToByte(queryIds, tokenWidth)
+	if err != nil {
+		return nil, err
+	}
 
-		if left == 0 {
-			// TODO: i don't think this should happen
-			fmt.Println("none found")
-			return &Prediction{nil, -1, 0, numExtend, make([][]int, 0)}
+	// find the longest suffix
+	bestN := m.longestSuffix(queryEnc, minMatches)
+	if bestN < 0 {
+		// TODO: i don't think this should happen
+		fmt.Println("none found")
+		return &Prediction{nil, -1, 0, 0, numExtend, make([][]int, 0)}, nil
+	}
+	bestQueryEnc := queryEnc[len(queryEnc)-bestN*tokenWidth:]
+
+	sample := newSupportSample(maxSupport, seed)
+	if numExtend == 1 && sample == nil {
+		counts := suffixArray.retrieveNextTokenCounts(dataBytes, bestQueryEnc)
+		total := 0
+		for _, count := range counts {
+			total += int(count)
 		}
-		best_n := left - 1
-
-		bestQueryEnc = intToByte(queryIds[len(queryIds)-best_n:])
+		return &Prediction{counts, bestN, total, total, numExtend, nil}, nil
 	}
 
-	substrings := suffixArray.retrieveSubstrings(dataBytes, bestQueryEnc, int64(numExtend))
+	substrings := suffixArray.retrieveSubstrings(dataBytes, bestQueryEnc, int64(numExtend), sample)
 
 	rawSuffixes := make([][]int, len(substrings))
-	distr := make([]float32, vocabSize)
+	counts := make(map[uint32]int64)
 	total := 0
 	for i, s := range substrings {
-		retrievedSuffix := byteToInt(s)
+		retrievedSuffix := byteToInt(s, tokenWidth)
 
 		newIds := retrievedSuffix[len(retrievedSuffix)-numExtend:]
 		newIds = append([]int{}, newIds...)
@@ -87,159 +120,254 @@ func (m *ModelData) NextTokenDistribution(queryIds []uint32, numExtend int, minM
 		rawSuffixes[i] = newIds
 
 		// populate distribution
-		distr[newIds[0]] += 1
+		counts[uint32(newIds[0])] += 1
 		total += 1
 	}
 
-	for i := range distr {
-		distr[i] /= float32(total)
+	numTotal := total
+	if sample != nil {
+		numTotal = int(m.countEncoded(bestQueryEnc))
+	}
+
+	// every sampled occurrence may have been inside a deleted document
+	if total == 0 {
+		return &Prediction{nil, bestN, 0, numTotal, numExtend, rawSuffixes}, nil
 	}
 
-	return &Prediction{distr, len(bestQueryEnc) / 2, total, numExtend, rawSuffixes}
+	return &Prediction{counts, bestN, total, numTotal, numExtend, rawSuffixes}, nil
 }
 
 // Will generate a sequence of numNewTokens tokens greedily using the longest matched
 // suffix. For a suffix to be considered valid, there must be at least minMatches
 // occurrences of it in the data. queryIds are the initial prompt tokens.
-func (m *ModelData) GenerateGreedy(queryIds []uint32, numNewTokens, minMatches int) []uint32 {
+func (m *ModelData) GenerateGreedy(queryIds []uint32, numNewTokens, minMatches int) ([]uint32, error) {
 	result := make([]uint32, 0, len(queryIds)+numNewTokens)
 	result = append(result, queryIds...)
 
 	for i := 0; i < numNewTokens; i++ {
-		prediction := m.NextTokenDistribution(result, 1, minMatches)
+		prediction, err := m.NextTokenDistribution(result, 1, minMatches, 0, 0)
+		if err != nil {
+			return nil, err
+		}
 
 		if prediction.numRetrieved == 0 {
-			return result
+			return result, nil
 		}
 
-		newToken := uint32(argmax(prediction.distribution))
+		newToken := prediction.sortedTokens()[0]
 		result = append(result, newToken)
 	}
 
-	return result
+	return result, nil
 }
 
-// Same as GenerateGreedy, but will send intermediate results to the generatedTokens
-func (m *ModelData) GenerateGreedyStream(queryIds []uint32, numNewTokens, minMatches int, generatedTokens chan<- []uint32) {
+// Same as GenerateGreedy, but will send intermediate results to the generatedTokens.
+// Stops early and sends the error to errs if the prediction fails.
+func (m *ModelData) GenerateGreedyStream(queryIds []uint32, numNewTokens, minMatches int, generatedTokens chan<- []uint32, errs chan<- error) {
 	defer close(generatedTokens)
 
 	result := make([]uint32, 0, len(queryIds)+numNewTokens)
 	result = append(result, queryIds...)
 
 	for i := 0; i < numNewTokens; i++ {
-		prediction := m.NextTokenDistribution(result, 1, minMatches)
+		prediction, err := m.NextTokenDistribution(result, 1, minMatches, 0, 0)
+		if err != nil {
+			errs <- err
+			return
+		}
 
 		if prediction.numRetrieved == 0 {
 			return
 		}
 
-		newToken := uint32(argmax(prediction.distribution))
+		newToken := prediction.sortedTokens()[0]
 		result = append(result, newToken)
 
 		generatedTokens <- result
 	}
 }
 
-// Creates the tokenized corpus and suffix array, saves them to outpath, and returns
-// the model. If either the tokenized corpus or suffix array already exist, they will
-// be loaded from disk. Set sentinalVal and sentinalSize to split documents.
-// Tokenization is done in parallel using nWorkers. Set lineSplit to the token that
-// separates documents in the input file (filename). Set tokenizerConfig to the path
-// of the tokenizer configuration file. vocabSize is the size of the vocabulary.
-// Creates a suffix array for each chunk of documents of size chunkSize.
-func InitializeModel(filename, lineSplit, outpath, tokenizerConfig string, sentinalVal, sentinalSize, nWorkers, vocabSize, chunkSize int) (*ModelData, error) {
-	// check whether tokenized data already exists
-	dataPath := path.Join(outpath, "data.bin")
-	_, err := os.Stat(dataPath)
-	if err != nil {
-		// tokenize data: streams documents from text file into binary file
-		fmt.Println("Tokenizing data to disk")
-		_, err := tokenizeMultiprocess(filename, lineSplit, outpath, tokenizerConfig, sentinalVal, sentinalSize, nWorkers)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		fmt.Println("Tokenized data already found")
+// Creates the tokenized corpus and suffix array, saves them to cfg.Outpath, and
+// returns the model. Documents are read from cfg.Files as described by
+// cfg.InputFormat and are tokenized in parallel using cfg.NWorkers with the
+// tokenizer in cfg.TokenizerConfig (or imported as they are if they are already
+// tokenized). Each document ends with cfg.SentinalSize copies of cfg.SentinalVal
+// and each token takes up cfg.TokenWidth bytes. Creates a suffix array for each
+// chunk of documents, building up to cfg.SAWorkers chunks at once within the
+// cfg.MaxMem memory budget. What was built is recorded in the index manifest; if
+// a manifest already exists, it must match cfg and anything already built is
+// loaded from disk. An interrupted build continues from its last checkpoint.
+func InitializeModel(cfg BuildConfig) (*ModelData, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
 	}
 
-	dataBytes, err := loadMMappedArray(dataPath)
+	tokenizerHash, err := hashFile(cfg.TokenizerConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	// check whether suffix array already exists
-	saChunkPathsPath := path.Join(outpath, "suffix_array_paths.txt")
+	outpath := cfg.Outpath
+	if err := checkLegacyIndex(outpath); err != nil {
+		return nil, err
+	}
 
-	_, err = os.Stat(saChunkPathsPath)
-	if err == nil {
-		fmt.Println("Suffix array(s) already found")
+	// progress of a build that was interrupted, if any
+	state, err := loadBuildState(outpath)
+	if err != nil {
+		return nil, err
+	}
+
+	// check whether tokenized data already exists
+	var manifest *IndexManifest
+	if hasManifest(outpath) {
+		fmt.Println("Tokenized data already found")
 
-		saChunkPathsStr, err := readStringFromFile(saChunkPathsPath)
+		manifest, err = loadManifest(outpath)
 		if err != nil {
 			return nil, err
 		}
+		if err := manifest.checkConfig(&cfg, tokenizerHash); err != nil {
+			return nil, err
+		}
+		if err := manifest.checkFiles(outpath); err != nil {
+			return nil, err
+		}
+	} else {
+		current, err := newBuildState(&cfg, tokenizerHash)
+		if err != nil {
+			return nil, err
+		}
+
+		// continue from the last checkpoint if the input and settings are the same
+		var resume *tokenizeCheckpoint
+		if state != nil && state.Tokenized != nil && state.sameSettings(current) && state.Tokenized.hasFiles(outpath) {
+			resume = state.Tokenized
+			current.Tokenized = resume
+			fmt.Printf("Resuming tokenization at byte %d of %s\n", resume.InputOffset, cfg.Files[resume.InputFile])
+		}
+		state = current
 
-		suffixArray, err := makeMultiSuffixArray(strings.Split(saChunkPathsStr, "\n"))
+		checkpoint := func(progress tokenizeCheckpoint) error {
+			state.Tokenized = &progress
+			return writeBuildState(outpath, state)
+		}
+
+		// tokenize data: streams documents from text file into binary file
+		fmt.Println("Tokenizing data to disk")
+		stats, err := buildCorpus(&cfg, 0, false, resume, checkpoint)
 		if err != nil {
 			return nil, err
 		}
 
-		return &ModelData{
-			suffixArray: suffixArray,
-			bytesData:   dataBytes,
-			vocabSize:   vocabSize,
-		}, nil
+		manifest = newManifest(&cfg, tokenizerHash, stats, state.Inputs)
+		if err := writeManifest(outpath, manifest); err != nil {
+			return nil, err
+		}
+	}
+
+	// check whether suffix array already exists
+	if manifest.Complete {
+		fmt.Println("Suffix array(s) already found")
+		return openModel(outpath, manifest, cfg.VerifyChecksums)
+	}
+
+	chunkSize := cfg.chunkSize()
+	if state == nil {
+		state = &buildState{Version: buildStateVersion}
+	}
+
+	// keep the chunks finished before the build was interrupted
+	done := state.finishedChunks(outpath, manifest, chunkSize)
+	state.ChunkSize = chunkSize
+	state.Chunks = done
+
+	startOffset := int64(0)
+	if len(done) > 0 {
+		startOffset = done[len(done)-1].End
+		fmt.Printf("Resuming suffix array(s) at chunk %d\n", len(done))
+	}
+
+	progress := func(finished []ChunkInfo) error {
+		state.Chunks = append(append([]ChunkInfo{}, done...), finished...)
+		return writeBuildState(outpath, state)
 	}
 
 	fmt.Println("Creating suffix array(s)")
-	offset := int64(0)
-	currChunk := 0
-	chunkBuffer := make([]byte, chunkSize)
-	saCallback := func(chunkLength int) error {
-		fmt.Printf("making chunk %d of size %d\n", currChunk, chunkLength)
+	chunks, err := buildSuffixArrays(outpath, manifest, startOffset, len(done), chunkSize, cfg.MaxMem, cfg.SAWorkers, cfg.ByteLevelSA, cfg.FMSampleRate, cfg.BuildLCP, progress)
+	if err != nil {
+		return nil, err
+	}
 
-		readValues := chunkBuffer[:chunkLength]
+	// record the chunks in the manifest
+	manifest.ChunkSize = chunkSize
+	manifest.Chunks = append(append([]ChunkInfo{}, done...), chunks...)
+	manifest.Complete = true
+	if err := writeManifest(outpath, manifest); err != nil {
+		return nil, err
+	}
 
-		unalignedSa := createUnalignedSuffixArray(readValues)
+	if err := removeBuildState(outpath); err != nil {
+		return nil, err
+	}
 
-		saChunkPath := path.Join(outpath, fmt.Sprintf("suffix_array_%d.bin", currChunk))
-		err = writeIndicesToFile(saChunkPath, unalignedSa, offset)
-		if err != nil {
-			return err
-		}
+	return openModel(outpath, manifest, cfg.VerifyChecksums)
+}
 
-		currChunk += 1
-		offset += int64(chunkLength)
+// Opens the index described by manifest, which must be complete. If
+// verifyChecksums is set, every suffix array is read once to check its checksum,
+// so a corrupted file fails here rather than serving wrong results.
+func openModel(outpath string, manifest *IndexManifest, verifyChecksums bool) (*ModelData, error) {
+	if err := manifest.checkFiles(outpath); err != nil {
+		return nil, err
+	}
+
+	dataBytes, err := manifest.openCorpus(outpath)
+	if err != nil {
+		return nil, err
+	}
 
-		return nil
+	deleted, indexed, err := loadTombstones(outpath, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var suffixArray SuffixArray
+	if manifest.backend() == backendFM {
+		suffixArray, err = makeMultiFMIndex(outpath, manifest.searchChunks(), manifest.TokenWidth, indexed)
+	} else {
+		suffixArray, err = makeMultiSuffixArray(outpath, manifest, indexed, verifyChecksums)
 	}
-	err = documentIter(dataPath, sentinalSize, sentinalVal, chunkBuffer, saCallback)
 	if err != nil {
 		return nil, err
 	}
 
-	// get list of filenames
-	numChunks := currChunk
-	saChunkPaths := make([]string, numChunks)
-	for i := 0; i < numChunks; i++ {
-		saChunkPaths[i] = path.Join(outpath, fmt.Sprintf("suffix_array_%d.bin", i))
+	docs, err := openDocIndex(outpath, manifest)
+	if err != nil {
+		return nil, err
 	}
 
-	// save list of filenames to disk
-	err = writeStringToFile(saChunkPathsPath, strings.Join(saChunkPaths, "\n"))
+	metadata, err := openMetadataIndex(outpath, manifest)
 	if err != nil {
 		return nil, err
 	}
 
-	suffixArray, err := makeMultiSuffixArray(saChunkPaths)
+	sources, err := openSourceIndex(outpath, manifest)
 	if err != nil {
 		return nil, err
 	}
 
 	return &ModelData{
-		suffixArray: suffixArray,
-		bytesData:   dataBytes,
-		vocabSize:   vocabSize,
+		suffixArray:  suffixArray,
+		bytesData:    dataBytes,
+		vocabSize:    manifest.VocabSize,
+		tokenWidth:   manifest.TokenWidth,
+		sentinalSize: manifest.SentinalSize,
+		docs:         docs,
+		deleted:      deleted,
+		metadata:     metadata,
+		sources:      sources,
+		sourceFiles:  manifest.Sources,
 	}, nil
 }
 
@@ -247,35 +375,53 @@ func InitializeModel(filename, lineSplit, outpath, tokenizerConfig string, senti
 // the longest possible suffix. The suffix must have at least minMatches occurrences in the data.
 // modelData and tk are the model and tokenizer, respectively.
 func InteractiveNextToken(queryIds []uint32, modelData *ModelData, tk *tokenizers.Tokenizer, top_k, minMatches int) {
-	prediction := modelData.NextTokenDistribution(queryIds, 1, minMatches)
+	prediction, err := modelData.NextTokenDistribution(queryIds, 1, minMatches, 0, 0)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 
 	if prediction.numRetrieved == 0 {
 		fmt.Println("No continuations found")
 		return
 	}
 
-	topIndices := intToUint32(argsort(prediction.distribution, true))
+	topIndices := prediction.sortedTokens()
 	if len(topIndices) > top_k {
 		topIndices = topIndices[:top_k]
 	}
 
+	var indexCounts []IndexTokenCounts
+	if modelData.members != nil {
+		indexCounts, err = modelData.NextTokenCountsByIndex(queryIds[len(queryIds)-prediction.effectiveN:])
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		for _, count := range indexCounts {
+			fmt.Printf("%s: %d continuation(s) of the suffix\n", count.Index, count.Total)
+		}
+	}
+
 	fullGeneration := append([]uint32{}, queryIds...)
 	fullGeneration = append(fullGeneration, 0)
 	for i, tkn_idx := range topIndices {
-		prob := prediction.distribution[tkn_idx]
+		count := prediction.counts[tkn_idx]
 
 		fullGeneration[len(fullGeneration)-1] = tkn_idx
 
-		total := prediction.numRetrieved
 		fmt.Printf(
 			"n=%d, p=%.3f (%d/%d), k=%d: %s\n",
 			prediction.effectiveN,
-			prob,
-			int(prob*float32(total)),
-			total,
+			prediction.prob(tkn_idx),
+			count,
+			prediction.numRetrieved,
 			i,
 			tk.Decode(fullGeneration, true),
 		)
+		for _, count := range indexCounts {
+			fmt.Printf("  %s: %d\n", count.Index, count.Counts[tkn_idx])
+		}
 	}
 }
 
@@ -284,12 +430,92 @@ func InteractiveNextToken(queryIds []uint32, modelData *ModelData, tk *tokenizer
 // modelData and tk are the model and tokenizer, respectively.
 func InteractiveGenerateGreedy(queryIds []uint32, modelData *ModelData, tk *tokenizers.Tokenizer, numNewTokens, minMatches int) {
 	generated_tokens := make(chan []uint32, 8)
+	errs := make(chan error, 1)
 
-	go modelData.GenerateGreedyStream(queryIds, numNewTokens, minMatches, generated_tokens)
+	go modelData.GenerateGreedyStream(queryIds, numNewTokens, minMatches, generated_tokens, errs)
 
 	for tkns := range generated_tokens {
 		fmt.Printf("====\n%s\n", tk.Decode(tkns, true))
 	}
+
+	select {
+	case err := <-errs:
+		fmt.Println("Error:", err)
+	default:
+	}
+}
+
+// Given a sequence of tokens (queryIds) will print the first maxDocs documents containing
+// it, with where it occurs in each, where it was read from, its metadata and some context
+// around the first occurrence.
+// modelData and tk are the model and tokenizer, respectively.
+func InteractiveFindDocuments(queryIds []uint32, modelData *ModelData, tk *tokenizers.Tokenizer, maxDocs int) {
+	const contextSize = 16 // tokens shown before and after the first occurrence
+
+	matches, err := modelData.FindDocuments(queryIds)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	if len(matches) == 0 {
+		fmt.Println("No documents found")
+		return
+	}
+
+	fmt.Printf("found in %d document(s)\n", len(matches))
+	for _, match := range matches[:min(len(matches), maxDocs)] {
+		doc, err := modelData.GetDocument(match.DocID)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+
+		first := match.Offsets[0]
+		context := doc[max(first-contextSize, 0):min(first+int64(len(queryIds))+contextSize, int64(len(doc)))]
+		source, err := modelData.DocumentSource(match.DocID)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+
+		fmt.Printf("doc %d (%d tokens, %s record %d), offsets %v: %s\n", match.DocID, len(doc), source.Path, source.Record, match.Offsets, tk.Decode(context, true))
+		if match.Metadata != nil {
+			fmt.Printf("  metadata: %s\n", match.Metadata)
+		}
+	}
+}
+
+// Given a sequence of tokens (queryIds) will print its number of occurrences and the
+// probability of its last token following the rest, both conditioned on every token
+// before it and as an ∞-gram (conditioned on the longest suffix with at least
+// minMatches occurrences). modelData is the model.
+func InteractiveProb(queryIds []uint32, modelData *ModelData, minMatches int) {
+	count, err := modelData.Count(queryIds)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Printf("count: %d\n", count)
+
+	if len(queryIds) == 0 {
+		return
+	}
+	context, token := queryIds[:len(queryIds)-1], queryIds[len(queryIds)-1]
+
+	prob, err := modelData.Prob(context, token)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Printf("n=%d, p=%.3f (%d/%d)\n", prob.SuffixLen+1, prob.Prob, prob.Count, prob.ContextCount)
+
+	infProb, err := modelData.InfGramProb(context, token, minMatches)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Printf("inf-gram: n=%d, p=%.3f (%d/%d)\n", infProb.SuffixLen+1, infProb.Prob, infProb.Count, infProb.ContextCount)
 }
 
 func main() {
@@ -297,6 +523,7 @@ func main() {
 
 	var (
 		filename        string
+		fileList        string
 		outpath         string
 		nWorkers        int
 		tokenizerConfig string
@@ -307,26 +534,131 @@ func main() {
 		interactiveMode int
 		numGenerate     int
 		lineSplit       string
+		inputFormat     string
+		textField       string
+		inputTokenWidth int
+		docSeparator    int
 		maxMem          int
+		chunkSize       int
+		saWorkers       int
+		tokenWidth      int
+		byteLevelSA     bool
+		backend         string
+		fmSampleRate    int
+		buildLCP        bool
+		verifyChecksums bool
+		dryRun          bool
+		mode            string
+		verifySamples   int
+		maxViolations   int
+		seed            int64
+		docIds          string
+		docIdsFile      string
+		metadataFields  string
+		dedupMinTokens  int
+		dedupCorpus     string
+		indexDirs       string
+		statsFormat     string
+		numUnigrams     int
 	)
 
-	flag.StringVar(&filename, "train_file", "", "Path to training data")
+	flag.StringVar(&mode, "mode", "query", "query: build the index if needed and answer queries interactively; verify: check the integrity of the index in --out_dir; merge: merge the suffix array chunks in --out_dir into one; append: add the documents in --train_file to the index in --out_dir; delete: mark the documents --doc_ids in --out_dir as deleted; compact: drop the entries of deleted documents from the suffix arrays in --out_dir; dedup: find the spans of at least --dedup_min_tokens tokens that are repeated in the index in --out_dir and write the corpus without them to --dedup_corpus; stats: print statistics of the index in --out_dir; lcp: build the LCP arrays missing from the suffix arrays in --out_dir")
+
+	flag.StringVar(&filename, "train_file", "", "Path to training data: a comma separated list of files and globs (e.g., shards/*.jsonl.zst), read in order. Files ending in .gz or .zst are decompressed")
+	flag.StringVar(&fileList, "train_file_list", "", "File listing more training data files, one per line, read after --train_file")
+	flag.StringVar(&inputFormat, "input_format", inputText, "Format of the training data: text (documents separated by --line_split), jsonl (one JSON object per document, which may span several lines), tokens (raw little endian token ids of --input_token_width bytes) or npy (one-dimensional NumPy array of token ids). tokens and npy are imported without running the tokenizer, with documents ending at --doc_separator")
+	flag.IntVar(&inputTokenWidth, "input_token_width", 2, "Number of bytes per token id in tokens training data: 2 (uint16) or 4 (uint32)")
+	flag.IntVar(&docSeparator, "doc_separator", -1, "Token id that ends each document (e.g., EOS) in tokens and npy training data; it is replaced by the sentinals. Also ends each document of --dedup_corpus")
 	flag.StringVar(&lineSplit, "line_split", "\n", "String to split documents in training data file")
+	flag.StringVar(&textField, "text_field", "text", "Field holding the document text in jsonl training data; use dots for nested fields (e.g., content.body)")
+	flag.StringVar(&metadataFields, "metadata_fields", "", "Comma separated jsonl fields to keep as metadata for each document; use dots for nested fields")
 	flag.StringVar(&outpath, "out_dir", "", "Directory to save trained model")
+	flag.StringVar(&indexDirs, "index_dirs", "", "Comma separated directories of built indices to query together as one corpus, instead of --out_dir")
 	flag.IntVar(&nWorkers, "n_workers", 4, "Number of workers to use")
 	flag.StringVar(&tokenizerConfig, "tokenizer_config", "tokenizer_gpt2.json", "Path to .json file containing tokenizer configuration")
 	flag.IntVar(&sentinalVal, "sentinal_val", 0, "Value to add at the end of every document")
 	flag.IntVar(&sentinalSize, "sentinal_size", 2, "Number of sentinals to add at the end of every document")
+	flag.IntVar(&tokenWidth, "token_width", defaultTokenWidth, "Number of bytes used to store each token: 2 (uint16) or 4 (uint32, for vocabularies larger than 65536)")
 	flag.IntVar(&minMatches, "min_matches", 1, "Minimum number of continuations needed for suffix to be valid")
 
-	flag.IntVar(&maxMem, "max_mem", 1024, "Maximum size (in MiB) of documents for each chunk")
-
-	flag.IntVar(&interactiveMode, "interactive_mode", 0, "0: print the top-k best next-token continuations 1: greedily generate k tokens")
-	flag.IntVar(&topK, "top_k", 8, "Number of most frequent continuations to print during interactive mode 0")
+	flag.IntVar(&maxMem, "max_mem", 1024, "Peak memory (in MiB) of building suffix arrays: covers the read buffer, every allocation of the chunks being built and the runtime")
+	flag.IntVar(&chunkSize, "chunk_size", 0, "Maximum size (in MiB) of documents for each chunk; 0 picks the largest size that can be built within --max_mem, the same for any --sa_workers")
+	flag.IntVar(&saWorkers, "sa_workers", 1, "Number of suffix array chunks to build at once")
+	flag.BoolVar(&byteLevelSA, "byte_level_sa", false, "Sort suffix arrays over bytes instead of tokens; gives the same suffix arrays but is slower and uses more memory")
+	flag.StringVar(&backend, "backend", backendSA, "Index stored for each chunk: sa (suffix array) or fm (FM-index with a wavelet tree; smaller, but queries are slower)")
+	flag.IntVar(&fmSampleRate, "fm_sample_rate", defaultFMSampleRate, "Token positions per sampled suffix array entry of the fm backend; larger values use less space but make retrieving continuations slower")
+	flag.BoolVar(&dryRun, "dry_run", false, "Print the number of chunks, peak memory and disk usage that building (or appending to) the index would have, without building anything")
+	flag.BoolVar(&verifyChecksums, "verify_checksums", true, "Check the checksum of every suffix array when the index is opened, so a corrupted file fails to open; reads every suffix array once, so disable it to open large indices faster")
+	flag.BoolVar(&buildLCP, "build_lcp", false, "Also build the LCP (longest common prefix) array of every suffix array chunk; needs token level suffix arrays and the sa backend")
+
+	flag.IntVar(&interactiveMode, "interactive_mode", 0, "0: print the top-k best next-token continuations 1: greedily generate k tokens 2: print the top-k documents containing the query 3: print the count of the query and the probability of its last token")
+	flag.IntVar(&topK, "top_k", 8, "Number of most frequent continuations to print during interactive mode 0, or documents during interactive mode 2")
 	flag.IntVar(&numGenerate, "num_generate", 32, "Number of new tokens to generate")
 
+	flag.IntVar(&verifySamples, "verify_samples", 10000, "Number of random entries to check per chunk during verification; 0 checks every entry")
+	flag.IntVar(&maxViolations, "max_violations", 10, "Number of violations to report during verification")
+	flag.Int64Var(&seed, "seed", 0, "Random seed used for sampling")
+
+	flag.StringVar(&docIds, "doc_ids", "", "Comma separated ids of the documents to delete")
+	flag.StringVar(&docIdsFile, "doc_ids_file", "", "File with the ids of the documents to delete, one per line")
+
+	flag.IntVar(&dedupMinTokens, "dedup_min_tokens", 50, "Minimum length (in tokens) of the repeated spans found by dedup")
+	flag.StringVar(&dedupCorpus, "dedup_corpus", "", "File to write the corpus without its repeated spans to during dedup, as raw token ids that can be indexed with --input_format tokens")
+
+	flag.StringVar(&statsFormat, "stats_format", statsText, "Output format of stats: text or json")
+	flag.IntVar(&numUnigrams, "num_unigrams", 20, "Number of most frequent tokens printed by stats")
+
 	flag.Parse()
 
+	switch mode {
+	case "query", "append":
+	case "verify":
+		ok, err := runVerify(outpath, verifySamples, maxViolations, seed)
+		if err != nil {
+			panic(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	case "merge":
+		if err := runMerge(outpath); err != nil {
+			panic(err)
+		}
+		return
+	case "delete":
+		ids, err := parseDocIds(docIds, docIdsFile)
+		if err != nil {
+			panic(err)
+		}
+		if err := runDelete(outpath, ids); err != nil {
+			panic(err)
+		}
+		return
+	case "compact":
+		if err := runCompact(outpath); err != nil {
+			panic(err)
+		}
+		return
+	case "stats":
+		if err := runStats(outpath, numUnigrams, statsFormat); err != nil {
+			panic(err)
+		}
+		return
+	case "dedup":
+		if err := runDedup(outpath, dedupMinTokens, dedupCorpus, docSeparator); err != nil {
+			panic(err)
+		}
+		return
+	case "lcp":
+		if err := runBuildLCP(outpath); err != nil {
+			panic(err)
+		}
+		return
+	default:
+		panic(fmt.Sprintf("unknown mode %q", mode))
+	}
+
 	// load tokenizer
 	tk, err := tokenizers.FromFile(tokenizerConfig)
 	if err != nil {
@@ -335,21 +667,67 @@ func main() {
 
 	defer tk.Close()
 
-	modelDataP, err := InitializeModel(
-		filename,
-		lineSplit,
-		outpath,
-		tokenizerConfig,
-		sentinalVal,
-		sentinalSize,
-		nWorkers,
-		int(tk.VocabSize()),
-		maxMem*1024*1024,
-	)
+	files, err := resolveInputs(filename, fileList)
 	if err != nil {
 		panic(err)
 	}
 
+	cfg := BuildConfig{
+		Files:           files,
+		InputFormat:     inputFormat,
+		LineSplit:       lineSplit,
+		TextField:       textField,
+		InputTokenWidth: inputTokenWidth,
+		DocSeparator:    docSeparator,
+		Outpath:         outpath,
+		TokenizerConfig: tokenizerConfig,
+		SentinalVal:     sentinalVal,
+		SentinalSize:    sentinalSize,
+		NWorkers:        nWorkers,
+		VocabSize:       int(tk.VocabSize()),
+		ChunkSize:       chunkSize * 1024 * 1024,
+		MaxMem:          int64(maxMem) * 1024 * 1024,
+		SAWorkers:       saWorkers,
+		TokenWidth:      tokenWidth,
+		ByteLevelSA:     byteLevelSA,
+		Backend:         backend,
+		FMSampleRate:    fmSampleRate,
+		BuildLCP:        buildLCP,
+		VerifyChecksums: verifyChecksums,
+		MetadataFields:  parseMetadataFields(metadataFields),
+	}
+
+	if dryRun {
+		if err := runDryRun(&cfg, mode == "append"); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if mode == "append" {
+		if err := runAppend(cfg); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	var modelDataP *ModelData
+	if indexDirs != "" {
+		tokenizerHash, err := hashFile(tokenizerConfig)
+		if err != nil {
+			panic(err)
+		}
+		modelDataP, err = openCompositeModel(parseIndexDirs(indexDirs), tokenizerHash, verifyChecksums)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		modelDataP, err = InitializeModel(cfg)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	modelData := *modelDataP
 
 	reader := bufio.NewReader(os.Stdin)
@@ -373,6 +751,10 @@ func main() {
 			InteractiveNextToken(en, &modelData, tk, topK, minMatches)
 		} else if interactiveMode == 1 {
 			InteractiveGenerateGreedy(en, &modelData, tk, numGenerate, minMatches)
+		} else if interactiveMode == 2 {
+			InteractiveFindDocuments(en, &modelData, tk, topK)
+		} else if interactiveMode == 3 {
+			InteractiveProb(en, &modelData, minMatches)
 		}
 	}
 }
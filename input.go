@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Formats of the input file.
+const (
+	inputText  = "text"  // documents separated by a string (e.g., one per line)
+	inputJSONL = "jsonl" // one JSON object per document
+
+	// pre-tokenized, imported without running the tokenizer
+	inputTokens = "tokens" // raw little endian token ids, documents ending in a separator token
+	inputNpy    = "npy"    // one-dimensional NumPy array of token ids, documents ending in a separator token
+)
+
+// A document read from the input, before it is tokenized.
+type document struct {
+	text     string
+	metadata []byte // selected metadata fields as a JSON object; nil if none are kept
+}
+
+// Describes how documents are read from the input file.
+type inputFormat struct {
+	format         string   // inputText or inputJSONL
+	lineSplit      string   // separates documents in text input
+	textField      []string // path to the document text in JSONL input
+	metadataFields []string // JSONL fields kept as metadata, as dot separated paths
+
+	inputTokenWidth int   // bytes per token id in raw token input
+	docSeparator    int64 // token id that ends each document in pre-tokenized input
+}
+
+// Returns whether the input is already tokenized.
+func (f *inputFormat) pretokenized() bool {
+	return f.format == inputTokens || f.format == inputNpy
+}
+
+// Checks that the input format of cfg and its settings are consistent.
+func validateInput(cfg *BuildConfig) error {
+	switch cfg.InputFormat {
+	case inputText:
+	case inputJSONL:
+		if cfg.TextField == "" {
+			return fmt.Errorf("%s input needs a text field", inputJSONL)
+		}
+	case inputTokens, inputNpy:
+		if cfg.InputFormat == inputTokens {
+			if err := validateTokenWidth(cfg.InputTokenWidth); err != nil {
+				return fmt.Errorf("input token width: %w", err)
+			}
+		}
+		if cfg.DocSeparator < 0 {
+			return fmt.Errorf("%s input needs a document separator token", cfg.InputFormat)
+		}
+	default:
+		return fmt.Errorf("unknown input format %q: use %s, %s, %s or %s", cfg.InputFormat, inputText, inputJSONL, inputTokens, inputNpy)
+	}
+
+	if len(cfg.MetadataFields) > 0 && cfg.InputFormat != inputJSONL {
+		return fmt.Errorf("metadata fields need %s input", inputJSONL)
+	}
+	return nil
+}
+
+// Calls callback with every record of filename (a line of text input or an
+// object of JSONL input), starting at byte start of its decompressed contents.
+// callback also gets the byte position just past the record, which is where
+// reading would resume after it. onRead is passed to openInput.
+func (f *inputFormat) readFrom(filename string, start int64, onRead func(n int), callback func(recordP *string, end int64) error) error {
+	if f.format == inputJSONL {
+		return readJSONDocumentsFrom(filename, start, onRead, callback)
+	}
+	return readDocumentsFrom(filename, f.lineSplit, start, onRead, callback)
+}
+
+// Splits a record into the document text and its metadata.
+func (f *inputFormat) parse(record string) (*document, error) {
+	if f.format != inputJSONL {
+		return &document{text: record}, nil
+	}
+
+	object := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(record), &object); err != nil {
+		return nil, fmt.Errorf("invalid JSON document: %w", err)
+	}
+
+	// null would unmarshal into an empty string
+	doc := &document{}
+	text := lookupField(object, f.textField)
+	if len(text) == 0 || text[0] != '"' || json.Unmarshal(text, &doc.text) != nil {
+		return nil, fmt.Errorf("document has no string field %q", strings.Join(f.textField, "."))
+	}
+
+	if len(f.metadataFields) > 0 {
+		var err error
+		if doc.metadata, err = encodeMetadata(object, f.metadataFields); err != nil {
+			return nil, err
+		}
+	}
+
+	return doc, nil
+}
+
+// Returns the value at fieldPath in object, descending into nested objects, or
+// nil if there is no such field.
+func lookupField(object map[string]json.RawMessage, fieldPath []string) json.RawMessage {
+	for i, field := range fieldPath {
+		value, ok := object[field]
+		if !ok {
+			return nil
+		}
+		if i == len(fieldPath)-1 {
+			return value
+		}
+
+		object = make(map[string]json.RawMessage)
+		if err := json.Unmarshal(value, &object); err != nil {
+			// not an object, so it has no fields
+			return nil
+		}
+	}
+	return nil
+}
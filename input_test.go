@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// JSONL input whose records span several lines and hold newlines in their text.
+const testJSONL = `{"id": 1, "meta": {"body": {"text": "the cat\nsat"}}}
+{"id": 2,
+ "meta": {"body": {"text": "on the\n\nmat"}}}
+
+{"id": 3, "meta": {"body": {"text": "a dog"}}}
+`
+
+func TestReadJSONDocuments(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "input.jsonl")
+	if err := os.WriteFile(filename, []byte(testJSONL), 0644); err != nil {
+		t.Fatal(err)
+	}
+	input := &inputFormat{format: inputJSONL, textField: []string{"meta", "body", "text"}}
+
+	texts, ends := make([]string, 0), make([]int64, 0)
+	err := input.readFrom(filename, 0, nil, func(recordP *string, end int64) error {
+		doc, err := input.parse(*recordP)
+		if err != nil {
+			return err
+		}
+		texts, ends = append(texts, doc.text), append(ends, end)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"the cat\nsat", "on the\n\nmat", "a dog"}; !slices.Equal(texts, want) {
+		t.Fatalf("texts %q, want %q", texts, want)
+	}
+
+	// each record ends just past its closing brace, and reading resumes from there
+	for i, end := range ends {
+		if testJSONL[end-1] != '}' {
+			t.Fatalf("record %d ends at byte %d, after %q", i, end, testJSONL[:end])
+		}
+
+		numRest := 0
+		err := input.readFrom(filename, end, nil, func(recordP *string, _ int64) error {
+			numRest++
+			return nil
+		})
+		if err != nil || numRest != len(ends)-i-1 {
+			t.Fatalf("resuming after record %d: %d records (%v), want %d", i, numRest, err, len(ends)-i-1)
+		}
+	}
+
+	// a malformed record stops reading at its position
+	malformed := testJSONL + `{"id": 4, "meta": }` + "\n"
+	if err := os.WriteFile(filename, []byte(malformed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	numRead := 0
+	err = input.readFrom(filename, 0, nil, func(recordP *string, _ int64) error {
+		numRead++
+		return nil
+	})
+	if err == nil || numRead != 3 || !strings.Contains(err.Error(), "invalid JSON") {
+		t.Fatalf("malformed record: read %d records, error %v", numRead, err)
+	}
+}
+
+func TestParseJSONDocument(t *testing.T) {
+	tests := []struct {
+		field  string
+		record string
+		text   string // empty if the document is rejected
+	}{
+		{"text", `{"text": "the cat"}`, "the cat"},
+		{"a.b.c", `{"a": {"b": {"c": "the\ncat", "d": 1}}, "c": "dog"}`, "the\ncat"},
+		{"a.b.c", `{"a": {"b": {"d": "the cat"}}}`, ""}, // missing
+		{"a.b.c", `{"a": {"b": "the cat"}}`, ""},        // not an object
+		{"a.b.c", `{"c": "the cat"}`, ""},               // only at the top
+		{"text", `{"text": 3}`, ""},                     // not a string
+		{"text", `{"text": null}`, ""},                  // not a string
+		{"text", `{"text": ["the", "cat"]}`, ""},        // not a string
+		{"text", `["the cat"]`, ""},                     // not an object
+		{"text", `{"text": "the cat"`, ""},              // malformed
+		{"text", `{"text": "the \"cat\"\u0021"}`, `the "cat"!`},
+	}
+
+	for _, tt := range tests {
+		input := &inputFormat{format: inputJSONL, textField: strings.Split(tt.field, ".")}
+		doc, err := input.parse(tt.record)
+		if tt.text == "" {
+			if err == nil {
+				t.Errorf("%s of %s: parsed %q", tt.field, tt.record, doc.text)
+			}
+		} else if err != nil || doc.text != tt.text {
+			t.Errorf("%s of %s: %v, want %q", tt.field, tt.record, err, tt.text)
+		}
+	}
+}
+
+func TestBuildJSONL(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "input.jsonl")
+	if err := os.WriteFile(filename, []byte(testJSONL), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testTextBuildConfig(t, []string{filename})
+	cfg.InputFormat = inputJSONL
+	cfg.TextField = "meta.body.text"
+	m := buildTestIndex(t, cfg)
+
+	for id, text := range []string{"the cat\nsat", "on the\n\nmat", "a dog"} {
+		if got, err := m.GetDocument(int64(id)); err != nil || !slices.Equal(got, testTokenize(text)) {
+			t.Fatalf("document %d is %v (%v), want %v", id, got, err, testTokenize(text))
+		}
+		if source, err := m.DocumentSource(int64(id)); err != nil || source.Record != int64(id) {
+			t.Fatalf("document %d comes from %+v (%v), want record %d", id, source, err, id)
+		}
+	}
+
+	// documents without the text field fail the build
+	if err := os.WriteFile(filename, []byte(testJSONL+`{"id": 4, "meta": {"text": "a cat"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Outpath = filepath.Join(t.TempDir(), "index")
+	if _, err := InitializeModel(cfg); err == nil {
+		t.Fatal("built an index from a document without text")
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/schollz/progressbar/v3"
+	"golang.org/x/exp/mmap"
+)
+
+// On-disk format of an LCP array file. Entry i is the length (in tokens) of the
+// longest common prefix of suffix array entries i-1 and i, and entry 0 is 0. All
+// values are little endian.
+//
+//	offset  size  field
+//	0       8     magic ("INFGRMLC")
+//	8       4     format version
+//	12      4     reserved (zero)
+//	16      8     number of entries
+//	24      8     number of large entries
+//	32      8     CRC-64 (ECMA) checksum of everything after the header
+//	40      24    reserved (zero)
+//	64      -     entries: one byte each, the LCP if it is less than lcpEscape and lcpEscape otherwise
+//	-       -     large entries: (entry index, LCP) pairs of 8 byte values, sorted by entry index
+//
+// Most LCPs are small, so they are read directly from the byte of their entry;
+// only entries that hold lcpEscape need a search of the large entries.
+//
+// Like suffix arrays, LCP arrays are memory-mapped, so opening one checks the
+// header and the file size but not the checksum.
+const (
+	lcpMagic      = "INFGRMLC"
+	lcpVersion    = 1
+	lcpHeaderSize = 64
+	lcpEscape     = 255
+)
+
+// Header at the start of every LCP array file.
+type lcpHeader struct {
+	version    uint32
+	numEntries int64
+	numLarge   int64
+	checksum   uint64
+}
+
+func (h *lcpHeader) encode() []byte {
+	buf := make([]byte, lcpHeaderSize)
+	copy(buf, lcpMagic)
+	binary.LittleEndian.PutUint32(buf[8:], h.version)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(h.numEntries))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(h.numLarge))
+	binary.LittleEndian.PutUint64(buf[32:], h.checksum)
+	return buf
+}
+
+// Parses the header of an LCP array file of fileSize bytes.
+func decodeLCPHeader(buf []byte, fileSize int64) (*lcpHeader, error) {
+	if len(buf) < lcpHeaderSize || string(buf[:8]) != lcpMagic {
+		return nil, errors.New("not an LCP array file")
+	}
+
+	h := &lcpHeader{
+		version:    binary.LittleEndian.Uint32(buf[8:]),
+		numEntries: int64(binary.LittleEndian.Uint64(buf[16:])),
+		numLarge:   int64(binary.LittleEndian.Uint64(buf[24:])),
+		checksum:   binary.LittleEndian.Uint64(buf[32:]),
+	}
+
+	if h.version != lcpVersion {
+		return nil, fmt.Errorf("unsupported LCP array version %d (expected %d)", h.version, lcpVersion)
+	}
+	if h.numEntries < 0 || h.numLarge < 0 || h.numLarge > h.numEntries {
+		return nil, errors.New("corrupt LCP array header")
+	}
+
+	expectedSize := lcpHeaderSize + h.numEntries + h.numLarge*16
+	if fileSize != expectedSize {
+		return nil, fmt.Errorf("file has %d bytes but header describes %d: file is truncated or corrupt", fileSize, expectedSize)
+	}
+	return h, nil
+}
+
+// Name of the LCP array file of the suffix array in saPath.
+func lcpPath(saPath string) string {
+	return strings.TrimSuffix(saPath, ".bin") + ".lcp.bin"
+}
+
+// An LCP that doesn't fit in an entry's byte.
+type lcpLarge struct {
+	index int64
+	value int64
+}
+
+// Streams LCP entries to a file. Like saFileWriter, the header is written once
+// all entries are known and the file is renamed to its final name once complete.
+type lcpFileWriter struct {
+	filename  string
+	f         *os.File
+	bufWriter *bufio.Writer
+	crc       hash.Hash64
+	header    lcpHeader
+	large     []lcpLarge
+}
+
+func createLCPFile(filename string) (*lcpFileWriter, error) {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	w := &lcpFileWriter{
+		filename:  filename,
+		f:         f,
+		bufWriter: bufio.NewWriter(f),
+		crc:       crc64.New(crcTable),
+		header:    lcpHeader{version: lcpVersion},
+	}
+
+	// placeholder for the header
+	if _, err := w.bufWriter.Write(make([]byte, lcpHeaderSize)); err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Appends the next entry.
+func (w *lcpFileWriter) write(lcp int64) error {
+	b := byte(lcpEscape)
+	if lcp < lcpEscape {
+		b = byte(lcp)
+	} else {
+		w.large = append(w.large, lcpLarge{w.header.numEntries, lcp})
+	}
+
+	w.crc.Write([]byte{b})
+	if err := w.bufWriter.WriteByte(b); err != nil {
+		return err
+	}
+	w.header.numEntries++
+	return nil
+}
+
+// Writes the large entries and the header, syncs the file to disk and renames
+// it to its final name.
+func (w *lcpFileWriter) close() error {
+	buf := make([]byte, 16)
+	for _, large := range w.large {
+		binary.LittleEndian.PutUint64(buf, uint64(large.index))
+		binary.LittleEndian.PutUint64(buf[8:], uint64(large.value))
+		w.crc.Write(buf)
+		if _, err := w.bufWriter.Write(buf); err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	if err := w.bufWriter.Flush(); err != nil {
+		w.abort()
+		return err
+	}
+
+	w.header.numLarge = int64(len(w.large))
+	w.header.checksum = w.crc.Sum64()
+	if _, err := w.f.WriteAt(w.header.encode(), 0); err != nil {
+		w.abort()
+		return err
+	}
+
+	if err := w.f.Sync(); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return os.Rename(w.f.Name(), w.filename)
+}
+
+// Closes and removes the unfinished file.
+func (w *lcpFileWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// Access the LCP array from a memory-mapped file. The large entries are loaded
+// into memory.
+type MMappedLCP struct {
+	mReader *mmap.ReaderAt
+	header  *lcpHeader
+	large   []lcpLarge
+}
+
+// Opens a memory-mapped LCP array.
+func makeMMappedLCP(filepath string) (*MMappedLCP, error) {
+	mReader, err := mmap.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, lcpHeaderSize)
+	if _, err := mReader.ReadAt(buf, 0); err != nil {
+		mReader.Close()
+		return nil, fmt.Errorf("%s: file is too small to be an LCP array", filepath)
+	}
+	header, err := decodeLCPHeader(buf, int64(mReader.Len()))
+	if err != nil {
+		mReader.Close()
+		return nil, fmt.Errorf("%s: %w", filepath, err)
+	}
+
+	largeBytes := make([]byte, header.numLarge*16)
+	if _, err := mReader.ReadAt(largeBytes, lcpHeaderSize+header.numEntries); err != nil && !errors.Is(err, io.EOF) {
+		mReader.Close()
+		return nil, err
+	}
+	large := make([]lcpLarge, header.numLarge)
+	for i := range large {
+		large[i] = lcpLarge{
+			index: int64(binary.LittleEndian.Uint64(largeBytes[i*16:])),
+			value: int64(binary.LittleEndian.Uint64(largeBytes[i*16+8:])),
+		}
+	}
+
+	return &MMappedLCP{mReader: mReader, header: header, large: large}, nil
+}
+
+// Opens the LCP array in filepath, which must have numEntries entries like the
+// suffix array it belongs to.
+func openMatchingLCP(filepath string, numEntries int64) (*MMappedLCP, error) {
+	lcpArray, err := makeMMappedLCP(filepath)
+	if err != nil {
+		return nil, err
+	}
+	if lcpArray.length() != numEntries {
+		lcpArray.close()
+		return nil, fmt.Errorf("%s has %d entries but the suffix array has %d", filepath, lcpArray.length(), numEntries)
+	}
+	return lcpArray, nil
+}
+
+// Returns the length (in tokens) of the longest common prefix of suffix array
+// entries idx-1 and idx.
+func (l *MMappedLCP) get(idx int64) int64 {
+	if idx < 0 || idx >= l.header.numEntries {
+		panic(fmt.Sprintf("%d is out of bounds", idx))
+	}
+
+	b := l.mReader.At(int(lcpHeaderSize + idx))
+	if b < lcpEscape {
+		return int64(b)
+	}
+
+	i := sort.Search(len(l.large), func(i int) bool {
+		return l.large[i].index >= idx
+	})
+	return l.large[i].value
+}
+
+func (l *MMappedLCP) length() int64 {
+	return l.header.numEntries
+}
+
+func (l *MMappedLCP) close() error {
+	return l.mReader.Close()
+}
+
+// Writes the LCP array of a chunk whose tokens are valueBytes and whose suffix
+// array (in token indices, as returned by createTokenSuffixArray) is
+// suffixArray to filename. Suffixes end at the end of the chunk. Uses the Φ
+// algorithm (Kärkkäinen et al., 2009), which needs one int32 per token besides
+// the suffix array.
+func writeTokenLCPFile(filename string, valueBytes []byte, suffixArray []int32, tokenWidth int) error {
+	numTokens := len(suffixArray)
+
+	// phi[pos] is the suffix before pos in the suffix array, then the LCP of the two
+	phi := make([]int32, numTokens)
+	if numTokens > 0 {
+		phi[suffixArray[0]] = -1
+	}
+	for i := 1; i < numTokens; i++ {
+		phi[suffixArray[i]] = suffixArray[i-1]
+	}
+
+	lcp := 0
+	for pos := 0; pos < numTokens; pos++ {
+		prev := int(phi[pos])
+		if prev < 0 {
+			phi[pos] = 0
+			lcp = 0
+			continue
+		}
+		for pos+lcp < numTokens && prev+lcp < numTokens && getToken(valueBytes, pos+lcp, tokenWidth) == getToken(valueBytes, prev+lcp, tokenWidth) {
+			lcp++
+		}
+		phi[pos] = int32(lcp)
+		lcp = max(lcp-1, 0)
+	}
+
+	w, err := createLCPFile(filename)
+	if err != nil {
+		return err
+	}
+	for i, pos := range suffixArray {
+		value := int64(0)
+		if i > 0 {
+			value = int64(phi[pos])
+		}
+		if err := w.write(value); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	return w.close()
+}
+
+// Computes the LCP array of a suffix array whose entries are given one at a time,
+// in order, by comparing neighbouring suffixes in the tokenized corpus. Each
+// suffix ends at the end of its chunk, which is how the chunks are sorted.
+type lcpBuilder struct {
+	w        *lcpFileWriter
+	vec      TokenArray
+	manifest *IndexManifest
+	prevPos  int64
+}
+
+func newLCPBuilder(filename string, vec TokenArray, manifest *IndexManifest) (*lcpBuilder, error) {
+	w, err := createLCPFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &lcpBuilder{w: w, vec: vec, manifest: manifest, prevPos: -1}, nil
+}
+
+// Adds the suffix array entry at byte pos.
+func (b *lcpBuilder) add(pos int64) error {
+	lcp := int64(0)
+	if b.prevPos >= 0 {
+		lcp = commonPrefixLength(b.vec, b.prevPos, b.manifest.chunkEnd(b.prevPos), pos, b.manifest.chunkEnd(pos)) / int64(b.manifest.TokenWidth)
+	}
+	b.prevPos = pos
+	return b.w.write(lcp)
+}
+
+func (b *lcpBuilder) close() error {
+	return b.w.close()
+}
+
+func (b *lcpBuilder) abort() {
+	b.w.abort()
+}
+
+// Writes the LCP array of the suffix array of chunk by streaming its entries.
+// Returns the chunk's new description.
+func buildLCPForChunk(outpath string, chunk ChunkInfo, vec TokenArray, manifest *IndexManifest) (ChunkInfo, error) {
+	reader, err := openSAFileReader(path.Join(outpath, chunk.Path))
+	if err != nil {
+		return chunk, err
+	}
+	defer reader.close()
+
+	if err := reader.header.checkChunk(chunk, manifest.TokenWidth); err != nil {
+		return chunk, fmt.Errorf("%s: %w", chunk.Path, err)
+	}
+
+	lcpFile := lcpPath(chunk.Path)
+	builder, err := newLCPBuilder(path.Join(outpath, lcpFile), vec, manifest)
+	if err != nil {
+		return chunk, err
+	}
+
+	bar := progressbar.Default(chunk.NumEntries)
+	for {
+		pos, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			builder.abort()
+			return chunk, err
+		}
+
+		if err := builder.add(pos); err != nil {
+			builder.abort()
+			return chunk, err
+		}
+		bar.Add(1)
+	}
+	bar.Finish()
+
+	if err := builder.close(); err != nil {
+		return chunk, err
+	}
+
+	chunk.LCPPath = lcpFile
+	return chunk, nil
+}
+
+// Builds the LCP array of every suffix array of the index in outpath (including
+// the merged suffix array) that doesn't have one yet, and records them in the
+// manifest.
+func runBuildLCP(outpath string) error {
+	manifest, err := loadManifest(outpath)
+	if err != nil {
+		return err
+	}
+	if !manifest.Complete {
+		return fmt.Errorf("index in %s has not finished building", outpath)
+	}
+	if err := manifest.checkFiles(outpath); err != nil {
+		return err
+	}
+	if err := manifest.checkSuffixArrays("building LCP arrays"); err != nil {
+		return err
+	}
+
+	vec, err := manifest.openCorpus(outpath)
+	if err != nil {
+		return err
+	}
+
+	updated := *manifest
+	updated.Chunks = append([]ChunkInfo{}, manifest.Chunks...)
+
+	numBuilt := 0
+	for i, chunk := range manifest.Chunks {
+		if chunk.LCPPath != "" {
+			continue
+		}
+
+		fmt.Printf("building LCP array of chunk %d (%s)\n", i, chunk.Path)
+		if updated.Chunks[i], err = buildLCPForChunk(outpath, chunk, vec, manifest); err != nil {
+			return err
+		}
+		numBuilt++
+	}
+
+	if manifest.Merged != nil && manifest.Merged.LCPPath == "" {
+		fmt.Printf("building LCP array of the merged suffix array (%s)\n", manifest.Merged.Path)
+
+		merged := *manifest.Merged
+		if merged.ChunkInfo, err = buildLCPForChunk(outpath, merged.ChunkInfo, vec, manifest); err != nil {
+			return err
+		}
+		updated.Merged = &merged
+		numBuilt++
+	}
+
+	if numBuilt == 0 {
+		fmt.Println("Every suffix array already has an LCP array")
+		return nil
+	}
+
+	if err := writeManifest(outpath, &updated); err != nil {
+		return err
+	}
+
+	fmt.Printf("Built %d LCP array(s)\n", numBuilt)
+	return nil
+}
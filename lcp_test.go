@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// Length of the longest common prefix of the suffixes of tokens starting at a
+// and b.
+func naiveLCP(tokens []uint32, a, b int) int64 {
+	length := int64(0)
+	for a < len(tokens) && b < len(tokens) && tokens[a] == tokens[b] {
+		length++
+		a++
+		b++
+	}
+	return length
+}
+
+func TestTokenLCPMatchesNaive(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	vocab := []uint32{0, 1, 2, 255, 256, 300}
+	for trial := 0; trial < 30; trial++ {
+		tokens := randomTokens(rng, 1+rng.Intn(400), vocab[:1+rng.Intn(len(vocab))], trial%2 == 0)
+		if trial%5 == 0 {
+			// long repeats give LCPs that don't fit in an entry's byte
+			repeat := randomTokens(rng, 1+rng.Intn(3), vocab, false)
+			for len(tokens) < 1200 {
+				tokens = append(tokens, repeat...)
+			}
+		}
+
+		tokenWidth := 2 + 2*(trial%2)
+		valueBytes := encodeTokens(t, tokens, tokenWidth)
+		suffixArray := createTokenSuffixArray(valueBytes, tokenWidth)
+
+		filename := filepath.Join(t.TempDir(), "suffix_array_0.lcp.bin")
+		if err := writeTokenLCPFile(filename, valueBytes, suffixArray, tokenWidth); err != nil {
+			t.Fatal(err)
+		}
+
+		data := make([]int64, len(suffixArray))
+		for i, pos := range suffixArray {
+			data[i] = int64(pos) * int64(tokenWidth)
+		}
+		sa := &MemSA{data: data}
+		if err := sa.openLCP(filename); err != nil {
+			t.Fatal(err)
+		}
+		if !sa.hasLCP() {
+			t.Fatal("suffix array has no LCP array after opening one")
+		}
+
+		for i := range suffixArray {
+			want := int64(0)
+			if i > 0 {
+				want = naiveLCP(tokens, int(suffixArray[i-1]), int(suffixArray[i]))
+			}
+			if got := sa.lcp(int64(i)); got != want {
+				t.Fatalf("trial %d: LCP of entry %d is %d, want %d", trial, i, got, want)
+			}
+		}
+		sa.close()
+	}
+}
+
+func TestOpenLCPChecksLength(t *testing.T) {
+	valueBytes := encodeTokens(t, []uint32{3, 1, 3, 1, 0}, 2)
+	suffixArray := createTokenSuffixArray(valueBytes, 2)
+	filename := filepath.Join(t.TempDir(), "suffix_array_0.lcp.bin")
+	if err := writeTokenLCPFile(filename, valueBytes, suffixArray, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	sa := &MemSA{data: make([]int64, len(suffixArray)+1)}
+	if err := sa.openLCP(filename); err == nil {
+		t.Fatal("opened an LCP array with fewer entries than the suffix array")
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Version of the manifest format. Bump whenever the manifest or any of the
+// files it describes change in an incompatible way.
+const manifestVersion = 4
+
+const manifestFilename = "index.json"
+
+// Describes a single suffix array chunk of the index.
+type ChunkInfo struct {
+	Path       string `json:"path"`               // suffix array file, relative to the index directory
+	Start      int64  `json:"start"`              // first byte of the chunk in the tokenized corpus
+	End        int64  `json:"end"`                // one past the last byte of the chunk
+	NumEntries int64  `json:"num_entries"`        // number of suffix array entries
+	LCPPath    string `json:"lcp_path,omitempty"` // LCP array file, relative to the index directory; empty if there is none
+}
+
+// Describes a suffix array that merges the first NumChunks chunks into one.
+type MergedInfo struct {
+	ChunkInfo
+	NumChunks int `json:"num_chunks"`
+}
+
+// Self-describing record of how an index was built. It is written once the
+// corpus has been tokenized and rewritten once every suffix array chunk is
+// done. Loading an index checks it against the runtime settings. The manifest
+// is replaced atomically, so readers always see a consistent index.
+type IndexManifest struct {
+	Version int `json:"version"`
+
+	// tokenizer
+	TokenizerPath string `json:"tokenizer_path"`
+	TokenizerHash string `json:"tokenizer_sha256"`
+	VocabSize     int    `json:"vocab_size"`
+
+	// tokenized corpus
+	DataPath     string `json:"data_path"` // relative to the index directory
+	TokenWidth   int    `json:"token_width"`
+	SentinalVal  int    `json:"sentinal_val"`
+	SentinalSize int    `json:"sentinal_size"`
+	DataBytes    int64  `json:"data_bytes"`
+	NumTokens    int64  `json:"num_tokens"` // includes the sentinals
+	NumDocuments int64  `json:"num_documents"`
+
+	// starting byte of every document, relative to the index directory
+	DocOffsetsPath string `json:"doc_offsets_path"`
+
+	// input files, in the order they were tokenized, and the input file and
+	// record number of every document, relative to the index directory
+	Sources        []SourceInfo `json:"sources"`
+	DocSourcesPath string       `json:"doc_sources_path"`
+
+	// how documents are read from the input files; empty if the index was built
+	// before they were recorded
+	InputFormat string `json:"input_format,omitempty"`
+	TextField   string `json:"text_field,omitempty"` // JSONL input only
+
+	// metadata of every document and where each document's metadata starts,
+	// relative to the index directory; empty if no metadata is kept
+	MetadataFields      []string `json:"metadata_fields,omitempty"`
+	MetadataPath        string   `json:"metadata_path,omitempty"`
+	MetadataOffsetsPath string   `json:"metadata_offsets_path,omitempty"`
+	MetadataBytes       int64    `json:"metadata_bytes,omitempty"`
+
+	// suffix arrays, or FM-indices if the backend is backendFM
+	Backend   string      `json:"backend,omitempty"` // empty for backendSA
+	ChunkSize int64       `json:"chunk_size"`
+	Complete  bool        `json:"complete"` // whether every chunk below has been built
+	Chunks    []ChunkInfo `json:"chunks"`
+	Merged    *MergedInfo `json:"merged,omitempty"` // replaces the chunks it covers when searching
+
+	// number of times deleted documents were dropped from the suffix arrays, and
+	// the deleted documents bitmap as of the last time, relative to the index
+	// directory: the suffix arrays have no entries inside of those documents
+	Compactions   int    `json:"compactions,omitempty"`
+	CompactedPath string `json:"compacted_path,omitempty"`
+}
+
+// Settings used to build an index and to check an existing one against.
+type BuildConfig struct {
+	Files           []string // input files, tokenized in order
+	InputFormat     string   // format of Files: inputText or inputJSONL
+	LineSplit       string   // separates documents in text input
+	TextField       string   // dot separated path to the document text in JSONL input
+	Outpath         string   // directory the index is saved to
+	TokenizerConfig string   // tokenizer .json file
+	SentinalVal     int      // value added at the end of every document
+	SentinalSize    int      // number of sentinals added at the end of every document
+	NWorkers        int      // number of tokenization workers
+	VocabSize       int      // size of the tokenizer vocabulary
+	ChunkSize       int      // maximum size (in bytes) of the documents in each chunk; 0 picks it from MaxMem
+	MaxMem          int64    // peak memory (in bytes) of building suffix arrays
+	SAWorkers       int      // number of suffix array chunks built at once
+	TokenWidth      int      // number of bytes per token
+	ByteLevelSA     bool     // sort suffix arrays over bytes instead of tokens
+	Backend         string   // backendSA or backendFM
+	FMSampleRate    int      // token positions per sampled suffix array entry of an FM-index
+	BuildLCP        bool     // write the LCP array of every suffix array chunk
+	VerifyChecksums bool     // check the checksum of every suffix array when the index is opened
+
+	MetadataFields []string // JSONL fields kept for each document, as dot separated paths
+
+	InputTokenWidth int // bytes per token id in raw token input
+	DocSeparator    int // token id that ends each document in pre-tokenized input; -1 if unset
+}
+
+// Size (in bytes) of the documents in each chunk. Unless set, it is the largest
+// chunk that can be built on its own within the memory budget, so the chunks are
+// the same no matter how many workers build them; the budget then limits how
+// many are built at once.
+func (cfg *BuildConfig) chunkSize() int64 {
+	if cfg.ChunkSize > 0 {
+		return int64(cfg.ChunkSize)
+	}
+	return cfg.memoryPlan().chunkSizeForBudget(cfg.MaxMem)
+}
+
+// How documents are read from Files.
+func (cfg *BuildConfig) inputFormat() *inputFormat {
+	return &inputFormat{
+		format:         cfg.InputFormat,
+		lineSplit:      cfg.LineSplit,
+		textField:      strings.Split(cfg.TextField, "."),
+		metadataFields: cfg.MetadataFields,
+
+		inputTokenWidth: cfg.InputTokenWidth,
+		docSeparator:    int64(cfg.DocSeparator),
+	}
+}
+
+// Checks that the settings themselves are consistent.
+func (cfg *BuildConfig) validate() error {
+	if err := validateInput(cfg); err != nil {
+		return err
+	}
+	if err := validateTokenWidth(cfg.TokenWidth); err != nil {
+		return err
+	}
+	if cfg.VocabSize > 0 && uint64(cfg.VocabSize-1) > maxTokenValue(cfg.TokenWidth) {
+		return fmt.Errorf("vocabulary of size %d does not fit in %d-byte tokens: use a larger token width", cfg.VocabSize, cfg.TokenWidth)
+	}
+	if cfg.SentinalVal < 0 {
+		return fmt.Errorf("sentinal value %d is negative", cfg.SentinalVal)
+	}
+	if err := checkTokenValue(uint64(cfg.SentinalVal), cfg.TokenWidth); err != nil {
+		return err
+	}
+	if cfg.SentinalSize < 1 {
+		return fmt.Errorf("sentinal size must be at least 1, got %d", cfg.SentinalSize)
+	}
+	if cfg.SAWorkers < 1 {
+		return fmt.Errorf("number of suffix array workers must be at least 1, got %d", cfg.SAWorkers)
+	}
+	if err := validateBackend(cfg.Backend); err != nil {
+		return err
+	}
+	if cfg.Backend == backendFM {
+		if cfg.ByteLevelSA {
+			return fmt.Errorf("%s indices are built over tokens: byte level suffix arrays aren't supported", backendFM)
+		}
+		if cfg.FMSampleRate < 1 {
+			return fmt.Errorf("FM-index sample rate must be at least 1, got %d", cfg.FMSampleRate)
+		}
+		if cfg.BuildLCP {
+			return fmt.Errorf("LCP arrays are built alongside suffix arrays: the %s backend doesn't support them", backendFM)
+		}
+	}
+	if cfg.BuildLCP && cfg.ByteLevelSA {
+		return errors.New("LCP arrays are built from token level suffix arrays: byte level suffix arrays aren't supported")
+	}
+	return nil
+}
+
+// Create the manifest for a corpus freshly tokenized from sources.
+func newManifest(cfg *BuildConfig, tokenizerHash string, stats *corpusStats, sources []SourceInfo) *IndexManifest {
+	manifest := &IndexManifest{
+		Version:       manifestVersion,
+		TokenizerPath: cfg.TokenizerConfig,
+		TokenizerHash: tokenizerHash,
+		VocabSize:     cfg.VocabSize,
+		DataPath:      "data.bin",
+		TokenWidth:    cfg.TokenWidth,
+		SentinalVal:   cfg.SentinalVal,
+		SentinalSize:  cfg.SentinalSize,
+		DataBytes:     stats.numBytes,
+		NumTokens:     stats.numBytes / int64(cfg.TokenWidth),
+		NumDocuments:  stats.numDocuments,
+
+		DocOffsetsPath: docOffsetsFilename,
+
+		Sources:        sources,
+		DocSourcesPath: docSourcesFilename,
+		InputFormat:    cfg.InputFormat,
+	}
+
+	if cfg.InputFormat == inputJSONL {
+		manifest.TextField = cfg.TextField
+	}
+	if cfg.Backend != backendSA {
+		manifest.Backend = cfg.Backend
+	}
+
+	if len(cfg.MetadataFields) > 0 {
+		manifest.MetadataFields = cfg.MetadataFields
+		manifest.MetadataPath = metadataFilename
+		manifest.MetadataOffsetsPath = metadataOffsetsFilename
+		manifest.MetadataBytes = stats.metadataBytes
+	}
+	return manifest
+}
+
+// Returns an error describing the first setting that differs between the
+// manifest and cfg. tokenizerHash is the hash of cfg.TokenizerConfig.
+func (m *IndexManifest) checkConfig(cfg *BuildConfig, tokenizerHash string) error {
+	if m.TokenizerHash != tokenizerHash {
+		return fmt.Errorf("index was built with tokenizer %s (sha256 %s) but %s has sha256 %s", m.TokenizerPath, m.TokenizerHash, cfg.TokenizerConfig, tokenizerHash)
+	}
+	if m.VocabSize != cfg.VocabSize {
+		return fmt.Errorf("index was built with vocab size %d but tokenizer has %d", m.VocabSize, cfg.VocabSize)
+	}
+	if m.TokenWidth != cfg.TokenWidth {
+		return fmt.Errorf("index was built with %d-byte tokens but token width is set to %d", m.TokenWidth, cfg.TokenWidth)
+	}
+	if m.SentinalVal != cfg.SentinalVal {
+		return fmt.Errorf("index was built with sentinal value %d but sentinal value is set to %d", m.SentinalVal, cfg.SentinalVal)
+	}
+	if m.SentinalSize != cfg.SentinalSize {
+		return fmt.Errorf("index was built with sentinal size %d but sentinal size is set to %d", m.SentinalSize, cfg.SentinalSize)
+	}
+	if m.backend() != cfg.Backend {
+		return fmt.Errorf("index was built with the %s backend but the backend is set to %s", m.backend(), cfg.Backend)
+	}
+	if m.InputFormat != "" && m.InputFormat != cfg.InputFormat {
+		return fmt.Errorf("index was built from %s input but the input format is set to %s", m.InputFormat, cfg.InputFormat)
+	}
+	if m.InputFormat == inputJSONL && m.TextField != cfg.TextField {
+		return fmt.Errorf("index was built with text field %q but the text field is set to %q", m.TextField, cfg.TextField)
+	}
+	if !slices.Equal(m.MetadataFields, cfg.MetadataFields) {
+		return fmt.Errorf("index keeps metadata fields %q but metadata fields are set to %q", m.MetadataFields, cfg.MetadataFields)
+	}
+	return nil
+}
+
+// Returns an error describing the first setting that differs between two
+// indices, which have to agree for their documents to be queried together.
+func (m *IndexManifest) checkCompatible(other *IndexManifest) error {
+	if m.TokenizerHash != other.TokenizerHash {
+		return fmt.Errorf("tokenizer sha256 %s differs from %s", m.TokenizerHash, other.TokenizerHash)
+	}
+	if m.VocabSize != other.VocabSize {
+		return fmt.Errorf("vocab size %d differs from %d", m.VocabSize, other.VocabSize)
+	}
+	if m.TokenWidth != other.TokenWidth {
+		return fmt.Errorf("token width %d differs from %d", m.TokenWidth, other.TokenWidth)
+	}
+	if m.SentinalVal != other.SentinalVal {
+		return fmt.Errorf("sentinal value %d differs from %d", m.SentinalVal, other.SentinalVal)
+	}
+	if m.SentinalSize != other.SentinalSize {
+		return fmt.Errorf("sentinal size %d differs from %d", m.SentinalSize, other.SentinalSize)
+	}
+	return nil
+}
+
+// Index backend of the chunks.
+func (m *IndexManifest) backend() string {
+	if m.Backend == "" {
+		return backendSA
+	}
+	return m.Backend
+}
+
+// Returns an error if the chunks aren't suffix arrays, which action needs.
+func (m *IndexManifest) checkSuffixArrays(action string) error {
+	if m.backend() != backendSA {
+		return fmt.Errorf("%s needs suffix arrays but the index uses the %s backend", action, m.backend())
+	}
+	return nil
+}
+
+// Returns whether every chunk has an LCP array.
+func (m *IndexManifest) hasLCP() bool {
+	for _, chunk := range m.Chunks {
+		if chunk.LCPPath == "" {
+			return false
+		}
+	}
+	return len(m.Chunks) > 0
+}
+
+// Checks that the files described by the manifest exist and have the expected sizes.
+// The tokenized corpus and per-document files may be longer than recorded while
+// documents are being appended.
+func (m *IndexManifest) checkFiles(outpath string) error {
+	dataPath := path.Join(outpath, m.DataPath)
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() < m.DataBytes {
+		return fmt.Errorf("%s has %d bytes but the manifest expects %d", dataPath, info.Size(), m.DataBytes)
+	}
+
+	docsPath := path.Join(outpath, m.DocOffsetsPath)
+	info, err = os.Stat(docsPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() < m.NumDocuments*docOffsetSize {
+		return fmt.Errorf("%s has %d bytes but the manifest expects %d documents", docsPath, info.Size(), m.NumDocuments)
+	}
+
+	sourcesPath := path.Join(outpath, m.DocSourcesPath)
+	info, err = os.Stat(sourcesPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() < m.NumDocuments*docSourceSize {
+		return fmt.Errorf("%s has %d bytes but the manifest expects %d documents", sourcesPath, info.Size(), m.NumDocuments)
+	}
+
+	if len(m.MetadataFields) > 0 {
+		metadataPath := path.Join(outpath, m.MetadataPath)
+		info, err = os.Stat(metadataPath)
+		if err != nil {
+			return err
+		}
+		if info.Size() < m.MetadataBytes {
+			return fmt.Errorf("%s has %d bytes but the manifest expects %d", metadataPath, info.Size(), m.MetadataBytes)
+		}
+
+		offsetsPath := path.Join(outpath, m.MetadataOffsetsPath)
+		info, err = os.Stat(offsetsPath)
+		if err != nil {
+			return err
+		}
+		if info.Size() < m.NumDocuments*docOffsetSize {
+			return fmt.Errorf("%s has %d bytes but the manifest expects %d documents", offsetsPath, info.Size(), m.NumDocuments)
+		}
+	}
+
+	for _, chunk := range m.searchChunks() {
+		if _, err := os.Stat(path.Join(outpath, chunk.Path)); err != nil {
+			return err
+		}
+		if chunk.LCPPath != "" {
+			if _, err := os.Stat(path.Join(outpath, chunk.LCPPath)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The suffix arrays that queries search: the merged suffix array, if there is
+// one, followed by the chunks it doesn't cover.
+func (m *IndexManifest) searchChunks() []ChunkInfo {
+	if m.Merged == nil {
+		return m.Chunks
+	}
+
+	chunks := make([]ChunkInfo, 0, len(m.Chunks)-m.Merged.NumChunks+1)
+	chunks = append(chunks, m.Merged.ChunkInfo)
+	chunks = append(chunks, m.Chunks[m.Merged.NumChunks:]...)
+	return chunks
+}
+
+// Returns the end of the chunk containing byte pos, which is where suffixes
+// starting at pos stop when the chunks are sorted.
+func (m *IndexManifest) chunkEnd(pos int64) int64 {
+	idx := sort.Search(len(m.Chunks), func(i int) bool {
+		return m.Chunks[i].End > pos
+	})
+	if idx == len(m.Chunks) {
+		return m.DataBytes
+	}
+	return m.Chunks[idx].End
+}
+
+// Memory-maps the part of the tokenized corpus covered by the manifest.
+func (m *IndexManifest) openCorpus(outpath string) (*MMappedArray, error) {
+	return loadMMappedArrayPrefix(path.Join(outpath, m.DataPath), m.DataBytes)
+}
+
+func manifestPath(outpath string) string {
+	return path.Join(outpath, manifestFilename)
+}
+
+// Indices built before the manifest existed list their suffix array chunks in
+// this file, next to data.bin.
+const legacyChunkListFilename = "suffix_array_paths.txt"
+
+// Returns an error if outpath holds an index built before the manifest existed.
+// Such an index can't be opened, and building over it would replace its
+// tokenized corpus.
+func checkLegacyIndex(outpath string) error {
+	if hasManifest(outpath) {
+		return nil
+	}
+	for _, filename := range []string{"data.bin", legacyChunkListFilename} {
+		if _, err := os.Stat(path.Join(outpath, filename)); err != nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s holds an index built before %s existed: rebuild it in a new directory", outpath, manifestFilename)
+}
+
+// Returns whether a manifest exists in outpath.
+func hasManifest(outpath string) bool {
+	_, err := os.Stat(manifestPath(outpath))
+	return err == nil
+}
+
+func loadManifest(outpath string) (*IndexManifest, error) {
+	if err := checkLegacyIndex(outpath); err != nil {
+		return nil, err
+	}
+
+	manifestStr, err := readStringFromFile(manifestPath(outpath))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &IndexManifest{}
+	if err := json.Unmarshal([]byte(manifestStr), manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", manifestPath(outpath), err)
+	}
+
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("manifest %s has version %d but version %d is required: rebuild the index", manifestPath(outpath), manifest.Version, manifestVersion)
+	}
+
+	return manifest, nil
+}
+
+func writeManifest(outpath string, manifest *IndexManifest) error {
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(manifestPath(outpath), append(manifestBytes, '\n'))
+}
+
+// Returns the hex encoded sha256 hash of the file's contents.
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
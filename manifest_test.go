@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Ends every document of the raw token input written by writeTokenInput.
+const testDocSeparator = 999
+
+// Writes docs to filename as raw uint16 token ids, each document followed by
+// testDocSeparator.
+func writeTokenInput(t *testing.T, filename string, docs [][]uint32) {
+	t.Helper()
+	tokens := make([]uint32, 0)
+	for _, doc := range docs {
+		tokens = append(append(tokens, doc...), testDocSeparator)
+	}
+	if err := os.WriteFile(filename, encodeTokens(t, tokens, 2), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Settings that build an index in a new temporary directory from docs, imported
+// as raw tokens. Each document ends with a single sentinal 0.
+func testBuildConfig(t *testing.T, docs [][]uint32) BuildConfig {
+	t.Helper()
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.bin")
+	writeTokenInput(t, input, docs)
+
+	tokenizer := filepath.Join(dir, "tokenizer.json")
+	if err := os.WriteFile(tokenizer, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return BuildConfig{
+		Files:           []string{input},
+		InputFormat:     inputTokens,
+		Outpath:         filepath.Join(dir, "index"),
+		TokenizerConfig: tokenizer,
+		SentinalVal:     0,
+		SentinalSize:    1,
+		NWorkers:        1,
+		VocabSize:       1000,
+		MaxMem:          1 << 28,
+		SAWorkers:       1,
+		TokenWidth:      2,
+		Backend:         backendSA,
+		FMSampleRate:    4,
+		InputTokenWidth: 2,
+		DocSeparator:    testDocSeparator,
+		VerifyChecksums: true,
+	}
+}
+
+// Writes a word-level tokenizer over testVocab in which word i has token id
+// i+1, as testTokenize expects, to filename.
+func writeTestTokenizer(t *testing.T, filename string) {
+	t.Helper()
+	writeWordLevelTokenizer(t, filename, 1)
+}
+
+// Settings that tokenize the text files with the tokenizer of writeTestTokenizer
+// into an index in a new temporary directory. Each document ends with a single
+// sentinal 0.
+func testTextBuildConfig(t *testing.T, files []string) BuildConfig {
+	t.Helper()
+	dir := t.TempDir()
+	tokenizer := filepath.Join(dir, "tokenizer.json")
+	writeTestTokenizer(t, tokenizer)
+
+	return BuildConfig{
+		Files:           files,
+		InputFormat:     inputText,
+		LineSplit:       "\n",
+		Outpath:         filepath.Join(dir, "index"),
+		TokenizerConfig: tokenizer,
+		SentinalVal:     0,
+		SentinalSize:    1,
+		NWorkers:        1,
+		VocabSize:       len(testVocab) + 1,
+		MaxMem:          1 << 28,
+		SAWorkers:       1,
+		TokenWidth:      2,
+		Backend:         backendSA,
+		FMSampleRate:    4,
+		DocSeparator:    -1,
+		VerifyChecksums: true,
+	}
+}
+
+// Builds the index described by cfg and returns its model.
+func buildTestIndex(t *testing.T, cfg BuildConfig) *ModelData {
+	t.Helper()
+	m, err := InitializeModel(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestLegacyIndexIsRejected(t *testing.T) {
+	cfg := testBuildConfig(t, [][]uint32{{1, 2, 3}})
+	if err := os.MkdirAll(cfg.Outpath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	legacyData := []byte{1, 0, 2, 0, 0, 0}
+	dataPath := filepath.Join(cfg.Outpath, "data.bin")
+	if err := os.WriteFile(dataPath, legacyData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Outpath, legacyChunkListFilename), []byte("suffix_array_0.bin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := InitializeModel(cfg); err == nil {
+		t.Error("InitializeModel: built over an index without a manifest")
+	}
+	if _, err := loadManifest(cfg.Outpath); err == nil {
+		t.Error("loadManifest: loaded an index without a manifest")
+	}
+	if _, err := computeStats(cfg.Outpath, 10); err == nil {
+		t.Error("computeStats: computed the statistics of an index without a manifest")
+	}
+
+	if data, err := os.ReadFile(dataPath); err != nil || !bytes.Equal(data, legacyData) {
+		t.Errorf("tokenized corpus was replaced with %v (%v)", data, err)
+	}
+	if hasManifest(cfg.Outpath) {
+		t.Error("a manifest was written over the index")
+	}
+}
+
+func TestIndexRejectsOtherSettings(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(filename, []byte("the cat sat\nthe dog ran\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base := testTextBuildConfig(t, []string{filename})
+	buildTestIndex(t, base)
+
+	tests := []struct {
+		name   string
+		change func(cfg *BuildConfig)
+		err    string
+	}{
+		{"tokenizer", func(cfg *BuildConfig) {
+			// the same words with other ids
+			cfg.TokenizerConfig = filepath.Join(t.TempDir(), "tokenizer.json")
+			writeWordLevelTokenizer(t, cfg.TokenizerConfig, 2)
+		}, "built with tokenizer"},
+		{"vocab size", func(cfg *BuildConfig) { cfg.VocabSize++ }, "vocab size"},
+		{"token width", func(cfg *BuildConfig) { cfg.TokenWidth = 4 }, "2-byte tokens"},
+		{"sentinal value", func(cfg *BuildConfig) { cfg.SentinalVal = len(testVocab) }, "sentinal value 0"},
+		{"sentinal size", func(cfg *BuildConfig) { cfg.SentinalSize = 2 }, "sentinal size 1"},
+		{"backend", func(cfg *BuildConfig) { cfg.Backend = backendFM }, "sa backend"},
+		{"input format", func(cfg *BuildConfig) {
+			cfg.InputFormat = inputJSONL
+			cfg.TextField = "text"
+		}, "built from text input"},
+	}
+	for _, tt := range tests {
+		cfg := base
+		tt.change(&cfg)
+		if _, err := InitializeModel(cfg); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: opened the index (%v), want an error about %q", tt.name, err, tt.err)
+		}
+	}
+
+	// the index is left as it was
+	buildTestIndex(t, base)
+	manifest, err := loadManifest(base.Outpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.NumDocuments != 2 {
+		t.Fatalf("%d documents, want 2", manifest.NumDocuments)
+	}
+}
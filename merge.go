@@ -0,0 +1,239 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+const mergedFilename = "suffix_array_merged.bin"
+
+// Position of the k-way merge in one chunk's suffix array.
+type mergeCursor struct {
+	reader *saFileReader
+	pos    int64 // byte position of the current suffix
+	end    int64 // end of the chunk, where the current suffix stops
+}
+
+// Moves the cursor to the next entry. Returns false once the chunk is exhausted.
+func (c *mergeCursor) advance() (bool, error) {
+	pos, err := c.reader.next()
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	c.pos = pos
+	return true, nil
+}
+
+// Min-heap of cursors ordered by their current suffix. Suffixes are compared
+// through the tokenized corpus, each ending at the end of its own chunk (which is
+// how each chunk was sorted).
+type mergeHeap struct {
+	cursors []*mergeCursor
+	vec     TokenArray
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.cursors)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.cursors[i], h.cursors[j]
+
+	cmpValue := compareSuffixes(h.vec, a.pos, a.end, b.pos, b.end)
+	if cmpValue == 0 {
+		// identical suffixes: keep the output deterministic
+		return a.pos < b.pos
+	}
+	return cmpValue < 0
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	h.cursors = append(h.cursors, x.(*mergeCursor))
+}
+
+func (h *mergeHeap) Pop() any {
+	last := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return last
+}
+
+// Merges the sorted suffix arrays of every chunk of the index in outpath into a
+// single suffix array over the whole tokenized corpus. The chunk files are read as
+// streams, so memory use only depends on the number of chunks. Returns the merged
+// suffix array's description, which still has to be recorded in the manifest.
+// If every chunk has an LCP array, the merged suffix array gets one as well.
+func mergeSuffixArrays(outpath string, manifest *IndexManifest) (*MergedInfo, error) {
+	if !manifest.Complete {
+		return nil, fmt.Errorf("index in %s has not finished building", outpath)
+	}
+	if len(manifest.Chunks) == 0 {
+		return nil, errors.New("index has no chunks to merge")
+	}
+
+	vec, err := manifest.openCorpus(outpath)
+	if err != nil {
+		return nil, err
+	}
+
+	mergedChunk := ChunkInfo{
+		Path:  mergedFilename,
+		Start: 0,
+		End:   manifest.Chunks[len(manifest.Chunks)-1].End,
+	}
+
+	h := &mergeHeap{vec: vec}
+	defer func() {
+		for _, c := range h.cursors {
+			c.reader.close()
+		}
+	}()
+
+	for _, chunk := range manifest.Chunks {
+		reader, err := openSAFileReader(path.Join(outpath, chunk.Path))
+		if err != nil {
+			return nil, err
+		}
+		if err := reader.header.checkChunk(chunk, manifest.TokenWidth); err != nil {
+			reader.close()
+			return nil, fmt.Errorf("%s: %w", chunk.Path, err)
+		}
+
+		cursor := &mergeCursor{reader: reader, end: chunk.End}
+		ok, err := cursor.advance()
+		if err != nil {
+			reader.close()
+			return nil, err
+		}
+		if !ok {
+			reader.close()
+			continue
+		}
+
+		h.cursors = append(h.cursors, cursor)
+		mergedChunk.NumEntries += chunk.NumEntries
+	}
+	heap.Init(h)
+
+	saWriter, err := createSAFile(path.Join(outpath, mergedFilename), manifest.TokenWidth, mergedChunk.Start, mergedChunk.End-mergedChunk.Start)
+	if err != nil {
+		return nil, err
+	}
+
+	var lcpWriter *lcpBuilder
+	if manifest.hasLCP() {
+		mergedChunk.LCPPath = lcpPath(mergedFilename)
+		lcpWriter, err = newLCPBuilder(path.Join(outpath, mergedChunk.LCPPath), vec, manifest)
+		if err != nil {
+			saWriter.abort()
+			return nil, err
+		}
+	}
+	abort := func() {
+		saWriter.abort()
+		if lcpWriter != nil {
+			lcpWriter.abort()
+		}
+	}
+
+	bar := progressbar.Default(mergedChunk.NumEntries)
+	const barStep = 1024 * 1024
+
+	numWritten := int64(0)
+	for h.Len() > 0 {
+		smallest := h.cursors[0]
+		if err := saWriter.write(smallest.pos); err != nil {
+			abort()
+			return nil, err
+		}
+		if lcpWriter != nil {
+			if err := lcpWriter.add(smallest.pos); err != nil {
+				abort()
+				return nil, err
+			}
+		}
+
+		numWritten++
+		if numWritten%barStep == 0 {
+			bar.Add(barStep)
+		}
+
+		ok, err := smallest.advance()
+		if err != nil {
+			abort()
+			return nil, err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h).(*mergeCursor).reader.close()
+		}
+	}
+	bar.Add(int(numWritten % barStep))
+
+	if err := saWriter.close(); err != nil {
+		if lcpWriter != nil {
+			lcpWriter.abort()
+		}
+		return nil, err
+	}
+	if lcpWriter != nil {
+		if err := lcpWriter.close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if numWritten != mergedChunk.NumEntries {
+		return nil, fmt.Errorf("merged %d entries but the chunks have %d", numWritten, mergedChunk.NumEntries)
+	}
+
+	return &MergedInfo{ChunkInfo: mergedChunk, NumChunks: len(manifest.Chunks)}, nil
+}
+
+// Merges the chunks of the index in outpath and records the merged suffix array
+// in the manifest, so that queries search a single suffix array.
+func runMerge(outpath string) error {
+	manifest, err := loadManifest(outpath)
+	if err != nil {
+		return err
+	}
+	if err := manifest.checkFiles(outpath); err != nil {
+		return err
+	}
+	if err := manifest.checkSuffixArrays("merging"); err != nil {
+		return err
+	}
+
+	fmt.Printf("Merging %d suffix array chunk(s)\n", len(manifest.Chunks))
+	merged, err := mergeSuffixArrays(outpath, manifest)
+	if err != nil {
+		return err
+	}
+
+	previous := manifest.Merged
+	manifest.Merged = merged
+	if err := writeManifest(outpath, manifest); err != nil {
+		return err
+	}
+
+	// a compacted merged suffix array has its own file
+	if previous != nil && previous.Path != merged.Path {
+		os.Remove(path.Join(outpath, previous.Path))
+		if previous.LCPPath != "" && previous.LCPPath != merged.LCPPath {
+			os.Remove(path.Join(outpath, previous.LCPPath))
+		}
+	}
+	return nil
+}
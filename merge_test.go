@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Queries for a chunk of tokens: the empty query, every token of vocab, tokens
+// that don't occur, and random substrings of the chunk, including its end.
+func testQueries(rng *rand.Rand, tokens, vocab []uint32) [][]uint32 {
+	queries := [][]uint32{{}, {1 << 15}, {vocab[0], 1 << 15}}
+	for _, token := range vocab {
+		queries = append(queries, []uint32{token})
+	}
+	for i := 0; i < 50; i++ {
+		length := 1 + rng.Intn(4)
+		start := rng.Intn(len(tokens))
+		if i%5 == 0 {
+			start = len(tokens) - length
+		}
+		queries = append(queries, tokens[max(start, 0):min(start+length, len(tokens))])
+	}
+	return queries
+}
+
+func TestMergeKeepsChunkOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	docs := randomDocuments(rng, 80, 12, 4)
+	cfg := testBuildConfig(t, docs)
+	cfg.ChunkSize = 200
+	unmerged := buildTestIndex(t, cfg)
+
+	if err := runMerge(cfg.Outpath); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := loadManifest(cfg.Outpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Chunks) < 2 || manifest.Merged == nil || manifest.Merged.NumChunks != len(manifest.Chunks) {
+		t.Fatalf("%d chunks, merged %+v: want several chunks merged into one", len(manifest.Chunks), manifest.Merged)
+	}
+	vec, err := manifest.openCorpus(cfg.Outpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vec.mReader.Close()
+
+	merged := readSuffixArray(t, filepath.Join(cfg.Outpath, manifest.Merged.Path))
+	if int64(len(merged)) != manifest.Merged.NumEntries {
+		t.Fatalf("merged suffix array has %d entries, the manifest says %d", len(merged), manifest.Merged.NumEntries)
+	}
+
+	// suffixes stop at the end of their chunk, as when the chunks were sorted
+	for i := 1; i < len(merged); i++ {
+		a, b := merged[i-1], merged[i]
+		cmpValue := compareSuffixes(vec, a, manifest.chunkEnd(a), b, manifest.chunkEnd(b))
+		if cmpValue > 0 || (cmpValue == 0 && a > b) {
+			t.Fatalf("entries %d and %d (positions %d and %d) are out of order", i-1, i, a, b)
+		}
+	}
+
+	// the entries of each chunk are in the order of the chunk's own suffix array
+	for _, chunk := range manifest.Chunks {
+		inChunk := make([]int64, 0)
+		for _, pos := range merged {
+			if chunk.Start <= pos && pos < chunk.End {
+				inChunk = append(inChunk, pos)
+			}
+		}
+		if want := readSuffixArray(t, filepath.Join(cfg.Outpath, chunk.Path)); !slices.Equal(inChunk, want) {
+			t.Fatalf("chunk [%d, %d): merged order %v, chunk order %v", chunk.Start, chunk.End, inChunk, want)
+		}
+	}
+
+	// and queries of the merged suffix array find the same occurrences, at least
+	// those without sentinals, which never cross the end of a chunk
+	m := buildTestIndex(t, cfg)
+	tokens := make([]uint32, 0)
+	for _, doc := range docs {
+		tokens = append(append(tokens, doc...), 0)
+	}
+	for _, query := range testQueries(rng, tokens, []uint32{1, 2, 3}) {
+		if slices.Contains(query, 0) {
+			continue
+		}
+		want, err := unmerged.Count(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := m.Count(query); err != nil || got != want {
+			t.Fatalf("query %v: %d occurrences (%v), %d before merging", query, got, err, want)
+		}
+	}
+}
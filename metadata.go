@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/exp/mmap"
+)
+
+// The metadata file holds the selected metadata fields of every document as a
+// compact JSON object, one after the other. The metadata offsets file holds the
+// byte position in the metadata file where each document's object starts, as
+// little endian int64s, so the metadata of any document can be read directly.
+const (
+	metadataFilename        = "metadata.bin"
+	metadataOffsetsFilename = "metadata_offsets.bin"
+)
+
+// Parses a comma separated list of metadata field names.
+func parseMetadataFields(fieldList string) []string {
+	fields := make([]string, 0)
+	for _, field := range strings.Split(fieldList, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Encodes the fields of record that are in metadataFields (dot separated paths
+// into nested objects) as a compact JSON object keyed by the paths, keeping the
+// order of metadataFields. Fields that record doesn't have are left out.
+func encodeMetadata(record map[string]json.RawMessage, metadataFields []string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for _, field := range metadataFields {
+		value := lookupField(record, strings.Split(field, "."))
+		if value == nil {
+			continue
+		}
+
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(field)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		if err := json.Compact(buf, value); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// A file written through a buffer.
+type bufferedFile struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func openBufferedFile(filename string, flags int) (*bufferedFile, error) {
+	f, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedFile{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (bf *bufferedFile) write(data []byte) error {
+	_, err := bf.w.Write(data)
+	return err
+}
+
+// Flushes everything written so far to disk.
+func (bf *bufferedFile) sync() error {
+	if err := bf.w.Flush(); err != nil {
+		return err
+	}
+	return bf.f.Sync()
+}
+
+func (bf *bufferedFile) close() error {
+	err := bf.w.Flush()
+	if closeErr := bf.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Access the document metadata from memory-mapped files.
+type metadataIndex struct {
+	data      *mmap.ReaderAt
+	offsets   *mmap.ReaderAt
+	numDocs   int64
+	dataBytes int64 // end of the last document's metadata
+}
+
+// Opens the metadata of the index described by manifest. Returns nil if the
+// index has no metadata.
+func openMetadataIndex(outpath string, manifest *IndexManifest) (*metadataIndex, error) {
+	if len(manifest.MetadataFields) == 0 {
+		return nil, nil
+	}
+
+	data, err := mmap.Open(path.Join(outpath, manifest.MetadataPath))
+	if err != nil {
+		return nil, err
+	}
+	if int64(data.Len()) < manifest.MetadataBytes {
+		data.Close()
+		return nil, fmt.Errorf("%s has %d bytes but the manifest expects %d", manifest.MetadataPath, data.Len(), manifest.MetadataBytes)
+	}
+
+	offsets, err := mmap.Open(path.Join(outpath, manifest.MetadataOffsetsPath))
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	if int64(offsets.Len()) < manifest.NumDocuments*docOffsetSize {
+		data.Close()
+		offsets.Close()
+		return nil, fmt.Errorf("%s has %d bytes but %d documents are expected", manifest.MetadataOffsetsPath, offsets.Len(), manifest.NumDocuments)
+	}
+
+	return &metadataIndex{data: data, offsets: offsets, numDocs: manifest.NumDocuments, dataBytes: manifest.MetadataBytes}, nil
+}
+
+func (mi *metadataIndex) start(id int64) int64 {
+	buf := make([]byte, docOffsetSize)
+	if _, err := mi.offsets.ReadAt(buf, id*docOffsetSize); err != nil {
+		panic(err)
+	}
+	return int64(binary.LittleEndian.Uint64(buf))
+}
+
+// Returns the metadata of document id as a JSON object.
+func (mi *metadataIndex) get(id int64) (json.RawMessage, error) {
+	if id < 0 || id >= mi.numDocs {
+		return nil, fmt.Errorf("document %d does not exist: the index has %d documents", id, mi.numDocs)
+	}
+
+	start, end := mi.start(id), mi.dataBytes
+	if id < mi.numDocs-1 {
+		end = mi.start(id + 1)
+	}
+	if start > end || end > mi.dataBytes {
+		return nil, fmt.Errorf("metadata of document %d spans bytes [%d, %d)", id, start, end)
+	}
+
+	metadata := make([]byte, end-start)
+	if _, err := mi.data.ReadAt(metadata, start); err != nil {
+		return nil, err
+	}
+	if !json.Valid(metadata) {
+		return nil, errors.New("corrupt metadata")
+	}
+	return metadata, nil
+}
+
+func (mi *metadataIndex) close() error {
+	err := mi.data.Close()
+	if closeErr := mi.offsets.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncodeMetadata(t *testing.T) {
+	record := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(`{"text": "the cat", "url": "http://a", "info": {"date": "2024", "tags": [1, 2]}}`), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := encodeMetadata(record, []string{"info.tags", "missing", "url", "info.missing", "info.date"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"info.tags":[1,2],"url":"http://a","info.date":"2024"}`; string(metadata) != want {
+		t.Fatalf("metadata %s, want %s", metadata, want)
+	}
+
+	if metadata, err := encodeMetadata(record, []string{"missing"}); err != nil || string(metadata) != "{}" {
+		t.Fatalf("metadata without any of the fields is %s (%v)", metadata, err)
+	}
+}
+
+// Writes numDocs JSONL documents with a source and nested url field to
+// filename, starting at document first. Every tenth document is all whitespace
+// and every seventh has no url. Returns the metadata expected for each document
+// that isn't skipped, along with its text.
+func writeMetadataInput(t *testing.T, filename string, first, numDocs int) ([]string, []string) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(int64(first)))
+	var input strings.Builder
+	metadata, texts := make([]string, 0), make([]string, 0)
+	for i := first; i < first+numDocs; i++ {
+		text := strings.Repeat(testVocab[1+rng.Intn(len(testVocab)-1)]+" ", 1+rng.Intn(5))
+		if i%10 == 0 {
+			text = " \n "
+		}
+
+		if i%7 == 0 {
+			fmt.Fprintf(&input, `{"text": %q, "source": "s%d", "extra": 1}`+"\n", text, i)
+			if i%10 != 0 {
+				metadata, texts = append(metadata, fmt.Sprintf(`{"source":"s%d"}`, i)), append(texts, text)
+			}
+		} else {
+			fmt.Fprintf(&input, `{"info": {"url": "http://%d"}, "text": %q, "source": "s%d"}`+"\n", i, text, i)
+			if i%10 != 0 {
+				metadata, texts = append(metadata, fmt.Sprintf(`{"source":"s%d","info.url":"http://%d"}`, i, i)), append(texts, text)
+			}
+		}
+	}
+	if err := os.WriteFile(filename, []byte(input.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return metadata, texts
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "input.jsonl")
+	metadata, texts := writeMetadataInput(t, filename, 0, 200)
+
+	cfg := testTextBuildConfig(t, []string{filename})
+	cfg.InputFormat = inputJSONL
+	cfg.TextField = "text"
+	cfg.MetadataFields = []string{"source", "info.url"}
+	cfg.NWorkers = 4
+	buildTestIndex(t, cfg)
+
+	// append more documents, which keep their metadata too
+	cfg.Files = []string{filepath.Join(t.TempDir(), "new.jsonl")}
+	newMetadata, newTexts := writeMetadataInput(t, cfg.Files[0], 200, 50)
+	if err := runAppend(cfg); err != nil {
+		t.Fatal(err)
+	}
+	metadata, texts = append(metadata, newMetadata...), append(texts, newTexts...)
+
+	m := buildTestIndex(t, cfg)
+	if m.numDocs() != int64(len(metadata)) {
+		t.Fatalf("%d documents, want %d", m.numDocs(), len(metadata))
+	}
+
+	// any document's metadata can be read, in any order
+	for _, id := range rand.New(rand.NewSource(1)).Perm(len(metadata)) {
+		got, err := m.GetMetadata(int64(id))
+		if err != nil || string(got) != metadata[id] {
+			t.Fatalf("metadata of document %d is %s (%v), want %s", id, got, err, metadata[id])
+		}
+	}
+	if _, err := m.GetMetadata(int64(len(metadata))); err == nil {
+		t.Fatalf("document %d of %d has metadata", len(metadata), len(metadata))
+	}
+
+	// and it comes back with document results
+	matches, err := m.FindDocuments(testTokenize(texts[len(texts)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 {
+		t.Fatal("the last document isn't found")
+	}
+	for _, match := range matches {
+		if string(match.Metadata) != metadata[match.DocID] {
+			t.Fatalf("document %d is found with metadata %s, want %s", match.DocID, match.Metadata, metadata[match.DocID])
+		}
+	}
+
+	// appending with other fields would leave documents without metadata, and
+	// reopening with them is rejected the same way
+	other := cfg
+	other.MetadataFields = []string{"source"}
+	if err := runAppend(other); err == nil || !strings.Contains(err.Error(), "metadata fields") {
+		t.Fatalf("appended documents with other metadata fields (%v)", err)
+	}
+	if _, err := InitializeModel(other); err == nil || !strings.Contains(err.Error(), "metadata fields") {
+		t.Fatalf("reopened the index with other metadata fields (%v)", err)
+	}
+
+	// as is another text field
+	other = cfg
+	other.TextField = "body"
+	if err := runAppend(other); err == nil || !strings.Contains(err.Error(), "text field") {
+		t.Fatalf("appended documents with another text field (%v)", err)
+	}
+	if _, err := InitializeModel(other); err == nil || !strings.Contains(err.Error(), "text field") {
+		t.Fatalf("reopened the index with another text field (%v)", err)
+	}
+}
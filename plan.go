@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Memory used while building the suffix arrays besides the chunks: the Go
+// runtime, goroutine stacks and the buffers of the files being read and written.
+const buildOverheadBytes = 32 * 1024 * 1024
+
+// Assumptions used to estimate the size of a corpus before it is tokenized.
+const (
+	estimatedTextBytesPerToken = 4 // typical of BPE tokenizers on English text
+	estimatedCompressionRatio  = 4 // decompressed bytes per byte of a .gz or .zst input
+)
+
+// Accounts for the memory needed to build the suffix arrays (or FM-indices) of
+// an index, so that chunks can be sized to fit a peak memory budget.
+type memoryPlan struct {
+	tokenWidth   int
+	byteLevel    bool
+	backend      string
+	fmSampleRate int
+	maxTokens    int64 // number of token ids that may appear in a chunk
+}
+
+func newMemoryPlan(tokenWidth, vocabSize, sentinalVal int, byteLevel bool, backend string, fmSampleRate int) *memoryPlan {
+	maxTokens := int64(vocabSize)
+	if maxTokens == 0 {
+		maxTokens = int64(maxTokenValue(tokenWidth)) + 1
+	}
+
+	return &memoryPlan{
+		tokenWidth:   tokenWidth,
+		byteLevel:    byteLevel,
+		backend:      backend,
+		fmSampleRate: fmSampleRate,
+		maxTokens:    max(maxTokens, int64(sentinalVal)+1),
+	}
+}
+
+// Memory plan of the index described by cfg.
+func (cfg *BuildConfig) memoryPlan() *memoryPlan {
+	return newMemoryPlan(cfg.TokenWidth, cfg.VocabSize, cfg.SentinalVal, cfg.ByteLevelSA, cfg.Backend, cfg.FMSampleRate)
+}
+
+// Peak memory (in bytes) of building the suffix array (or FM-index) of a chunk of
+// chunkLength bytes, including the chunk's copy of its text. SA-IS needs up to
+// half an entry per suffix of scratch space on unfavorable inputs, which is
+// counted. Building the chunk's LCP array needs no more, as it reuses the space of
+// the ranked tokens.
+func (p *memoryPlan) chunkCost(chunkLength int64) int64 {
+	if p.byteLevel {
+		// the text, an int64 per byte for createUnalignedSuffixArray, the SA-IS
+		// scratch space and its bucket counts
+		return chunkLength + 8*chunkLength + 4*chunkLength + 2*256*8
+	}
+
+	numTokens := chunkLength / int64(p.tokenWidth)
+	alphabetSize := min(p.maxTokens, numTokens)
+
+	// rankTokens: the rank of every token id and the tokens in rank order, then
+	// the bucket counts of SA-IS: two int32s per token of the alphabet
+	alphabet := 4*p.maxTokens + 4*alphabetSize + 8*alphabetSize
+
+	// createTokenSuffixArray: the text, the ranked tokens, the suffix array and the
+	// SA-IS scratch space
+	sorting := chunkLength + 4*numTokens + 4*numTokens + 2*numTokens
+
+	if p.backend == backendFM {
+		// buildFMIndex: the text, the suffix array, the BWT, the scratch space of
+		// the wavelet tree, the levels of the wavelet tree, the sampled rows and the
+		// samples
+		numRows := numTokens + 1
+		bitsBytes := (numRows + 63) / 64 * 8
+		fm := chunkLength + 4*numTokens + 4*numRows + 4*numRows + int64(fmSymbolBits(int(alphabetSize)))*bitsBytes + bitsBytes + 4*(numTokens/int64(p.fmSampleRate)+1)
+		sorting = max(sorting, fm)
+	}
+
+	return alphabet + sorting
+}
+
+// Peak memory (in bytes) of building chunks of chunkSize bytes, numWorkers at
+// once: the read buffer, the chunks being built and the overhead.
+func (p *memoryPlan) peakMemory(chunkSize int64, numWorkers int) int64 {
+	return buildOverheadBytes + chunkSize + int64(numWorkers)*p.chunkCost(chunkSize)
+}
+
+// Largest chunk size (in bytes) such that a chunk can be built on its own within
+// maxMem bytes. Returns 0 if not even a single token fits.
+func (p *memoryPlan) chunkSizeForBudget(maxMem int64) int64 {
+	tokenWidth := int64(p.tokenWidth)
+
+	// the cost grows with the chunk size, so search for the largest that fits
+	lo, hi := int64(0), maxMem/tokenWidth+1
+	if !p.byteLevel {
+		hi = min(hi, maxTokenChunkSize(p.tokenWidth)/tokenWidth+1)
+	}
+	for lo+1 < hi {
+		mid := lo + (hi-lo)/2
+		if p.peakMemory(mid*tokenWidth, 1) <= maxMem {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo * tokenWidth
+}
+
+// Size (in bytes) of the FM-index file of a chunk of numTokens tokens.
+func (p *memoryPlan) fmIndexSize(numTokens int64) int64 {
+	alphabetSize := min(p.maxTokens, numTokens)
+	numRows := numTokens + 1
+	bitsBytes := (numRows + 63) / 64 * 8
+	numSamples := (numTokens + int64(p.fmSampleRate) - 1) / int64(p.fmSampleRate)
+	return fmHeaderSize + 4*alphabetSize + 8*(alphabetSize+2) + int64(fmSymbolBits(int(alphabetSize)))*(8+bitsBytes) + bitsBytes + 4*numSamples
+}
+
+// Size of a corpus that is about to be indexed.
+type corpusEstimate struct {
+	dataBytes    int64 // size of the tokenized corpus
+	numDocuments int64 // -1 if unknown
+	exact        bool  // whether the corpus is already tokenized
+	notes        []string
+}
+
+// Estimates the size of the tokenized corpus that cfg.Files will turn into.
+// The number of tokens of raw token and .npy inputs is known (up to the
+// sentinals, as the number of documents isn't) unless raw tokens are compressed;
+// for text, it is assumed that every token takes estimatedTextBytesPerToken bytes.
+// Compressed files are assumed to decompress to estimatedCompressionRatio times
+// their size.
+func estimateInputs(cfg *BuildConfig) (*corpusEstimate, error) {
+	sources, err := statSources(cfg.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	estimate := &corpusEstimate{numDocuments: -1}
+	numCompressed := 0
+	for _, source := range sources {
+		compressed := isCompressed(source.Path)
+		size := source.Size
+		if compressed {
+			size *= estimatedCompressionRatio
+		}
+
+		var numTokens int64
+		switch cfg.InputFormat {
+		case inputNpy:
+			// the header has the exact length, even if the file is compressed
+			header, err := readNpyHeader(source.Path)
+			if err != nil {
+				return nil, err
+			}
+			numTokens = header.length
+			compressed = false
+		case inputTokens:
+			numTokens = size / int64(cfg.InputTokenWidth)
+		default:
+			numTokens = size / estimatedTextBytesPerToken
+		}
+
+		if compressed {
+			numCompressed++
+		}
+		estimate.dataBytes += numTokens * int64(cfg.TokenWidth)
+	}
+
+	if cfg.InputFormat == inputText || cfg.InputFormat == inputJSONL {
+		estimate.notes = append(estimate.notes, fmt.Sprintf("assuming %d bytes of text per token", estimatedTextBytesPerToken))
+	}
+	if numCompressed > 0 {
+		estimate.notes = append(estimate.notes, fmt.Sprintf("assuming %d compressed file(s) decompress to %d times their size", numCompressed, estimatedCompressionRatio))
+	}
+	estimate.notes = append(estimate.notes, "not counting the sentinals, as the number of documents is unknown")
+	return estimate, nil
+}
+
+// Files of the index that building cfg's chunks would write, with their
+// estimated sizes.
+func estimateDiskUsage(cfg *BuildConfig, corpus *corpusEstimate, numChunks int64) []ComponentSize {
+	plan := cfg.memoryPlan()
+	numTokens := corpus.dataBytes / int64(cfg.TokenWidth)
+
+	usage := []ComponentSize{{Name: "tokenized corpus", Bytes: corpus.dataBytes}}
+	if corpus.numDocuments >= 0 {
+		usage = append(usage,
+			ComponentSize{Name: "document offsets", Bytes: corpus.numDocuments * docOffsetSize},
+			ComponentSize{Name: "document sources", Bytes: corpus.numDocuments * docSourceSize},
+		)
+	}
+
+	if cfg.Backend == backendFM {
+		fmBytes := int64(0)
+		if numChunks > 0 {
+			// every chunk but the last one is full
+			chunkTokens := cfg.chunkSize() / int64(cfg.TokenWidth)
+			fmBytes = (numChunks-1)*plan.fmIndexSize(chunkTokens) + plan.fmIndexSize(numTokens-(numChunks-1)*chunkTokens)
+		}
+		usage = append(usage, ComponentSize{Name: "FM-indices", Bytes: fmBytes})
+	} else {
+		usage = append(usage, ComponentSize{Name: "suffix arrays", Bytes: numChunks*saHeaderSize + numTokens*int64(saElemWidth(corpus.dataBytes))})
+	}
+
+	if cfg.BuildLCP {
+		usage = append(usage, ComponentSize{Name: "LCP arrays", Bytes: numChunks*lcpHeaderSize + numTokens})
+	}
+	return usage
+}
+
+// Prints how building the index described by cfg would go, without building
+// anything: the number of chunks, the peak memory of building them and the size
+// of the index on disk. The size of the corpus is exact if it has already been
+// tokenized and estimated from the input files otherwise. If appending is set,
+// the input files are appended to the existing index.
+func runDryRun(cfg *BuildConfig, appending bool) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	var corpus *corpusEstimate
+	if !appending && hasManifest(cfg.Outpath) {
+		manifest, err := loadManifest(cfg.Outpath)
+		if err != nil {
+			return err
+		}
+		if manifest.Complete {
+			fmt.Printf("The index in %s is already built\n", cfg.Outpath)
+			return nil
+		}
+		corpus = &corpusEstimate{dataBytes: manifest.DataBytes, numDocuments: manifest.NumDocuments, exact: true}
+	} else {
+		var err error
+		if corpus, err = estimateInputs(cfg); err != nil {
+			return err
+		}
+	}
+
+	plan := cfg.memoryPlan()
+	chunkSize := cfg.chunkSize()
+	if chunkSize <= 0 {
+		return fmt.Errorf("--max_mem of %d bytes is too small: building a chunk needs at least %d bytes", cfg.MaxMem, plan.peakMemory(int64(cfg.TokenWidth), 1))
+	}
+
+	// chunks end at document boundaries, so there may be a few more
+	numChunks := (corpus.dataBytes + chunkSize - 1) / chunkSize
+	// as many chunks are built at once as fit in the budget
+	largestChunk := min(chunkSize, corpus.dataBytes)
+	numFit := (cfg.MaxMem - buildOverheadBytes - chunkSize) / max(plan.chunkCost(largestChunk), 1)
+	numWorkers := max(min(int64(cfg.SAWorkers), numChunks, numFit), 1)
+	peak := buildOverheadBytes + chunkSize + numWorkers*plan.chunkCost(largestChunk)
+
+	kind := "estimated"
+	if corpus.exact {
+		kind = "exact, already tokenized"
+	}
+	fmt.Println("dry run: nothing is built")
+	fmt.Printf("tokenized corpus: %d bytes, %d tokens (%s)\n", corpus.dataBytes, corpus.dataBytes/int64(cfg.TokenWidth), kind)
+	for _, note := range corpus.notes {
+		fmt.Printf("  %s\n", note)
+	}
+	fmt.Printf("chunks: %d of up to %d bytes, %d built at once\n", numChunks, chunkSize, numWorkers)
+	fmt.Printf("peak memory: %d bytes (budget %d)\n", peak, cfg.MaxMem)
+	fmt.Printf("  read buffer: %d bytes\n", chunkSize)
+	fmt.Printf("  per chunk being built: %d bytes\n", plan.chunkCost(largestChunk))
+	fmt.Printf("  runtime and buffers: %d bytes\n", buildOverheadBytes)
+
+	usage := estimateDiskUsage(cfg, corpus, numChunks)
+	total := int64(0)
+	for _, component := range usage {
+		total += component.Bytes
+	}
+	fmt.Printf("disk usage: %d bytes\n", total)
+	for _, component := range usage {
+		fmt.Printf("  %s: %d bytes\n", component.Name, component.Bytes)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestChunksDoNotDependOnWorkers(t *testing.T) {
+	docs := randomDocuments(rand.New(rand.NewSource(1)), 400, 100, 50)
+
+	var chunks []ChunkInfo
+	for _, saWorkers := range []int{1, 3} {
+		cfg := testBuildConfig(t, docs)
+		cfg.MaxMem = buildOverheadBytes + 64*1024
+		cfg.SAWorkers = saWorkers
+
+		chunkSize := cfg.chunkSize()
+		if chunkSize <= 0 {
+			t.Fatalf("%d workers: no room for chunks", saWorkers)
+		}
+		if peak := cfg.memoryPlan().peakMemory(chunkSize, 1); peak > cfg.MaxMem {
+			t.Fatalf("%d workers: %d-byte chunks need %d bytes but the budget is %d", saWorkers, chunkSize, peak, cfg.MaxMem)
+		}
+
+		buildTestIndex(t, cfg)
+		manifest, err := loadManifest(cfg.Outpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Chunks) < 2 {
+			t.Fatalf("%d workers: %d chunks, the corpus should need several", saWorkers, len(manifest.Chunks))
+		}
+
+		// the files are named after the chunk numbers, so they match too
+		if chunks == nil {
+			chunks = manifest.Chunks
+		} else if !slices.Equal(manifest.Chunks, chunks) {
+			t.Errorf("%d workers: chunks %v, but with one worker %v", saWorkers, manifest.Chunks, chunks)
+		}
+	}
+}
+
+func TestChunkSizeForBudget(t *testing.T) {
+	budgets := []int64{buildOverheadBytes - 1, buildOverheadBytes + 100, buildOverheadBytes + 64*1024, 1 << 30, 1 << 36}
+	for _, tokenWidth := range []int{2, 4} {
+		for _, vocabSize := range []int{0, 50, 1 << 15} {
+			plans := []*memoryPlan{
+				newMemoryPlan(tokenWidth, vocabSize, 0, false, backendSA, 4),
+				newMemoryPlan(tokenWidth, vocabSize, 0, true, backendSA, 4),
+				newMemoryPlan(tokenWidth, vocabSize, 0, false, backendFM, 4),
+				newMemoryPlan(tokenWidth, vocabSize, 0, false, backendFM, 64),
+			}
+			for _, plan := range plans {
+				for _, budget := range budgets {
+					chunkSize := plan.chunkSizeForBudget(budget)
+					if chunkSize%int64(tokenWidth) != 0 {
+						t.Fatalf("plan %+v, budget %d: %d-byte chunks hold partial tokens", *plan, budget, chunkSize)
+					}
+					if chunkSize == 0 {
+						if plan.peakMemory(int64(tokenWidth), 1) <= budget {
+							t.Fatalf("plan %+v: a budget of %d bytes fits a token but no chunks", *plan, budget)
+						}
+						continue
+					}
+					if peak := plan.peakMemory(chunkSize, 1); peak > budget {
+						t.Fatalf("plan %+v: %d-byte chunks need %d bytes but the budget is %d", *plan, chunkSize, peak, budget)
+					}
+
+					// the chunks are as large as fit, unless token level suffix
+					// arrays can't index a larger one
+					larger := chunkSize + int64(tokenWidth)
+					if plan.peakMemory(larger, 1) <= budget && (plan.byteLevel || larger <= maxTokenChunkSize(tokenWidth)) {
+						t.Fatalf("plan %+v, budget %d: %d-byte chunks fit too, not just %d", *plan, budget, larger, chunkSize)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDryRunWritesNothing(t *testing.T) {
+	docs := randomDocuments(rand.New(rand.NewSource(1)), 100, 20, 50)
+
+	// a new index, which isn't even created
+	cfg := testBuildConfig(t, docs)
+	cfg.MaxMem = buildOverheadBytes + 64*1024
+	if err := runDryRun(&cfg, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cfg.Outpath); !os.IsNotExist(err) {
+		t.Fatalf("the index directory was created (%v)", err)
+	}
+
+	// and appending to an existing one, which is left as it is
+	buildTestIndex(t, cfg)
+	before := readIndexFiles(t, cfg.Outpath)
+	if err := runDryRun(&cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	if after := readIndexFiles(t, cfg.Outpath); !maps.EqualFunc(after, before, bytes.Equal) {
+		t.Fatal("the index changed")
+	}
+
+	cfg.MaxMem = buildOverheadBytes
+	if err := runDryRun(&cfg, true); err == nil {
+		t.Fatal("planned chunks without room for a single token")
+	}
+}
+
+// Returns the contents of every file in dir.
+func readIndexFiles(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = data
+	}
+	return files
+}
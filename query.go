@@ -0,0 +1,96 @@
+package main
+
+// Conditional probability of a token given a context, as estimated from the
+// number of times the context occurs and the number of times it is followed by
+// the token.
+type TokenProb struct {
+	Prob         float64 // Count / ContextCount; -1 if the context doesn't occur
+	Count        int64   // occurrences of the context followed by the token
+	ContextCount int64   // occurrences of the context
+	SuffixLen    int     // number of tokens at the end of the context that were used
+}
+
+// Returns the number of occurrences of the encoded query (outside of deleted
+// documents).
+func (m *ModelData) countEncoded(queryEnc []byte) int64 {
+	return int64(m.suffixArray.retrieveNum(m.bytesData, queryEnc))
+}
+
+// Returns the length (in tokens) of the longest suffix of queryEnc, an encoded
+// query, that occurs at least minMatches times, or -1 if not even the empty
+// suffix does. Every suffix of a suffix that occurs also occurs, so the length is
+// found by binary search.
+func (m *ModelData) longestSuffix(queryEnc []byte, minMatches int) int {
+	numTokens := len(queryEnc) / m.tokenWidth
+
+	left := 0
+	right := numTokens + 1
+	for left < right {
+		// the current candidate for the longest suffix length
+		mid := (left + right) / 2
+		suffixEnc := queryEnc[len(queryEnc)-mid*m.tokenWidth:]
+
+		if m.countEncoded(suffixEnc) >= int64(minMatches) {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	return left - 1
+}
+
+// Returns the exact number of occurrences of tokens in the corpus, not counting
+// those inside deleted documents. The empty sequence occurs once per token.
+func (m *ModelData) Count(tokens []uint32) (int64, error) {
+	queryEnc, err := intToByte(tokens, m.tokenWidth)
+	if err != nil {
+		return 0, err
+	}
+	return m.countEncoded(queryEnc), nil
+}
+
+// Returns the probability of the token following the context in the corpus,
+// conditioned on the whole context (that is, an n-gram probability with n =
+// len(context) + 1). If the context doesn't occur, Prob is -1.
+func (m *ModelData) Prob(context []uint32, token uint32) (*TokenProb, error) {
+	queryEnc, err := intToByte(append(context[:len(context):len(context)], token), m.tokenWidth)
+	if err != nil {
+		return nil, err
+	}
+	return m.probEncoded(queryEnc), nil
+}
+
+// Returns the ∞-gram probability of the token following the context: the
+// probability conditioned on the longest suffix of the context that occurs at
+// least minMatches times, whose length is SuffixLen. If not even the empty
+// suffix occurs minMatches times, SuffixLen is -1 and Prob is -1.
+func (m *ModelData) InfGramProb(context []uint32, token uint32, minMatches int) (*TokenProb, error) {
+	queryEnc, err := intToByte(append(context[:len(context):len(context)], token), m.tokenWidth)
+	if err != nil {
+		return nil, err
+	}
+
+	contextEnc := queryEnc[:len(queryEnc)-m.tokenWidth]
+	suffixLen := m.longestSuffix(contextEnc, minMatches)
+	if suffixLen < 0 {
+		return &TokenProb{Prob: -1, SuffixLen: -1}, nil
+	}
+
+	return m.probEncoded(queryEnc[len(contextEnc)-suffixLen*m.tokenWidth:]), nil
+}
+
+// Returns the probability of the last token of queryEnc, an encoded query,
+// following the tokens before it.
+func (m *ModelData) probEncoded(queryEnc []byte) *TokenProb {
+	contextEnc := queryEnc[:len(queryEnc)-m.tokenWidth]
+
+	result := &TokenProb{Prob: -1, SuffixLen: len(contextEnc) / m.tokenWidth}
+	result.ContextCount = m.countEncoded(contextEnc)
+	if result.ContextCount == 0 {
+		return result
+	}
+
+	result.Count = m.countEncoded(queryEnc)
+	result.Prob = float64(result.Count) / float64(result.ContextCount)
+	return result
+}
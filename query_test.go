@@ -0,0 +1,191 @@
+package main
+
+import (
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// Model over a single chunk of tokens, searched with its suffix array.
+func newTestModel(t *testing.T, tokens []uint32, tokenWidth int) *ModelData {
+	valueBytes := encodeTokens(t, tokens, tokenWidth)
+	chunk := ChunkInfo{Start: 0, End: int64(len(valueBytes))}
+	return &ModelData{
+		suffixArray: &MultiSuffixArray{
+			suffixArrays: []SuffixArrayData{buildTestMemSA(valueBytes, tokenWidth)},
+			chunks:       []ChunkInfo{chunk},
+			chunkEnd:     func(int64) int64 { return chunk.End },
+			tokenWidth:   tokenWidth,
+		},
+		bytesData:  &MemArray{data: valueBytes},
+		tokenWidth: tokenWidth,
+	}
+}
+
+// Conditional probability of token after context in tokens, by brute force.
+func naiveProb(tokens, context []uint32, token uint32) TokenProb {
+	want := TokenProb{Prob: -1, SuffixLen: len(context)}
+	want.ContextCount = int64(len(naiveOccurrences(tokens, context, 2)))
+	if want.ContextCount > 0 {
+		want.Count = int64(len(naiveOccurrences(tokens, append(slices.Clone(context), token), 2)))
+		want.Prob = float64(want.Count) / float64(want.ContextCount)
+	}
+	return want
+}
+
+func TestProbMatchesNaive(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	vocab := []uint32{1, 2, 3}
+	for trial := 0; trial < 10; trial++ {
+		tokens := randomTokens(rng, 1+rng.Intn(200), vocab, true)
+		m := newTestModel(t, tokens, 2)
+
+		// contexts that never occur are among the queries
+		for _, context := range testQueries(rng, tokens, vocab) {
+			if got, err := m.Count(context); err != nil || got != int64(len(naiveOccurrences(tokens, context, 2))) {
+				t.Fatalf("tokens %v: count of %v is %d (%v), want %d", tokens, context, got, err, len(naiveOccurrences(tokens, context, 2)))
+			}
+
+			for _, token := range []uint32{0, 1, 2, 3, 1 << 15} {
+				got, err := m.Prob(context, token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := naiveProb(tokens, context, token); *got != want {
+					t.Fatalf("tokens %v: p(%d | %v) is %+v, want %+v", tokens, token, context, *got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestInfGramProbMatchesNaive(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	vocab := []uint32{1, 2, 3}
+	for trial := 0; trial < 10; trial++ {
+		tokens := randomTokens(rng, 1+rng.Intn(200), vocab, true)
+		m := newTestModel(t, tokens, 2)
+
+		for _, context := range testQueries(rng, tokens, vocab) {
+			// the empty suffix occurs once per token, so the last limit leaves no suffix
+			for _, minMatches := range []int{1, 2, 5, len(tokens) + 1} {
+				// the longest suffix of the context that occurs minMatches times
+				suffixLen := -1
+				for length := len(context); length >= 0; length-- {
+					if len(naiveOccurrences(tokens, context[len(context)-length:], 2)) >= minMatches {
+						suffixLen = length
+						break
+					}
+				}
+
+				for _, token := range []uint32{0, 1, 2, 3} {
+					got, err := m.InfGramProb(context, token, minMatches)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					want := TokenProb{Prob: -1, SuffixLen: -1}
+					if suffixLen >= 0 {
+						want = naiveProb(tokens, context[len(context)-suffixLen:], token)
+					}
+					if *got != want {
+						t.Fatalf("tokens %v, %d matches: p(%d | %v) is %+v, want %+v", tokens, minMatches, token, context, *got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestNextTokenDistributionCounts(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	vocab := []uint32{1, 2, 3, 300}
+	for trial := 0; trial < 10; trial++ {
+		tokens := randomTokens(rng, 1+rng.Intn(300), vocab, true)
+		m := newTestModel(t, tokens, 2)
+		deleted := deleteRandomDocuments(rng, tokens, 2)
+		if len(deleted.ranges) > 0 {
+			m.deleted = deleted
+			m.suffixArray.(*MultiSuffixArray).deleted = deleted
+		}
+
+		for _, query := range testQueries(rng, tokens, vocab) {
+			prediction, err := m.NextTokenDistribution(query, 1, 1, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prediction.effectiveN < 0 {
+				continue
+			}
+
+			// the tokens after each occurrence of the suffix that was used
+			suffix := query[len(query)-prediction.effectiveN:]
+			want := make(map[uint32]int64)
+			for _, pos := range naiveOccurrences(tokens, suffix, 2) {
+				if next := int(pos/2) + len(suffix); next < len(tokens) && !deleted.isDeleted(pos) {
+					want[tokens[next]]++
+				}
+			}
+			if !maps.Equal(prediction.counts, want) {
+				t.Fatalf("tokens %v, deleted %v, query %v: counts %v, want %v", tokens, deleted.ranges, query, prediction.counts, want)
+			}
+
+			total := int64(0)
+			for _, count := range want {
+				total += count
+			}
+			if int64(prediction.numRetrieved) != total || int64(prediction.numTotal) != total {
+				t.Fatalf("tokens %v, deleted %v, query %v: %d retrieved of %d, want %d", tokens, deleted.ranges, query, prediction.numRetrieved, prediction.numTotal, total)
+			}
+		}
+	}
+}
+
+func TestNextTokenDistributionSampleOfDeleted(t *testing.T) {
+	// one live document continues with 1, and many deleted ones with 2
+	tokens := []uint32{5, 1, 0}
+	for i := 0; i < 50; i++ {
+		tokens = append(tokens, 5, 2, 0)
+	}
+	m := newTestModel(t, tokens, 2)
+	m.deleted = &tombstones{ranges: []docRange{{6, int64(len(tokens) * 2)}}}
+	m.suffixArray.(*MultiSuffixArray).deleted = m.deleted
+
+	numEmpty := 0
+	for seed := int64(0); seed < 20; seed++ {
+		prediction, err := m.NextTokenDistribution([]uint32{5}, 1, 1, 1, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prediction.effectiveN != 1 || prediction.numTotal != 1 {
+			t.Fatalf("seed %d: suffix of %d tokens with %d continuations, want 1 and 1", seed, prediction.effectiveN, prediction.numTotal)
+		}
+
+		if prediction.numRetrieved == 0 {
+			numEmpty++
+			if len(prediction.counts) != 0 || prediction.prob(1) != 0 {
+				t.Fatalf("seed %d: nothing retrieved, but counts are %v", seed, prediction.counts)
+			}
+		} else if prediction.prob(1) != 1 {
+			t.Fatalf("seed %d: p(1) = %f, want 1", seed, prediction.prob(1))
+		}
+	}
+	if numEmpty == 0 {
+		t.Fatal("no sample fell only inside deleted documents")
+	}
+}
+
+func TestGenerateGreedy(t *testing.T) {
+	m := newTestModel(t, []uint32{1, 2, 3, 1, 2, 4, 1, 2, 3, 0}, 2)
+
+	// 3 follows 1 2 twice and 4 once; 1 and 0 follow 1 2 3 once each, and the
+	// smaller id wins the tie
+	got, err := m.GenerateGreedy([]uint32{1, 2}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{1, 2, 3, 0}; !slices.Equal(got, want) {
+		t.Fatalf("generated %v, want %v", got, want)
+	}
+}
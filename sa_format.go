@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+)
+
+// On-disk format of a suffix array file. All values are little endian.
+//
+//	offset  size  field
+//	0       8     magic ("INFGRMSA")
+//	8       4     format version
+//	12      4     element width: bytes per entry (4 or 8)
+//	16      4     token width: bytes per token in the tokenized corpus
+//	20      4     reserved (zero)
+//	24      8     number of entries
+//	32      8     base offset: first byte of the chunk in the tokenized corpus
+//	40      8     span: number of bytes of the tokenized corpus covered by the chunk
+//	48      8     CRC-64 (ECMA) checksum of the entries
+//	56      8     reserved (zero)
+//	64      -     entries: absolute byte offsets into the tokenized corpus
+//
+// The file size must be exactly saHeaderSize + entries * element width.
+//
+// Opening a suffix array checks the header and the file size, so a file of the
+// wrong chunk, version or length fails when it is opened. The checksum is checked
+// whenever the whole file is read: when it is loaded into memory, when an index is
+// opened with --verify_checksums (the default), and by verify mode with
+// --verify_samples 0. Only with --verify_checksums=false does a file whose entries
+// were corrupted in place still open, serving wrong results until it is verified.
+const (
+	saMagic          = "INFGRMSA"
+	saVersion        = 1
+	saHeaderSize     = 64
+	saChecksumOffset = 48
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// Header at the start of every suffix array file.
+type saHeader struct {
+	version    uint32
+	elemWidth  int
+	tokenWidth int
+	numEntries int64
+	baseOffset int64
+	span       int64
+	checksum   uint64
+}
+
+func (h *saHeader) encode() []byte {
+	buf := make([]byte, saHeaderSize)
+	copy(buf, saMagic)
+	binary.LittleEndian.PutUint32(buf[8:], h.version)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(h.elemWidth))
+	binary.LittleEndian.PutUint32(buf[16:], uint32(h.tokenWidth))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(h.numEntries))
+	binary.LittleEndian.PutUint64(buf[32:], uint64(h.baseOffset))
+	binary.LittleEndian.PutUint64(buf[40:], uint64(h.span))
+	binary.LittleEndian.PutUint64(buf[saChecksumOffset:], h.checksum)
+	return buf
+}
+
+// Parses the header of a suffix array file of fileSize bytes. Returns an error
+// if the file is not a suffix array, uses an unknown version or is truncated.
+func decodeSAHeader(buf []byte, fileSize int64) (*saHeader, error) {
+	if len(buf) < saHeaderSize || string(buf[:8]) != saMagic {
+		return nil, errors.New("not a suffix array file")
+	}
+
+	h := &saHeader{
+		version:    binary.LittleEndian.Uint32(buf[8:]),
+		elemWidth:  int(binary.LittleEndian.Uint32(buf[12:])),
+		tokenWidth: int(binary.LittleEndian.Uint32(buf[16:])),
+		numEntries: int64(binary.LittleEndian.Uint64(buf[24:])),
+		baseOffset: int64(binary.LittleEndian.Uint64(buf[32:])),
+		span:       int64(binary.LittleEndian.Uint64(buf[40:])),
+		checksum:   binary.LittleEndian.Uint64(buf[saChecksumOffset:]),
+	}
+
+	if h.version != saVersion {
+		return nil, fmt.Errorf("unsupported suffix array version %d (expected %d)", h.version, saVersion)
+	}
+	if h.elemWidth != 4 && h.elemWidth != 8 {
+		return nil, fmt.Errorf("unsupported element width %d", h.elemWidth)
+	}
+	if err := validateTokenWidth(h.tokenWidth); err != nil {
+		return nil, err
+	}
+	if h.numEntries < 0 || h.baseOffset < 0 || h.span < 0 {
+		return nil, errors.New("corrupt suffix array header")
+	}
+
+	expectedSize := saHeaderSize + h.numEntries*int64(h.elemWidth)
+	if fileSize != expectedSize {
+		return nil, fmt.Errorf("file has %d bytes but header describes %d: file is truncated or corrupt", fileSize, expectedSize)
+	}
+
+	return h, nil
+}
+
+// Reads and parses the header from the start of r.
+func readSAHeader(r io.ReaderAt, fileSize int64) (*saHeader, error) {
+	buf := make([]byte, saHeaderSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("file is too small to be a suffix array")
+		}
+		return nil, err
+	}
+	return decodeSAHeader(buf, fileSize)
+}
+
+// Checks that the header describes the given chunk of a corpus made of
+// tokenWidth-byte tokens.
+func (h *saHeader) checkChunk(chunk ChunkInfo, tokenWidth int) error {
+	if h.tokenWidth != tokenWidth {
+		return fmt.Errorf("suffix array indexes %d-byte tokens but the corpus uses %d-byte tokens", h.tokenWidth, tokenWidth)
+	}
+	if h.baseOffset != chunk.Start || h.baseOffset+h.span != chunk.End {
+		return fmt.Errorf("suffix array covers bytes [%d, %d) but the chunk covers [%d, %d)", h.baseOffset, h.baseOffset+h.span, chunk.Start, chunk.End)
+	}
+	if h.numEntries != chunk.NumEntries {
+		return fmt.Errorf("suffix array has %d entries but the chunk has %d", h.numEntries, chunk.NumEntries)
+	}
+	return nil
+}
+
+// Smallest element width that can hold every offset below maxOffset.
+func saElemWidth(maxOffset int64) int {
+	if maxOffset <= math.MaxUint32 {
+		return 4
+	}
+	return 8
+}
+
+func putSAEntry(buf []byte, v int64, elemWidth int) {
+	if elemWidth == 4 {
+		binary.LittleEndian.PutUint32(buf, uint32(v))
+	} else {
+		binary.LittleEndian.PutUint64(buf, uint64(v))
+	}
+}
+
+func getSAEntry(buf []byte, elemWidth int) int64 {
+	if elemWidth == 4 {
+		return int64(binary.LittleEndian.Uint32(buf))
+	}
+	return int64(binary.LittleEndian.Uint64(buf))
+}
+
+// Streams suffix array entries to a file. The header is written once all
+// entries are known, when the writer is closed. The entries are written to a
+// temporary file that is only renamed to the final name once it is complete, so
+// a file under the final name is never truncated.
+type saFileWriter struct {
+	filename  string
+	f         *os.File
+	bufWriter *bufio.Writer
+	crc       hash.Hash64
+	header    saHeader
+	entryBuf  []byte
+}
+
+// Create a suffix array file for the chunk starting at byte baseOffset of the
+// tokenized corpus and covering span bytes.
+func createSAFile(filename string, tokenWidth int, baseOffset, span int64) (*saFileWriter, error) {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	w := &saFileWriter{
+		filename:  filename,
+		f:         f,
+		bufWriter: bufio.NewWriter(f),
+		crc:       crc64.New(crcTable),
+		header: saHeader{
+			version:    saVersion,
+			elemWidth:  saElemWidth(baseOffset + span),
+			tokenWidth: tokenWidth,
+			baseOffset: baseOffset,
+			span:       span,
+		},
+	}
+	w.entryBuf = make([]byte, w.header.elemWidth)
+
+	// placeholder for the header
+	if _, err := w.bufWriter.Write(make([]byte, saHeaderSize)); err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Appends the absolute byte offset v.
+func (w *saFileWriter) write(v int64) error {
+	putSAEntry(w.entryBuf, v, w.header.elemWidth)
+	w.crc.Write(w.entryBuf)
+	if _, err := w.bufWriter.Write(w.entryBuf); err != nil {
+		return err
+	}
+	w.header.numEntries++
+	return nil
+}
+
+// Flushes the entries, writes the header, syncs the file to disk and renames
+// it to its final name.
+func (w *saFileWriter) close() error {
+	if err := w.bufWriter.Flush(); err != nil {
+		w.abort()
+		return err
+	}
+
+	w.header.checksum = w.crc.Sum64()
+	if _, err := w.f.WriteAt(w.header.encode(), 0); err != nil {
+		w.abort()
+		return err
+	}
+
+	if err := w.f.Sync(); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+
+	return os.Rename(w.f.Name(), w.filename)
+}
+
+// Closes and removes the unfinished file.
+func (w *saFileWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// Reads an entire suffix array file into memory and verifies its checksum.
+func readSAFile(filename string) (*saHeader, []int64, error) {
+	dataBytes, err := readBytesFromFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header, err := decodeSAHeader(dataBytes, int64(len(dataBytes)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	entryBytes := dataBytes[saHeaderSize:]
+	if crc64.Checksum(entryBytes, crcTable) != header.checksum {
+		return nil, nil, fmt.Errorf("%s: checksum mismatch", filename)
+	}
+
+	entries := make([]int64, header.numEntries)
+	for i := range entries {
+		entries[i] = getSAEntry(entryBytes[i*header.elemWidth:], header.elemWidth)
+	}
+
+	return header, entries, nil
+}
+
+// Streams the entries of a suffix array file in order, without loading the
+// whole file into memory.
+type saFileReader struct {
+	f         *os.File
+	bufReader *bufio.Reader
+	header    *saHeader
+	remaining int64
+	entryBuf  []byte
+}
+
+func openSAFileReader(filename string) (*saFileReader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	header, err := readSAHeader(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	entries := io.NewSectionReader(f, saHeaderSize, header.numEntries*int64(header.elemWidth))
+
+	return &saFileReader{
+		f:         f,
+		bufReader: bufio.NewReaderSize(entries, 64*1024),
+		header:    header,
+		remaining: header.numEntries,
+		entryBuf:  make([]byte, header.elemWidth),
+	}, nil
+}
+
+// Returns the next entry, or io.EOF once every entry has been read.
+func (r *saFileReader) next() (int64, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if _, err := io.ReadFull(r.bufReader, r.entryBuf); err != nil {
+		return 0, err
+	}
+	r.remaining--
+
+	return getSAEntry(r.entryBuf, r.header.elemWidth), nil
+}
+
+func (r *saFileReader) close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Writes a suffix array of entries for a chunk of 2-byte tokens to filename and
+// returns the file's bytes.
+func writeTestSAFile(t *testing.T, filename string, entries []int64) []byte {
+	t.Helper()
+	w, err := createSAFile(filename, 2, 0, 2*int64(len(entries)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range entries {
+		if err := w.write(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSuffixArrayHeaderRejection(t *testing.T) {
+	dir := t.TempDir()
+	entries := []int64{6, 4, 0, 2}
+	original := writeTestSAFile(t, filepath.Join(dir, "original.bin"), entries)
+
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		header  string // error of decodeSAHeader and of opening, empty if the header is fine
+	}{
+		{"bad magic", func(data []byte) []byte {
+			data[0] = 'X'
+			return data
+		}, "not a suffix array"},
+		{"wrong version", func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[8:], saVersion+1)
+			return data
+		}, "unsupported suffix array version"},
+		{"wrong element width", func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[12:], 3)
+			return data
+		}, "unsupported element width 3"},
+		{"wrong token width", func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[16:], 3)
+			return data
+		}, "token width"},
+		{"truncated entries", func(data []byte) []byte {
+			return data[:len(data)-1]
+		}, "truncated"},
+		{"extra entries", func(data []byte) []byte {
+			return append(data, 8, 0, 0, 0)
+		}, "truncated"},
+		{"negative entries", func(data []byte) []byte {
+			binary.LittleEndian.PutUint64(data[24:], 1<<63)
+			return data
+		}, "corrupt suffix array header"},
+		{"checksum mismatch", func(data []byte) []byte {
+			data[saChecksumOffset] ^= 0xff
+			return data
+		}, ""},
+		{"entries changed", func(data []byte) []byte {
+			data[saHeaderSize] ^= 0xff
+			return data
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		data := tt.corrupt(slices.Clone(original))
+		filename := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "_")+".bin")
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := decodeSAHeader(data, int64(len(data)))
+		if tt.header == "" && err != nil {
+			t.Fatalf("%s: header rejected: %v", tt.name, err)
+		} else if tt.header != "" && (err == nil || !strings.Contains(err.Error(), tt.header)) {
+			t.Fatalf("%s: header error %v, want %q", tt.name, err, tt.header)
+		}
+
+		// loading into memory reads the entries, so it checks the checksum too
+		if msa, err := makeMemSA(filename); err == nil {
+			msa.close()
+			t.Fatalf("%s: loaded into memory", tt.name)
+		} else if tt.header == "" && !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Fatalf("%s: loading error %v, want a checksum mismatch", tt.name, err)
+		}
+
+		// mapping it only checks the header, and leaves the checksum to verifyChecksum
+		msa, err := makeMMappedSA(filename)
+		if tt.header != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.header) || !strings.Contains(err.Error(), filename) {
+				t.Fatalf("%s: mapping error %v, want %q in %s", tt.name, err, tt.header, filename)
+			}
+			if msa != nil {
+				t.Fatalf("%s: mapped", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := msa.verifyChecksum(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Fatalf("%s: checksum error %v", tt.name, err)
+		}
+		msa.close()
+	}
+
+	// a file shorter than a header can't even be read as one
+	filename := filepath.Join(dir, "truncated_header.bin")
+	if err := os.WriteFile(filename, original[:saHeaderSize-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeSAHeader(original[:saHeaderSize-1], saHeaderSize-1); err == nil {
+		t.Fatal("decoded a truncated header")
+	}
+	if _, err := makeMemSA(filename); err == nil {
+		t.Fatal("loaded a truncated header into memory")
+	}
+	if _, err := makeMMappedSA(filename); err == nil || !strings.Contains(err.Error(), "too small") {
+		t.Fatalf("mapping a truncated header: %v", err)
+	}
+
+	// the original file passes every check
+	msa, err := makeMMappedSA(filepath.Join(dir, "original.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msa.close()
+	if err := msa.verifyChecksum(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range entries {
+		if got := msa.get(int64(i)); got != want {
+			t.Fatalf("entry %d is %d, want %d", i, got, want)
+		}
+	}
+	memSA, err := makeMemSA(filepath.Join(dir, "original.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memSA.close()
+	if memSA.length() != int64(len(entries)) {
+		t.Fatalf("%d entries in memory, want %d", memSA.length(), len(entries))
+	}
+}
+
+func TestOpenIndexChecksCorruptedSuffixArray(t *testing.T) {
+	cfg := testBuildConfig(t, [][]uint32{{1, 2, 3}, {2, 3, 4}, {3, 4, 5}})
+	buildTestIndex(t, cfg)
+
+	manifest, err := loadManifest(cfg.Outpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saPath := filepath.Join(cfg.Outpath, manifest.Chunks[0].Path)
+	data, err := os.ReadFile(saPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// swap the first two entries, which keeps the header valid
+	elemWidth := int(binary.LittleEndian.Uint32(data[12:]))
+	first := slices.Clone(data[saHeaderSize : saHeaderSize+elemWidth])
+	copy(data[saHeaderSize:], data[saHeaderSize+elemWidth:saHeaderSize+2*elemWidth])
+	copy(data[saHeaderSize+elemWidth:], first)
+	if err := os.WriteFile(saPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := InitializeModel(cfg); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("opened an index with a corrupted suffix array (%v)", err)
+	}
+
+	// without the check it opens, as only the header is read
+	cfg.VerifyChecksums = false
+	buildTestIndex(t, cfg)
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"encoding/binary"
 	"fmt"
+	"hash/crc64"
+	"io"
 
 	"golang.org/x/exp/mmap"
 )
@@ -11,72 +12,152 @@ import (
 type SuffixArrayData interface {
 	get(index int64) int64
 	length() int64
+	hasLCP() bool
+	lcp(index int64) int64 // LCP (in tokens) of entries index-1 and index; only valid if hasLCP()
+	close() error
 }
 
 // Loads the entire suffix array into memory.
 type MemSA struct {
-	data []int64
+	header   *saHeader
+	data     []int64
+	lcpArray *MMappedLCP // nil if the suffix array has no LCP array
 }
 
 func (msa *MemSA) get(idx int64) int64 {
 	return msa.data[idx]
 }
 
+func (msa *MemSA) hasLCP() bool {
+	return msa.lcpArray != nil
+}
+
+func (msa *MemSA) lcp(idx int64) int64 {
+	return msa.lcpArray.get(idx)
+}
+
 func (msa *MemSA) length() int64 {
 	return int64(len(msa.data))
 }
 
+// Loads the suffix array in filepath into memory. The checksum is verified
+// as the whole file is read anyway.
 func makeMemSA(filepath string) (*MemSA, error) {
 	fmt.Println("loading suffix array from", filepath)
 
-	data, err := readInt64FromFile(filepath)
+	header, data, err := readSAFile(filepath)
 	if err != nil {
 		return nil, err
 	}
 
-	return &MemSA{data: data}, nil
+	return &MemSA{header: header, data: data}, nil
+}
+
+// Opens the LCP array in filepath as the suffix array's LCP array. The LCP array
+// stays memory-mapped.
+func (msa *MemSA) openLCP(filepath string) error {
+	lcpArray, err := openMatchingLCP(filepath, msa.length())
+	if err != nil {
+		return err
+	}
+
+	msa.lcpArray = lcpArray
+	return nil
+}
+
+func (msa *MemSA) close() error {
+	if msa.lcpArray != nil {
+		return msa.lcpArray.close()
+	}
+	return nil
 }
 
 // Access the suffix array from a memory-mapped file.
 type MMappedSA struct {
-	mReader *mmap.ReaderAt
+	mReader  *mmap.ReaderAt
+	header   *saHeader
+	lcpArray *MMappedLCP // nil if the suffix array has no LCP array
 }
 
 func (msa *MMappedSA) get(idx int64) int64 {
-	dest := make([]byte, 8)
+	if idx < 0 || idx >= msa.header.numEntries {
+		// matches the behavior of the regular array, and
+		// this panic lets us print the out of bounds index
+		panic(fmt.Sprintf("%d is out of bounds", idx))
+	}
 
-	_, err := msa.mReader.ReadAt(dest, idx*8)
+	elemWidth := msa.header.elemWidth
+	dest := make([]byte, elemWidth)
 
+	_, err := msa.mReader.ReadAt(dest, saHeaderSize+idx*int64(elemWidth))
 	if err != nil {
-		// the regular array also throws an error if EOF, so that
-		// behavior is matched here
-		if err.Error() == "EOF" {
-			// this panic lets us print the out of bounds index
-			panic(fmt.Sprintf("%d is out of bounds", idx))
-		} else {
-			// will also panic if start is out of bounds
-			// and will print the index
-			panic(err)
-		}
+		panic(err)
 	}
 
-	return int64(binary.LittleEndian.Uint64(dest))
+	return getSAEntry(dest, elemWidth)
 }
 
 func (msa *MMappedSA) length() int64 {
-	lengthBytes := int64(msa.mReader.Len())
+	return msa.header.numEntries
+}
+
+func (msa *MMappedSA) hasLCP() bool {
+	return msa.lcpArray != nil
+}
 
-	if lengthBytes%8 != 0 {
-		panic("suffix array is not a multiple of 8 bytes")
+func (msa *MMappedSA) lcp(idx int64) int64 {
+	return msa.lcpArray.get(idx)
+}
+
+// Opens the LCP array in filepath alongside the suffix array. It must have as
+// many entries as the suffix array.
+func (msa *MMappedSA) openLCP(filepath string) error {
+	lcpArray, err := openMatchingLCP(filepath, msa.header.numEntries)
+	if err != nil {
+		return err
+	}
+
+	msa.lcpArray = lcpArray
+	return nil
+}
+
+// Computes the checksum of the entries and compares it against the header.
+// This reads the entire file, so makeMMappedSA leaves it to the caller.
+func (msa *MMappedSA) verifyChecksum() error {
+	entries := io.NewSectionReader(msa.mReader, saHeaderSize, msa.header.numEntries*int64(msa.header.elemWidth))
+
+	crc := crc64.New(crcTable)
+	if _, err := io.Copy(crc, entries); err != nil {
+		return err
 	}
 
-	return lengthBytes / 8
+	if crc.Sum64() != msa.header.checksum {
+		return fmt.Errorf("checksum mismatch: expected %x, got %x", msa.header.checksum, crc.Sum64())
+	}
+	return nil
+}
+
+func (msa *MMappedSA) close() error {
+	if msa.lcpArray != nil {
+		msa.lcpArray.close()
+	}
+	return msa.mReader.Close()
 }
 
+// Opens a memory-mapped suffix array. Returns an error if the file is not a
+// suffix array, is truncated or uses an unsupported version. Only the header and
+// the file size are checked; the checksum is checked separately by verifyChecksum.
 func makeMMappedSA(filepath string) (*MMappedSA, error) {
 	mReader, err := mmap.Open(filepath)
 	if err != nil {
 		return nil, err
 	}
-	return &MMappedSA{mReader: mReader}, nil
+
+	header, err := readSAHeader(mReader, int64(mReader.Len()))
+	if err != nil {
+		mReader.Close()
+		return nil, fmt.Errorf("%s: %w", filepath, err)
+	}
+
+	return &MMappedSA{mReader: mReader, header: header}, nil
 }
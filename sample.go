@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+)
+
+// Entries of a suffix array (or rows of an FM-index) that match a query in one
+// chunk.
+type matchRange struct {
+	at         func(int64) int64 // byte position of an entry in vec
+	start, end int64             // the entries [start, end)
+	vec        TokenArray        // tokenized corpus the positions are in
+	deleted    *tombstones       // nil if no documents are deleted
+}
+
+func (r *matchRange) size() int64 {
+	return r.end - r.start
+}
+
+// Limits the occurrences of a query that are retrieved to a uniform random sample
+// of at most maxSupport of them, like the max_support parameter of the official
+// infini-gram engine. The sample is drawn from the matches of every chunk
+// together, so each chunk contributes in proportion to the size of its range.
+// Sampled occurrences inside deleted documents are dropped, so the sample is
+// uniform over the other occurrences but may be smaller than maxSupport.
+type supportSample struct {
+	maxSupport int
+	rng        *rand.Rand
+}
+
+// Creates a sample of at most maxSupport occurrences drawn using seed. Returns
+// nil, which retrieves every occurrence, if maxSupport isn't positive.
+func newSupportSample(maxSupport int, seed int64) *supportSample {
+	if maxSupport <= 0 {
+		return nil
+	}
+	return &supportSample{maxSupport: maxSupport, rng: rand.New(rand.NewSource(seed))}
+}
+
+// Returns whether s retrieves fewer than numEntries entries.
+func (s *supportSample) limits(numEntries int64) bool {
+	return s != nil && numEntries > int64(s.maxSupport)
+}
+
+// Returns maxSupport distinct indices out of numEntries, which must be more,
+// chosen uniformly at random (with Floyd's algorithm) and in increasing order.
+func (s *supportSample) choose(numEntries int64) []int64 {
+	chosen := make(map[int64]bool, s.maxSupport)
+	indices := make([]int64, 0, s.maxSupport)
+	for j := numEntries - int64(s.maxSupport); j < numEntries; j++ {
+		idx := s.rng.Int63n(j + 1)
+		if chosen[idx] {
+			idx = j
+		}
+		chosen[idx] = true
+		indices = append(indices, idx)
+	}
+	slices.Sort(indices)
+	return indices
+}
+
+// Retrieves the occurrences of ranges chosen by s (every occurrence if s is nil
+// or there are at most maxSupport), each as the length bytes starting at its
+// position. Occurrences inside deleted documents are skipped.
+func (s *supportSample) substrings(ranges []matchRange, length int64) [][]byte {
+	results := make([][]byte, 0)
+	retrieve := func(r *matchRange, idx int64) {
+		pos := r.at(idx)
+		if r.deleted == nil || !r.deleted.isDeleted(pos) {
+			results = append(results, r.vec.getSlice(pos, pos+length))
+		}
+	}
+
+	numEntries := int64(0)
+	for _, r := range ranges {
+		numEntries += r.size()
+	}
+
+	if !s.limits(numEntries) {
+		for i := range ranges {
+			for idx := ranges[i].start; idx < ranges[i].end; idx++ {
+				retrieve(&ranges[i], idx)
+			}
+		}
+		return results
+	}
+
+	rangeIdx, rangeStart := 0, int64(0)
+	for _, idx := range s.choose(numEntries) {
+		// the ranges are concatenated, so find the one containing idx
+		for idx >= rangeStart+ranges[rangeIdx].size() {
+			rangeStart += ranges[rangeIdx].size()
+			rangeIdx++
+		}
+		retrieve(&ranges[rangeIdx], ranges[rangeIdx].start+idx-rangeStart)
+	}
+	return results
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// Ranges of sizes over a corpus of consecutive 2-byte tokens 0, 1, 2, ..., whose
+// entries are the positions in order.
+func testRanges(t *testing.T, sizes []int64) []matchRange {
+	numTokens := int64(0)
+	for _, size := range sizes {
+		numTokens += size
+	}
+	tokens := make([]uint32, numTokens)
+	for i := range tokens {
+		tokens[i] = uint32(i)
+	}
+	vec := &MemArray{data: encodeTokens(t, tokens, 2)}
+
+	ranges := make([]matchRange, 0, len(sizes))
+	start := int64(0)
+	for _, size := range sizes {
+		ranges = append(ranges, matchRange{at: func(idx int64) int64 { return idx * 2 }, start: start, end: start + size, vec: vec})
+		start += size
+	}
+	return ranges
+}
+
+// Token ids of the substrings retrieved by s.
+func sampledTokens(s *supportSample, ranges []matchRange) []uint32 {
+	tokens := make([]uint32, 0)
+	for _, substring := range s.substrings(ranges, 2) {
+		tokens = append(tokens, getToken(substring, 0, 2))
+	}
+	return tokens
+}
+
+func TestSupportSampleRetrievesEverythingUnlessLimited(t *testing.T) {
+	ranges := testRanges(t, []int64{3, 0, 5})
+	want := []uint32{0, 1, 2, 3, 4, 5, 6, 7}
+	for _, s := range []*supportSample{nil, newSupportSample(0, 1), newSupportSample(8, 1), newSupportSample(100, 1)} {
+		if got := sampledTokens(s, ranges); !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSupportSampleIsSeeded(t *testing.T) {
+	ranges := testRanges(t, []int64{40, 7, 100})
+	a := sampledTokens(newSupportSample(10, 7), ranges)
+	b := sampledTokens(newSupportSample(10, 7), ranges)
+	c := sampledTokens(newSupportSample(10, 8), ranges)
+	if len(a) != 10 || !slices.IsSorted(a) || len(slices.Compact(slices.Clone(a))) != 10 {
+		t.Fatalf("sample %v isn't 10 distinct occurrences", a)
+	}
+	if !slices.Equal(a, b) {
+		t.Errorf("samples with the same seed differ: %v and %v", a, b)
+	}
+	if slices.Equal(a, c) {
+		t.Errorf("samples with different seeds are both %v", a)
+	}
+}
+
+func TestSupportSampleIsUniform(t *testing.T) {
+	// the ranges of small chunks are as likely to be sampled as those of large ones
+	ranges := testRanges(t, []int64{5, 50, 200})
+	numEntries := int64(255)
+	numTrials, maxSupport := 5000, 20
+
+	hits := make([]int, numEntries)
+	for seed := 0; seed < numTrials; seed++ {
+		for _, token := range sampledTokens(newSupportSample(maxSupport, int64(seed)), ranges) {
+			hits[token]++
+		}
+	}
+
+	expected := float64(numTrials*maxSupport) / float64(numEntries)
+	for token, count := range hits {
+		if math.Abs(float64(count)-expected) > 6*math.Sqrt(expected) {
+			t.Errorf("occurrence %d was sampled %d times, expected about %.0f", token, count, expected)
+		}
+	}
+}
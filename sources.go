@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/mmap"
+)
+
+// The document sources file records where every document was read from: for
+// each document id, the index of its input file in the manifest's sources
+// (little endian uint32) followed by its record number within that file (little
+// endian int64, starting at 0). For inputs with one document per line, the
+// record number is the line number.
+const (
+	docSourcesFilename = "doc_sources.bin"
+	docSourceSize      = 12
+)
+
+// An input file of the index.
+type SourceInfo struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`     // bytes on disk, before decompression
+	ModTime int64  `json:"mod_time"` // unix nanoseconds
+}
+
+// Returns the input files given as a comma separated list of paths and globs,
+// followed by the paths in listFile (one per line), in order. Globs expand to
+// their matches in lexical order and must match at least one file.
+func resolveInputs(inputList, listFile string) ([]string, error) {
+	patterns := strings.Split(inputList, ",")
+	if listFile != "" {
+		listed, err := readStringFromFile(listFile)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, strings.Split(listed, "\n")...)
+	}
+
+	files := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		if !strings.ContainsAny(pattern, "*?[") {
+			files = append(files, pattern)
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("input pattern %q does not match any files", pattern)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// Describes the input files.
+func statSources(files []string) ([]SourceInfo, error) {
+	sources := make([]SourceInfo, len(files))
+	for i, filename := range files {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		sources[i] = SourceInfo{Path: filename, Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	}
+	return sources, nil
+}
+
+func encodeDocSource(source int, record int64) []byte {
+	buf := make([]byte, docSourceSize)
+	binary.LittleEndian.PutUint32(buf, uint32(source))
+	binary.LittleEndian.PutUint64(buf[4:], uint64(record))
+	return buf
+}
+
+// Access the document sources from a memory-mapped file.
+type sourceIndex struct {
+	mReader *mmap.ReaderAt
+	numDocs int64
+}
+
+// Opens the document sources of the index described by manifest.
+func openSourceIndex(outpath string, manifest *IndexManifest) (*sourceIndex, error) {
+	sourcesPath := path.Join(outpath, manifest.DocSourcesPath)
+	mReader, err := mmap.Open(sourcesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(mReader.Len()) < manifest.NumDocuments*docSourceSize {
+		mReader.Close()
+		return nil, fmt.Errorf("%s has %d bytes but %d documents are expected", sourcesPath, mReader.Len(), manifest.NumDocuments)
+	}
+
+	return &sourceIndex{mReader: mReader, numDocs: manifest.NumDocuments}, nil
+}
+
+// Returns the input file index and record number of document id.
+func (s *sourceIndex) get(id int64) (int, int64) {
+	if id < 0 || id >= s.numDocs {
+		panic(fmt.Sprintf("document %d is out of bounds", id))
+	}
+
+	buf := make([]byte, docSourceSize)
+	if _, err := s.mReader.ReadAt(buf, id*docSourceSize); err != nil {
+		panic(err)
+	}
+	return int(binary.LittleEndian.Uint32(buf)), int64(binary.LittleEndian.Uint64(buf[4:]))
+}
+
+func (s *sourceIndex) close() error {
+	return s.mReader.Close()
+}
+
+// Where a document was read from.
+type DocumentSource struct {
+	Path   string // input file
+	Record int64  // record number within the input file, starting at 0 (the line number for one document per line)
+}
+
+// Returns the input file and record number that document docID was read from.
+func (m *ModelData) DocumentSource(docID int64) (DocumentSource, error) {
+	if m.members != nil {
+		member, id, err := m.memberOfDoc(docID)
+		if err != nil {
+			return DocumentSource{}, err
+		}
+		return member.model.DocumentSource(id)
+	}
+
+	if docID < 0 || docID >= m.docs.numDocs {
+		return DocumentSource{}, fmt.Errorf("document %d does not exist: the index has %d documents", docID, m.docs.numDocs)
+	}
+
+	source, record := m.sources.get(docID)
+	if source >= len(m.sourceFiles) {
+		return DocumentSource{}, fmt.Errorf("document %d comes from input %d but the index has %d inputs", docID, source, len(m.sourceFiles))
+	}
+	return DocumentSource{Path: m.sourceFiles[source].Path, Record: record}, nil
+}
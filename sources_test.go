@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Writes contents to filename, compressed if it ends in .gz or .zst.
+func writeInputFile(t *testing.T, filename string, contents []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	switch {
+	case strings.HasSuffix(filename, ".gz"):
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case strings.HasSuffix(filename, ".zst"):
+		zw, err := zstd.NewWriter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(zw.EncodeAll(contents, nil))
+		zw.Close()
+	default:
+		buf.Write(contents)
+	}
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenInput(t *testing.T) {
+	dir := t.TempDir()
+	contents := []byte(strings.Repeat("the cat sat on the mat\n", 1000))
+	for _, name := range []string{"plain.txt", "shard.txt.gz", "shard.txt.zst"} {
+		filename := filepath.Join(dir, name)
+		writeInputFile(t, filename, contents)
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, start := range []int64{0, 1, 23, int64(len(contents)) - 1, int64(len(contents))} {
+			numRead := int64(0)
+			input, err := openInput(filename, start, func(n int) { numRead += int64(n) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(input)
+			input.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, contents[start:]) {
+				t.Fatalf("%s from byte %d: read %d bytes, want the last %d", name, start, len(got), len(contents)-int(start))
+			}
+			// bytes skipped to get to start count as read too
+			if numRead != info.Size() {
+				t.Fatalf("%s from byte %d: %d bytes read from disk, the file has %d", name, start, numRead, info.Size())
+			}
+		}
+
+		if isCompressed(name) {
+			if _, err := openInput(filename, int64(len(contents))+1, nil); err == nil {
+				t.Fatalf("%s: skipped past the end of the contents", name)
+			}
+		}
+	}
+}
+
+func TestResolveInputs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "shard_1.txt.gz", "shard_0.txt", "shard_2.txt.zst", "other.txt"} {
+		writeInputFile(t, filepath.Join(dir, name), []byte("the cat\n"))
+	}
+	listFile := filepath.Join(dir, "files.txt")
+	list := filepath.Join(dir, "other.txt") + "\n\n  " + filepath.Join(dir, "shard_?.txt") + "  \n"
+	if err := os.WriteFile(listFile, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := resolveInputs(filepath.Join(dir, "a.txt")+", "+filepath.Join(dir, "shard_*"), listFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.txt", "shard_0.txt", "shard_1.txt.gz", "shard_2.txt.zst", "other.txt", "shard_0.txt"}
+	for i := range want {
+		want[i] = filepath.Join(dir, want[i])
+	}
+	if !slices.Equal(files, want) {
+		t.Fatalf("inputs %v, want %v", files, want)
+	}
+
+	if _, err := resolveInputs(filepath.Join(dir, "missing_*"), ""); err == nil {
+		t.Fatal("a pattern without matches resolved")
+	}
+}
+
+// Shards of text documents, one per line, as plain, gzip and zstd files. Blank
+// lines aren't documents but still count as records.
+var testShards = map[string]string{
+	"shard_0.txt":     "the cat sat\non the mat\n",
+	"shard_1.txt.gz":  "the dog ran\n   \na dog on a log\nthe unknown cat\n",
+	"shard_2.txt.zst": "a cat\n\nthe mat sat on the dog\nran\n",
+}
+
+// Writes testShards to dir and returns them in the order of their names, along
+// with the tokens of the corpus tokenized from them and the source of each document.
+func writeTestShards(t *testing.T, dir string) ([]string, []uint32, []DocumentSource) {
+	t.Helper()
+	names := make([]string, 0, len(testShards))
+	for name := range testShards {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	files := make([]string, 0)
+	tokens := make([]uint32, 0)
+	sources := make([]DocumentSource, 0)
+	for _, name := range names {
+		filename := filepath.Join(dir, name)
+		writeInputFile(t, filename, []byte(testShards[name]))
+		files = append(files, filename)
+
+		for record, line := range strings.Split(strings.TrimSuffix(testShards[name], "\n"), "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			tokens = append(append(tokens, testTokenize(line)...), 0)
+			sources = append(sources, DocumentSource{Path: filename, Record: int64(record)})
+		}
+	}
+	return files, tokens, sources
+}
+
+func TestBuildCompressedShards(t *testing.T) {
+	dir := t.TempDir()
+	_, tokens, sources := writeTestShards(t, dir)
+
+	files, err := resolveInputs(filepath.Join(dir, "shard_*"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testTextBuildConfig(t, files)
+	m := buildTestIndex(t, cfg)
+
+	data, err := os.ReadFile(filepath.Join(cfg.Outpath, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := encodeTokens(t, tokens, 2); !bytes.Equal(data, want) {
+		t.Fatalf("data.bin is %v, want %v", data, want)
+	}
+
+	for id, want := range sources {
+		if got, err := m.DocumentSource(int64(id)); err != nil || got != want {
+			t.Fatalf("document %d comes from %+v (%v), want %+v", id, got, err, want)
+		}
+	}
+	if _, err := m.DocumentSource(int64(len(sources))); err == nil {
+		t.Fatalf("document %d of %d has a source", len(sources), len(sources))
+	}
+
+	manifest, err := loadManifest(cfg.Outpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, source := range manifest.Sources {
+		info, err := os.Stat(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source.Path != files[i] || source.Size != info.Size() {
+			t.Fatalf("input %d is %+v, want %s with %d bytes", i, source, files[i], info.Size())
+		}
+	}
+}
+
+func TestResumeInsideCompressedShard(t *testing.T) {
+	dir := t.TempDir()
+	files, _, _ := writeTestShards(t, dir)
+	filenames := []string{"data.bin", docOffsetsFilename, docSourcesFilename}
+	input := &inputFormat{format: inputText, lineSplit: "\n"}
+
+	// the files of an uninterrupted run
+	complete := testTextBuildConfig(t, files)
+	if _, err := tokenizeMultiprocess(files, 0, input, complete.Outpath, complete.TokenizerConfig, 0, 1, 2, 1, false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string][]byte)
+	for _, filename := range filenames {
+		data, err := os.ReadFile(filepath.Join(complete.Outpath, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[filename] = data
+	}
+
+	for fileIdx := 1; fileIdx < len(files); fileIdx++ {
+		// interrupted after the first two records of the compressed shard, whose
+		// tokens are then replaced by [UNK] so they are only kept if they aren't
+		// tokenized again
+		lines := strings.SplitAfter(testShards[filepath.Base(files[fileIdx])], "\n")
+		checkpoint := &tokenizeCheckpoint{InputFile: fileIdx, InputOffset: int64(len(lines[0]) + len(lines[1])), InputLines: 2}
+		for _, filename := range files[:fileIdx] {
+			for _, line := range strings.Split(strings.TrimSuffix(testShards[filepath.Base(filename)], "\n"), "\n") {
+				if strings.TrimSpace(line) != "" {
+					checkpoint.NumDocuments++
+					checkpoint.DataBytes += int64(len(testTokenize(line))+1) * 2
+				}
+			}
+		}
+		for _, line := range lines[:2] {
+			if strings.TrimSpace(line) != "" {
+				checkpoint.NumDocuments++
+				checkpoint.DataBytes += int64(len(testTokenize(line))+1) * 2
+			}
+		}
+
+		tokenized := bytes.Clone(want["data.bin"][:checkpoint.DataBytes])
+		for i := 0; i < len(tokenized); i += 2 {
+			if tokenized[i] != 0 {
+				tokenized[i] = 1
+			}
+		}
+		resumed := map[string][]byte{
+			"data.bin":         append(bytes.Clone(tokenized), want["data.bin"][checkpoint.DataBytes:]...),
+			docOffsetsFilename: want[docOffsetsFilename],
+			docSourcesFilename: want[docSourcesFilename],
+		}
+		interrupted := map[string][]byte{
+			"data.bin":         tokenized,
+			docOffsetsFilename: want[docOffsetsFilename][:checkpoint.NumDocuments*docOffsetSize],
+			docSourcesFilename: want[docSourcesFilename][:checkpoint.NumDocuments*docSourceSize],
+		}
+
+		outpath := filepath.Join(t.TempDir(), "index")
+		if err := os.MkdirAll(outpath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, filename := range filenames {
+			data := append(bytes.Clone(interrupted[filename]), 9, 9, 9, 9)
+			if err := os.WriteFile(filepath.Join(outpath, filename), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := tokenizeMultiprocess(files, 0, input, outpath, complete.TokenizerConfig, 0, 1, 2, 1, false, checkpoint, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, filename := range filenames {
+			data, err := os.ReadFile(filepath.Join(outpath, filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, resumed[filename]) {
+				t.Fatalf("resuming in %s: %s is %v, want %v", files[fileIdx], filename, data, resumed[filename])
+			}
+		}
+	}
+}
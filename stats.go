@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// Output formats of the stats mode.
+const (
+	statsText = "text"
+	statsJSON = "json"
+)
+
+// Number of documents whose length (in tokens, not counting the sentinals) is in
+// [Min, Max].
+type LengthBucket struct {
+	Min          int64 `json:"min"`
+	Max          int64 `json:"max"`
+	NumDocuments int64 `json:"num_documents"`
+}
+
+// Statistics of the document lengths.
+type LengthStats struct {
+	Min     int64          `json:"min"`
+	Max     int64          `json:"max"`
+	Mean    float64        `json:"mean"`
+	Buckets []LengthBucket `json:"buckets"` // powers of two, without the empty ones
+}
+
+// A chunk of the index and the size of its file.
+type ChunkStats struct {
+	ChunkInfo
+	NumTokens int64 `json:"num_tokens"`
+	FileBytes int64 `json:"file_bytes"`
+}
+
+// Size of one of the files of the index.
+type ComponentSize struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Number of occurrences of a token in the documents.
+type UnigramCount struct {
+	Token uint32 `json:"token"`
+	Count int64  `json:"count"`
+}
+
+// Basic facts about a built index.
+type IndexStats struct {
+	NumTokens        int64           `json:"num_tokens"` // not counting the sentinals
+	NumDocuments     int64           `json:"num_documents"`
+	NumDeleted       int64           `json:"num_deleted_documents"`
+	NumSources       int             `json:"num_sources"`
+	TokenWidth       int             `json:"token_width"`
+	Backend          string          `json:"backend"`
+	DocumentLengths  LengthStats     `json:"document_lengths"`
+	Chunks           []ChunkStats    `json:"chunks"`
+	Merged           *ChunkStats     `json:"merged,omitempty"`
+	DiskUsage        []ComponentSize `json:"disk_usage"`
+	TotalBytes       int64           `json:"total_bytes"`
+	DistinctUnigrams int64           `json:"distinct_unigrams"`
+	TopUnigrams      []UnigramCount  `json:"top_unigrams"`
+}
+
+// Size of the file at filename, or -1 if it doesn't exist.
+func fileSize(filename string) (int64, error) {
+	info, err := os.Stat(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Computes the statistics of the index in outpath: the document lengths come
+// from the document offsets, the unigram counts from scanning the tokenized
+// corpus (without the sentinals) and the sizes from the files themselves.
+// Deleted documents are still counted. Keeps the numUnigrams most frequent tokens.
+func computeStats(outpath string, numUnigrams int) (*IndexStats, error) {
+	manifest, err := loadManifest(outpath)
+	if err != nil {
+		return nil, err
+	}
+	if err := manifest.checkFiles(outpath); err != nil {
+		return nil, err
+	}
+
+	stats := &IndexStats{
+		NumTokens:    manifest.NumTokens - manifest.NumDocuments*int64(manifest.SentinalSize),
+		NumDocuments: manifest.NumDocuments,
+		NumSources:   len(manifest.Sources),
+		TokenWidth:   manifest.TokenWidth,
+		Backend:      manifest.backend(),
+	}
+
+	bitmap, err := readDeletedBitmap(outpath)
+	if err != nil {
+		return nil, err
+	}
+	for id := int64(0); id < min(int64(len(bitmap))*8, manifest.NumDocuments); id++ {
+		if isBitSet(bitmap, id) {
+			stats.NumDeleted++
+		}
+	}
+
+	if stats.DocumentLengths, err = documentLengthStats(outpath, manifest); err != nil {
+		return nil, err
+	}
+
+	for _, chunk := range manifest.Chunks {
+		chunkStats, err := makeChunkStats(outpath, chunk, manifest.TokenWidth)
+		if err != nil {
+			return nil, err
+		}
+		stats.Chunks = append(stats.Chunks, chunkStats)
+	}
+	if manifest.Merged != nil {
+		merged, err := makeChunkStats(outpath, manifest.Merged.ChunkInfo, manifest.TokenWidth)
+		if err != nil {
+			return nil, err
+		}
+		stats.Merged = &merged
+	}
+
+	if err := addDiskUsage(stats, outpath, manifest); err != nil {
+		return nil, err
+	}
+
+	counts, err := countUnigrams(outpath, manifest)
+	if err != nil {
+		return nil, err
+	}
+	for token, count := range counts {
+		if count == 0 {
+			continue
+		}
+		stats.DistinctUnigrams++
+		stats.TopUnigrams = append(stats.TopUnigrams, UnigramCount{Token: uint32(token), Count: count})
+	}
+	sort.SliceStable(stats.TopUnigrams, func(i, j int) bool {
+		return stats.TopUnigrams[i].Count > stats.TopUnigrams[j].Count
+	})
+	stats.TopUnigrams = stats.TopUnigrams[:min(len(stats.TopUnigrams), numUnigrams)]
+
+	return stats, nil
+}
+
+// Computes the lengths of the documents from the document offsets.
+func documentLengthStats(outpath string, manifest *IndexManifest) (LengthStats, error) {
+	lengths := LengthStats{}
+	if manifest.NumDocuments == 0 {
+		return lengths, nil
+	}
+
+	docs, err := openDocIndex(outpath, manifest)
+	if err != nil {
+		return lengths, err
+	}
+	defer docs.close()
+
+	// bucket k holds lengths in [2^(k-1), 2^k), and bucket 0 empty documents
+	buckets := make([]int64, 65)
+	total := int64(0)
+	lengths.Min = -1
+	for id := int64(0); id < manifest.NumDocuments; id++ {
+		length := (docs.end(id)-docs.start(id))/int64(manifest.TokenWidth) - int64(manifest.SentinalSize)
+		if lengths.Min < 0 || length < lengths.Min {
+			lengths.Min = length
+		}
+		lengths.Max = max(lengths.Max, length)
+		total += length
+		buckets[bits.Len64(uint64(length))]++
+	}
+	lengths.Mean = float64(total) / float64(manifest.NumDocuments)
+
+	for k, count := range buckets {
+		if count == 0 {
+			continue
+		}
+		bucket := LengthBucket{NumDocuments: count}
+		if k > 0 {
+			bucket.Min, bucket.Max = int64(1)<<(k-1), int64(1)<<k-1
+		}
+		lengths.Buckets = append(lengths.Buckets, bucket)
+	}
+	return lengths, nil
+}
+
+func makeChunkStats(outpath string, chunk ChunkInfo, tokenWidth int) (ChunkStats, error) {
+	size, err := fileSize(path.Join(outpath, chunk.Path))
+	if err != nil {
+		return ChunkStats{}, err
+	}
+	return ChunkStats{ChunkInfo: chunk, NumTokens: (chunk.End - chunk.Start) / int64(tokenWidth), FileBytes: size}, nil
+}
+
+// Adds the size of every file of the index that exists to stats.
+func addDiskUsage(stats *IndexStats, outpath string, manifest *IndexManifest) error {
+	add := func(name string, size int64) {
+		if size >= 0 {
+			stats.DiskUsage = append(stats.DiskUsage, ComponentSize{Name: name, Bytes: size})
+			stats.TotalBytes += size
+		}
+	}
+
+	files := []struct{ name, filename string }{
+		{"tokenized corpus", manifest.DataPath},
+		{"document offsets", manifest.DocOffsetsPath},
+		{"document sources", manifest.DocSourcesPath},
+		{"metadata", manifest.MetadataPath},
+		{"metadata offsets", manifest.MetadataOffsetsPath},
+		{"deleted documents", deletedFilename},
+		{"manifest", manifestFilename},
+	}
+	for _, file := range files {
+		if file.filename == "" {
+			continue
+		}
+		size, err := fileSize(path.Join(outpath, file.filename))
+		if err != nil {
+			return err
+		}
+		add(file.name, size)
+	}
+
+	chunkBytes := int64(0)
+	for _, chunk := range stats.Chunks {
+		chunkBytes += max(chunk.FileBytes, 0)
+	}
+	if manifest.backend() == backendFM {
+		add("FM-indices", chunkBytes)
+	} else {
+		add("suffix arrays", chunkBytes)
+	}
+	if stats.Merged != nil {
+		add("merged suffix array", stats.Merged.FileBytes)
+	}
+
+	lcpChunks := manifest.Chunks
+	if manifest.Merged != nil {
+		lcpChunks = append(lcpChunks[:len(lcpChunks):len(lcpChunks)], manifest.Merged.ChunkInfo)
+	}
+	lcpBytes, numLCP := int64(0), 0
+	for _, chunk := range lcpChunks {
+		if chunk.LCPPath == "" {
+			continue
+		}
+		size, err := fileSize(path.Join(outpath, chunk.LCPPath))
+		if err != nil {
+			return err
+		}
+		lcpBytes += max(size, 0)
+		numLCP++
+	}
+	if numLCP > 0 {
+		add("LCP arrays", lcpBytes)
+	}
+	return nil
+}
+
+// Counts the occurrences of every token in the documents of the tokenized corpus,
+// not counting the sentinals at the end of every document.
+func countUnigrams(outpath string, manifest *IndexManifest) ([]int64, error) {
+	tokenWidth := manifest.TokenWidth
+
+	numCounts := uint64(manifest.VocabSize)
+	if numCounts == 0 {
+		numCounts = maxTokenValue(tokenWidth) + 1
+	}
+	numCounts = max(numCounts, uint64(manifest.SentinalVal)+1)
+	counts := make([]int64, numCounts)
+
+	f, err := os.Open(path.Join(outpath, manifest.DataPath))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bar := progressbar.DefaultBytes(manifest.DataBytes, "counting unigrams")
+	reader := bufio.NewReaderSize(io.LimitReader(f, manifest.DataBytes), 1024*1024)
+	buf := make([]byte, 1024*1024/tokenWidth*tokenWidth)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		for i := 0; i < n/tokenWidth; i++ {
+			token := uint64(getToken(buf, i, tokenWidth))
+			if token >= uint64(len(counts)) {
+				return nil, fmt.Errorf("token id %d is outside of the vocabulary of %d tokens", token, manifest.VocabSize)
+			}
+			counts[token]++
+		}
+		bar.Add(n)
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	bar.Finish()
+
+	counts[manifest.SentinalVal] -= manifest.NumDocuments * int64(manifest.SentinalSize)
+	return counts, nil
+}
+
+func (s *IndexStats) printText() {
+	fmt.Printf("tokens: %d\n", s.NumTokens)
+	fmt.Printf("documents: %d (%d deleted) from %d input file(s)\n", s.NumDocuments, s.NumDeleted, s.NumSources)
+	fmt.Printf("token width: %d bytes, backend: %s\n", s.TokenWidth, s.Backend)
+
+	lengths := s.DocumentLengths
+	fmt.Printf("document lengths: min %d, max %d, mean %.1f\n", lengths.Min, lengths.Max, lengths.Mean)
+	for _, bucket := range lengths.Buckets {
+		fmt.Printf("  %d-%d tokens: %d\n", bucket.Min, bucket.Max, bucket.NumDocuments)
+	}
+
+	fmt.Printf("chunks: %d\n", len(s.Chunks))
+	for i, chunk := range s.Chunks {
+		fmt.Printf("  chunk %d (%s): %d tokens, %d entries, %d bytes\n", i, chunk.Path, chunk.NumTokens, chunk.NumEntries, chunk.FileBytes)
+	}
+	if s.Merged != nil {
+		fmt.Printf("  merged (%s): %d tokens, %d entries, %d bytes\n", s.Merged.Path, s.Merged.NumTokens, s.Merged.NumEntries, s.Merged.FileBytes)
+	}
+
+	fmt.Printf("disk usage: %d bytes\n", s.TotalBytes)
+	for _, component := range s.DiskUsage {
+		fmt.Printf("  %s: %d bytes\n", component.Name, component.Bytes)
+	}
+
+	fmt.Printf("distinct unigrams: %d\n", s.DistinctUnigrams)
+	for _, unigram := range s.TopUnigrams {
+		fraction := 0.0
+		if s.NumTokens > 0 {
+			fraction = float64(unigram.Count) / float64(s.NumTokens)
+		}
+		fmt.Printf("  token %d: %d (%.2f%%)\n", unigram.Token, unigram.Count, 100*fraction)
+	}
+}
+
+// Prints the statistics of the index in outpath as text or JSON, with the
+// numUnigrams most frequent tokens.
+func runStats(outpath string, numUnigrams int, format string) error {
+	if format != statsText && format != statsJSON {
+		return fmt.Errorf("unknown stats format %q: use %s or %s", format, statsText, statsJSON)
+	}
+
+	stats, err := computeStats(outpath, numUnigrams)
+	if err != nil {
+		return err
+	}
+
+	if format == statsJSON {
+		statsBytes, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(statsBytes))
+		return nil
+	}
+
+	stats.printText()
+	return nil
+}
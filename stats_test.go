@@ -0,0 +1,121 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestComputeStats(t *testing.T) {
+	// token 0 is the sentinal too, so only the sentinals are taken off its count
+	docs := [][]uint32{
+		{5},
+		{5, 0},
+		{3, 5, 7},
+		{5, 0, 5, 3},
+		{1, 2, 3, 5, 5},
+		{5, 5, 5, 5, 0, 0, 7, 7},
+		{1, 1, 1, 1, 1, 1, 1, 1, 1},
+	}
+	cfg := testBuildConfig(t, docs)
+	cfg.SentinalSize = 2
+	cfg.ChunkSize = 40
+	buildTestIndex(t, cfg)
+	// deleted documents are still counted
+	if err := runDelete(cfg.Outpath, []int64{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := computeStats(cfg.Outpath, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make([]int64, 8)
+	numTokens := int64(0)
+	for _, doc := range docs {
+		for _, token := range doc {
+			counts[token]++
+		}
+		numTokens += int64(len(doc))
+	}
+	if stats.NumTokens != numTokens || stats.NumDocuments != int64(len(docs)) || stats.NumDeleted != 1 {
+		t.Fatalf("%d tokens in %d documents (%d deleted), want %d in %d (1 deleted)", stats.NumTokens, stats.NumDocuments, stats.NumDeleted, numTokens, len(docs))
+	}
+
+	wantLengths := LengthStats{
+		Min:  1,
+		Max:  9,
+		Mean: float64(numTokens) / float64(len(docs)),
+		Buckets: []LengthBucket{
+			{Min: 1, Max: 1, NumDocuments: 1},
+			{Min: 2, Max: 3, NumDocuments: 2},
+			{Min: 4, Max: 7, NumDocuments: 2},
+			{Min: 8, Max: 15, NumDocuments: 2},
+		},
+	}
+	if !reflect.DeepEqual(stats.DocumentLengths, wantLengths) {
+		t.Fatalf("document lengths %+v, want %+v", stats.DocumentLengths, wantLengths)
+	}
+
+	// the most frequent first, ties broken by token id
+	unigrams := make([]UnigramCount, 0)
+	for token, count := range counts {
+		if count > 0 {
+			unigrams = append(unigrams, UnigramCount{Token: uint32(token), Count: count})
+		}
+	}
+	slices.SortStableFunc(unigrams, func(a, b UnigramCount) int {
+		return cmp.Compare(b.Count, a.Count)
+	})
+	if stats.DistinctUnigrams != int64(len(unigrams)) || !slices.Equal(stats.TopUnigrams, unigrams[:3]) {
+		t.Fatalf("%d distinct unigrams, top %v, want %d, top %v", stats.DistinctUnigrams, stats.TopUnigrams, len(unigrams), unigrams[:3])
+	}
+
+	numChunkTokens := int64(0)
+	for _, chunk := range stats.Chunks {
+		if chunk.FileBytes <= saHeaderSize {
+			t.Fatalf("chunk %s has %d bytes", chunk.Path, chunk.FileBytes)
+		}
+		numChunkTokens += chunk.NumTokens
+	}
+	if len(stats.Chunks) < 2 || numChunkTokens != numTokens+int64(len(docs))*2 {
+		t.Fatalf("%d chunks with %d tokens, want at least 2 with %d", len(stats.Chunks), numChunkTokens, numTokens+int64(len(docs))*2)
+	}
+
+	// the JSON output keeps its field names
+	statsBytes, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(statsBytes, &fields); err != nil {
+		t.Fatal(err)
+	}
+	wantFields := []string{"num_tokens", "num_documents", "num_deleted_documents", "num_sources", "token_width", "backend", "document_lengths", "chunks", "disk_usage", "total_bytes", "distinct_unigrams", "top_unigrams"}
+	for _, field := range wantFields {
+		if _, ok := fields[field]; !ok {
+			t.Fatalf("JSON output %s has no %s", statsBytes, field)
+		}
+	}
+	if len(fields) != len(wantFields) {
+		t.Fatalf("JSON output %s has fields other than %v", statsBytes, wantFields)
+	}
+
+	lengthBytes, err := json.Marshal(stats.DocumentLengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"min":1,"max":9,"mean":4.571428571428571,"buckets":[{"min":1,"max":1,"num_documents":1},{"min":2,"max":3,"num_documents":2},{"min":4,"max":7,"num_documents":2},{"min":8,"max":15,"num_documents":2}]}`; string(lengthBytes) != want {
+		t.Fatalf("document lengths %s, want %s", lengthBytes, want)
+	}
+	unigramBytes, err := json.Marshal(stats.TopUnigrams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"token":5,"count":11},{"token":1,"count":10},{"token":0,"count":4}]`; string(unigramBytes) != want {
+		t.Fatalf("top unigrams %s, want %s", unigramBytes, want)
+	}
+}
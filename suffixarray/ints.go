@@ -0,0 +1,15 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package suffixarray
+
+// Ints_32 computes the suffix array of text, whose values must be in [0, textMax).
+// It requires that len(text) fit in an int32 and that sa has the same length.
+func Ints_32(text []int32, textMax int, sa []int32) {
+	if int(int32(len(text))) != len(text) || len(text) != len(sa) {
+		panic("suffixarray: misuse of Ints_32")
+	}
+	clear(sa)
+	sais_32(text, textMax, sa, make([]int32, 2*textMax))
+}
@@ -1,33 +1,84 @@
 package main
 
 import (
+	"cmp"
 	"fmt"
 	"infinigram/suffixarray"
+	"math/bits"
+	"path"
+	"slices"
+	"sort"
 )
 
 type SuffixArray interface {
-	retrieveNum(corpusVec TokenArray, query []byte) int                              // retrieve number of continuations
-	retrieveSubstrings(corpusVec TokenArray, query []byte, numExtend int64) [][]byte // retrieve all continuations
+	retrieveNum(corpusVec TokenArray, query []byte) int                                                     // retrieve number of continuations
+	retrieveSubstrings(corpusVec TokenArray, query []byte, numExtend int64, sample *supportSample) [][]byte // retrieve all (or a sample of) continuations
+	retrievePositions(corpusVec TokenArray, query []byte) ([]int64, error)                                  // retrieve the byte position of every occurrence
+	retrieveNextTokenCounts(corpusVec TokenArray, query []byte) map[uint32]int64                            // count the tokens that follow the occurrences
+	matchRanges(corpusVec TokenArray, query []byte) []matchRange                                            // the entries that match in each chunk
 }
 
 // Wrapper around suffix arrays corresponding to multiple chunks
-// of data. Will sum over the results of each chunk.
+// of data. Will sum over the results of each chunk. Occurrences inside
+// deleted documents are skipped.
 type MultiSuffixArray struct {
-	suffixArrays []SuffixArrayData // suffix array for each chunk of documents
+	suffixArrays []SuffixArrayData     // suffix array for each chunk of documents
+	chunks       []ChunkInfo           // byte range covered by each suffix array
+	chunkEnd     func(pos int64) int64 // end of the chunk containing pos, where suffixes stop
+	tokenWidth   int                   // number of bytes per token
+	deleted      *tombstones           // nil if no documents are deleted
 }
 
-// Create a multi-suffix array from a list of suffix array paths.
-func makeMultiSuffixArray(suffixArrayPaths []string) (*MultiSuffixArray, error) {
-	suffixArrays := make([]SuffixArrayData, len(suffixArrayPaths))
-	for i, path := range suffixArrayPaths {
-		newSA, err := makeMMappedSA(path)
+// Create a multi-suffix array from the chunks of the index in outpath described
+// by manifest (see searchChunks). Each chunk's suffix array file must match the
+// chunk's byte range and entry count, and its checksum if verifyChecksums is set.
+// Chunks with an LCP array have it opened as well.
+func makeMultiSuffixArray(outpath string, manifest *IndexManifest, deleted *tombstones, verifyChecksums bool) (*MultiSuffixArray, error) {
+	chunks := manifest.searchChunks()
+	tokenWidth := manifest.TokenWidth
+
+	suffixArrays := make([]SuffixArrayData, len(chunks))
+	for i, chunk := range chunks {
+		saPath := path.Join(outpath, chunk.Path)
+		newSA, err := makeMMappedSA(saPath)
 		if err != nil {
+			closeSuffixArrays(suffixArrays[:i])
 			return nil, err
 		}
 		suffixArrays[i] = newSA
+
+		if err := newSA.header.checkChunk(chunk, tokenWidth); err != nil {
+			closeSuffixArrays(suffixArrays[:i+1])
+			return nil, fmt.Errorf("%s: %w", saPath, err)
+		}
+		if verifyChecksums {
+			if err := newSA.verifyChecksum(); err != nil {
+				closeSuffixArrays(suffixArrays[:i+1])
+				return nil, fmt.Errorf("%s: %w", saPath, err)
+			}
+		}
+		if chunk.LCPPath != "" {
+			if err := newSA.openLCP(path.Join(outpath, chunk.LCPPath)); err != nil {
+				closeSuffixArrays(suffixArrays[:i+1])
+				return nil, err
+			}
+		}
 	}
 
-	return &MultiSuffixArray{suffixArrays: suffixArrays}, nil
+	return &MultiSuffixArray{
+		suffixArrays: suffixArrays,
+		chunks:       chunks,
+		chunkEnd:     manifest.chunkEnd,
+		tokenWidth:   tokenWidth,
+		deleted:      deleted,
+	}, nil
+}
+
+// Unmaps suffixArrays, e.g., the chunks opened before one of them fails to open.
+func closeSuffixArrays(suffixArrays []SuffixArrayData) {
+	for _, sa := range suffixArrays {
+		sa.close()
+	}
 }
 
 // Retrieve the number of suffix arrays.
@@ -49,26 +100,75 @@ func (msa *MultiSuffixArray) retrieveNum(vec TokenArray, query []byte) int {
 			return 0 // TODO: handle error here
 		}
 
-		numResults += retrieveNum(arr, vec, query)
-		fmt.Printf("retrieved from chunk #%d: suffix_size=%d, occurrences=%d\n", i, len(query)/2, numResults)
+		numResults += retrieveLiveNum(arr, vec, query, msa.chunks[i], msa.tokenWidth, msa.deleted)
+		fmt.Printf("retrieved from chunk #%d: suffix_size=%d, occurrences=%d\n", i, len(query)/msa.tokenWidth, numResults)
 	}
 
-	fmt.Printf("suffix of size %d has %d total occurrences\n", len(query)/2, numResults)
+	fmt.Printf("suffix of size %d has %d total occurrences\n", len(query)/msa.tokenWidth, numResults)
 
 	return numResults
 }
 
-func (msa *MultiSuffixArray) retrieveSubstrings(vec TokenArray, query []byte, extend int64) [][]byte {
-	results := make([][]byte, 0)
+// Retrieve the continuations in every chunk, or a sample of them if sample isn't
+// nil.
+func (msa *MultiSuffixArray) retrieveSubstrings(vec TokenArray, query []byte, extend int64, sample *supportSample) [][]byte {
+	return sample.substrings(msa.matchRanges(vec, query), int64(len(query))+extend*int64(msa.tokenWidth))
+}
+
+// Retrieve the range of the occurrences in every chunk that has some.
+func (msa *MultiSuffixArray) matchRanges(vec TokenArray, query []byte) []matchRange {
+	ranges := make([]matchRange, 0)
 	for i := 0; i < msa.numArrays(); i++ {
 		arr, err := msa.getArray(i)
 		if err != nil {
 			return nil // TODO: handle error here
 		}
-		substrings := retrieveSubstrings(arr, vec, query, extend)
-		results = append(results, substrings...)
+
+		startIdx, endIdx := arraySearch(arr, vec, query)
+		if (startIdx == -1) && (endIdx == -1) {
+			continue
+		}
+		ranges = append(ranges, matchRange{at: arr.get, start: startIdx, end: endIdx + 1, vec: vec, deleted: msa.deleted})
 	}
-	return results
+	return ranges
+}
+
+// Retrieve the byte positions of the occurrences in every chunk.
+func (msa *MultiSuffixArray) retrievePositions(vec TokenArray, query []byte) ([]int64, error) {
+	results := make([]int64, 0)
+	for i := 0; i < msa.numArrays(); i++ {
+		arr, err := msa.getArray(i)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pos := range retrieve(arr, vec, query) {
+			if msa.deleted == nil || !msa.deleted.isDeleted(pos) {
+				results = append(results, pos)
+			}
+		}
+	}
+	return results, nil
+}
+
+// Count the tokens that follow the occurrences in every chunk, leaving out those
+// inside deleted documents.
+func (msa *MultiSuffixArray) retrieveNextTokenCounts(vec TokenArray, query []byte) map[uint32]int64 {
+	counts := make(map[uint32]int64)
+	for i := 0; i < msa.numArrays(); i++ {
+		arr, err := msa.getArray(i)
+		if err != nil {
+			return nil // TODO: handle error here
+		}
+
+		startIdx, endIdx := arraySearch(arr, vec, query)
+		if (startIdx == -1) && (endIdx == -1) {
+			continue
+		}
+
+		countLiveNextTokens(arr.get, startIdx, endIdx+1, vec, query, msa.tokenWidth, msa.chunks[i], msa.chunkEnd, msa.deleted, counts)
+	}
+	return counts
 }
 
 // Perform left or right binary search on the suffix array.
@@ -101,12 +201,74 @@ func binarySearch(suffixArray SuffixArrayData, vec TokenArray, query []byte, lef
 	return start
 }
 
+// Compares the suffix of vec starting at a and ending at aEnd (exclusive) with
+// the suffix starting at b and ending at bEnd. The suffixes are read in blocks of
+// increasing size, so only a little more than their common prefix is read.
+// Returns -1 if the first suffix is smaller, 0 if they are equal, and 1 otherwise.
+func compareSuffixes(vec TokenArray, a, aEnd, b, bEnd int64) int {
+	blockSize := int64(64)
+	for {
+		aStop := min(a+blockSize, aEnd)
+		bStop := min(b+blockSize, bEnd)
+
+		cmpValue := compareSlices(vec.getSlice(a, aStop), vec.getSlice(b, bStop))
+		if cmpValue != 0 {
+			return cmpValue
+		}
+
+		// the blocks are equal, so a suffix that ended is a prefix of the other one
+		if aStop == aEnd && bStop == bEnd {
+			return 0
+		} else if aStop == aEnd {
+			return -1
+		} else if bStop == bEnd {
+			return 1
+		}
+
+		a, b = aStop, bStop
+		blockSize = min(blockSize*2, 1024*1024)
+	}
+}
+
+// Returns the number of bytes the suffix of vec starting at a and ending at aEnd
+// (exclusive) has in common with the suffix starting at b and ending at bEnd.
+// Like compareSuffixes, the suffixes are read in blocks of increasing size.
+func commonPrefixLength(vec TokenArray, a, aEnd, b, bEnd int64) int64 {
+	length := int64(0)
+	blockSize := int64(64)
+	for {
+		aStop := min(a+blockSize, aEnd)
+		bStop := min(b+blockSize, bEnd)
+
+		aBlock, bBlock := vec.getSlice(a, aStop), vec.getSlice(b, bStop)
+		n := min(len(aBlock), len(bBlock))
+		for i := 0; i < n; i++ {
+			if aBlock[i] != bBlock[i] {
+				return length + int64(i)
+			}
+		}
+		length += int64(n)
+
+		if aStop == aEnd || bStop == bEnd {
+			return length
+		}
+
+		a, b = aStop, bStop
+		blockSize = min(blockSize*2, 1024*1024)
+	}
+}
+
 // Search for the occurrences of a query in the suffix array.
 // Returns the starting and ending positions of the occurrences.
 func arraySearch(suffixArray SuffixArrayData, vec TokenArray, query []byte) (int64, int64) {
 	// bisect left; all values to the left are <, all values to the right are >=
 	occStart := binarySearch(suffixArray, vec, query, true)
 
+	// the query is larger than every suffix
+	if occStart == suffixArray.length() {
+		return -1, -1
+	}
+
 	// if found, occStart is the first occurrence
 	queryLen := int64(len(query))
 	vecLen := vec.length()
@@ -158,43 +320,200 @@ func retrieveNum(suffixArray SuffixArrayData, vec TokenArray, query []byte) int
 	return int(endIdx - startIdx + 1)
 }
 
-// Retrieve all occurrences of a query in the suffix array. The returned occurrences
-// are extended by extend tokens.
-func retrieveSubstrings(suffixArray SuffixArrayData, vec TokenArray, query []byte, extend int64) [][]byte {
-	suffixStarts := retrieve(suffixArray, vec, query)
+// Same as retrieveNum, but occurrences inside deleted documents aren't counted.
+// chunk is the byte range covered by the suffix array. Chunks without deleted
+// documents are counted like retrieveNum. Otherwise, the deleted occurrences are
+// found by checking every occurrence or by scanning the deleted documents of the
+// chunk, whichever has fewer positions to look at.
+func retrieveLiveNum(suffixArray SuffixArrayData, vec TokenArray, query []byte, chunk ChunkInfo, tokenWidth int, deleted *tombstones) int {
+	if deleted == nil {
+		return retrieveNum(suffixArray, vec, query)
+	}
+	numDeletedTokens := deleted.deletedBytes(chunk.Start, chunk.End) / int64(tokenWidth)
+	if numDeletedTokens == 0 {
+		return retrieveNum(suffixArray, vec, query)
+	}
+
+	startIdx, endIdx := arraySearch(suffixArray, vec, query)
 
-	n_result := len(suffixStarts)
+	if (startIdx == -1) && (endIdx == -1) {
+		return 0
+	}
+
+	numOccurrences := endIdx - startIdx + 1
+	if numOccurrences > numDeletedTokens {
+		return int(numOccurrences - deleted.deletedMatches(vec, query, chunk.Start, chunk.End, vec.length(), tokenWidth))
+	}
+
+	numLive := 0
+	for s := startIdx; s <= endIdx; s++ {
+		if !deleted.isDeleted(suffixArray.get(s)) {
+			numLive++
+		}
+	}
+
+	return numLive
+}
+
+// Adds the number of times each token follows query to counts, given the entries
+// [start, end) of a suffix array (or the rows of an FM-index) that start with
+// query. at returns the byte position of an entry and chunkEnd the end of the
+// chunk containing a byte position. The entries are sorted by the token after
+// query, so the entries followed by a token are found by binary searching for
+// the first entry followed by a larger one: the cost depends on the number of
+// distinct next tokens rather than the number of entries. Entries whose suffix
+// ends right after query sort first and have no next token, so they are skipped.
+// Entries inside deleted documents are counted too: countLiveNextTokens leaves
+// them out.
+func countNextTokens(at func(int64) int64, start, end int64, vec TokenArray, queryLen int64, tokenWidth int, chunkEnd func(int64) int64, counts map[uint32]int64) {
+	width := int64(tokenWidth)
+	nextToken := func(idx int64) []byte {
+		pos := at(idx)
+		return vec.getSlice(pos+queryLen, pos+queryLen+width)
+	}
+
+	for start < end {
+		pos := at(start)
+		if pos+queryLen+width <= chunkEnd(pos) {
+			break
+		}
+		start++
+	}
+
+	for start < end {
+		next := nextToken(start)
+
+		// the first entry after start followed by a larger token
+		stop := start + 1 + int64(sort.Search(int(end-start-1), func(i int) bool {
+			return compareSlices(nextToken(start+1+int64(i)), next) > 0
+		}))
+
+		counts[getToken(next, 0, tokenWidth)] += stop - start
+
+		start = stop
+	}
+}
+
+// Same as countNextTokens, but entries inside deleted documents aren't counted.
+// chunk is the byte range covered by the entries. As in retrieveLiveNum, chunks
+// without deleted documents are counted like countNextTokens. Otherwise, the
+// deleted entries are left out by checking every entry or subtracted by scanning
+// the deleted documents of the chunk, whichever has fewer positions to look at.
+func countLiveNextTokens(at func(int64) int64, start, end int64, vec TokenArray, query []byte, tokenWidth int, chunk ChunkInfo, chunkEnd func(int64) int64, deleted *tombstones, counts map[uint32]int64) {
 	queryLen := int64(len(query))
+	width := int64(tokenWidth)
+
+	numDeletedTokens := int64(0)
+	if deleted != nil {
+		numDeletedTokens = deleted.deletedBytes(chunk.Start, chunk.End) / width
+	}
+	if numDeletedTokens == 0 {
+		countNextTokens(at, start, end, vec, queryLen, tokenWidth, chunkEnd, counts)
+		return
+	}
 
-	resultSlices := make([][]byte, n_result)
-	for i, start := range suffixStarts {
-		resultSlices[i] = vec.getSlice(start, start+queryLen+(extend*2))
+	if end-start > numDeletedTokens {
+		countNextTokens(at, start, end, vec, queryLen, tokenWidth, chunkEnd, counts)
+		deleted.subtractNextTokens(vec, query, chunk.Start, chunk.End, tokenWidth, chunkEnd, counts)
+		return
 	}
 
-	return resultSlices
+	for idx := start; idx < end; idx++ {
+		pos := at(idx)
+		if pos+queryLen+width > chunkEnd(pos) || deleted.isDeleted(pos) {
+			continue
+		}
+		counts[getToken(vec.getSlice(pos+queryLen, pos+queryLen+width), 0, tokenWidth)]++
+	}
 }
 
 // Encode a sequence of integers into a byte array ending in the sentinal.
-// The sentinalVal is repeated sentinalSize times.
-func encodeSequence(valueBytes []byte, values []uint32, sentinalVal int, sentinalSize int) {
+// The sentinalVal is repeated sentinalSize times. Each value takes up
+// tokenWidth bytes; values that do not fit return an error.
+func encodeSequence(valueBytes []byte, values []uint32, sentinalVal int, sentinalSize int, tokenWidth int) error {
 	size := len(values)
 
 	for i := 0; i < size; i++ {
-		putByte(valueBytes, uint16(values[i]), i)
+		if err := putByte(valueBytes, values[i], i, tokenWidth); err != nil {
+			return err
+		}
 	}
 
 	for i := 0; i < sentinalSize; i++ {
-		putByte(valueBytes, uint16(sentinalVal), size+i)
+		if err := putByte(valueBytes, uint32(sentinalVal), size+i, tokenWidth); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
 // Create a suffix array for a given byte array.
-// Each token is a uint16 value, so will take up two bytes. This means that
-// only even indices in the suffix array are valid. The unaligned suffix
-// array returned will contain odd values.
+// Each token takes up tokenWidth bytes. This means that only indices that
+// are a multiple of the token width in the suffix array are valid. The
+// unaligned suffix array returned will contain the other values as well.
 func createUnalignedSuffixArray(valueBytes []byte) []int64 {
 	suffixArray := make([]int64, len(valueBytes))
 	suffixarray.Text_64(valueBytes, suffixArray)
 
 	return suffixArray
 }
+
+// Ranks the tokens that appear in a byte array, where each token takes up
+// tokenWidth bytes, by the order of their bytes (little endian, compared first
+// byte first). Returns the rank of every token id up to the largest one that
+// appears, and the tokens that appear in rank order.
+func rankTokens(valueBytes []byte, tokenWidth int) ([]int32, []uint32) {
+	numTokens := len(valueBytes) / tokenWidth
+
+	maxToken := uint32(0)
+	for i := 0; i < numTokens; i++ {
+		maxToken = max(maxToken, getToken(valueBytes, i, tokenWidth))
+	}
+
+	rank := make([]int32, int64(maxToken)+1)
+	for i := 0; i < numTokens; i++ {
+		rank[getToken(valueBytes, i, tokenWidth)] = 1
+	}
+
+	tokens := make([]uint32, 0)
+	for token, present := range rank {
+		if present == 1 {
+			tokens = append(tokens, uint32(token))
+		}
+	}
+	slices.SortFunc(tokens, func(a, b uint32) int {
+		return cmp.Compare(byteOrderKey(a, tokenWidth), byteOrderKey(b, tokenWidth))
+	})
+	for i, token := range tokens {
+		rank[token] = int32(i)
+	}
+
+	return rank, tokens
+}
+
+// Create a suffix array over the tokens of a byte array, where each token takes
+// up tokenWidth bytes. Returns the token index of each suffix in sorted order.
+// The tokens are ranked by their bytes (see rankTokens) so that the suffixes are
+// in the same order as when comparing bytes, which is what the binary search
+// does. The alphabet is the set of tokens that appear in the chunk, so it is at
+// most the vocabulary size.
+func createTokenSuffixArray(valueBytes []byte, tokenWidth int) []int32 {
+	numTokens := len(valueBytes) / tokenWidth
+	rank, tokens := rankTokens(valueBytes, tokenWidth)
+
+	text := make([]int32, numTokens)
+	for i := range text {
+		text[i] = rank[getToken(valueBytes, i, tokenWidth)]
+	}
+
+	suffixArray := make([]int32, numTokens)
+	suffixarray.Ints_32(text, len(tokens), suffixArray)
+
+	return suffixArray
+}
+
+// Key that orders tokens the same way as comparing their little endian bytes.
+func byteOrderKey(token uint32, tokenWidth int) uint32 {
+	return bits.ReverseBytes32(token) >> (32 - 8*tokenWidth)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestTokenSuffixArrayMatchesByteOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, tokenWidth := range []int{2, 4} {
+		vocab := []uint32{0, 1, 2, 255, 256, 257, 511, 512, 1000, 65535}
+		if tokenWidth == 4 {
+			vocab = append(vocab, 65536, 70000, 1<<24, 1<<24+1)
+		}
+
+		for trial := 0; trial < 30; trial++ {
+			// small vocabularies give long repeats, which are the hard case
+			trialVocab := vocab[:2+rng.Intn(len(vocab)-1)]
+			tokens := randomTokens(rng, 1+rng.Intn(500), trialVocab, trial%2 == 0)
+			valueBytes := encodeTokens(t, tokens, tokenWidth)
+
+			aligned := make([]int32, 0, len(tokens))
+			for _, pos := range createUnalignedSuffixArray(valueBytes) {
+				if pos%int64(tokenWidth) == 0 {
+					aligned = append(aligned, int32(pos/int64(tokenWidth)))
+				}
+			}
+
+			suffixArray := createTokenSuffixArray(valueBytes, tokenWidth)
+			if len(suffixArray) != len(aligned) {
+				t.Fatalf("width %d, tokens %v: %d entries, want %d", tokenWidth, tokens, len(suffixArray), len(aligned))
+			}
+			for i := range aligned {
+				if suffixArray[i] != aligned[i] {
+					t.Fatalf("width %d, tokens %v: entry %d is %d, want %d", tokenWidth, tokens, i, suffixArray[i], aligned[i])
+				}
+			}
+		}
+	}
+}
+
+func TestByteOrderKey(t *testing.T) {
+	tokens := []uint32{0, 1, 255, 256, 257, 511, 65535, 65536, 1 << 24, 1<<32 - 1}
+	for _, a := range tokens {
+		for _, b := range tokens {
+			aBytes := encodeTokens(t, []uint32{a}, 4)
+			bBytes := encodeTokens(t, []uint32{b}, 4)
+			want := compareSlices(aBytes, bBytes)
+
+			got := 0
+			if byteOrderKey(a, 4) < byteOrderKey(b, 4) {
+				got = -1
+			} else if byteOrderKey(a, 4) > byteOrderKey(b, 4) {
+				got = 1
+			}
+			if got != want {
+				t.Errorf("tokens %d and %d compare as %d, but their bytes compare as %d", a, b, got, want)
+			}
+		}
+	}
+}
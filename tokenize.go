@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"infinigram/tokenizers"
 	"os"
@@ -20,7 +21,56 @@ func initTokenizer(tokenizerConfig string) (*tokenizers.Tokenizer, error) {
 	return tk, err
 }
 
-func worker(wg *sync.WaitGroup, tokenizerConfig string, sentinalVal int, sentinalSize int, textJobs <-chan *string, results chan<- []byte) {
+// Number of records per tokenization worker that can be read ahead of the
+// next document to be written.
+const reorderWindowPerWorker = 64
+
+// Records the first error reported by any of the tokenization goroutines.
+type errorCollector struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (ec *errorCollector) set(err error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ec.err == nil {
+		ec.err = err
+	}
+}
+
+func (ec *errorCollector) get() error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	return ec.err
+}
+
+// A record read from an input file and where it came from.
+type inputRecord struct {
+	seq    int64 // position of the record in the order it was read
+	text   string
+	source int   // index of the input file among the index's sources
+	record int64 // record number within the input file
+}
+
+// A tokenized document, its metadata and where it came from, ready to be written.
+// Every record gets one, in the same order they were read; skip is set for
+// records that aren't written (whitespace documents and errors).
+type tokenizedDoc struct {
+	seq      int64
+	skip     bool
+	data     []byte
+	metadata []byte // nil if no metadata is kept
+	source   int
+	record   int64
+}
+
+// Tokenizes the records in textJobs, which input splits into the text to tokenize
+// and its metadata. Skips documents that are all whitespace. Sends one result per
+// record, in whatever order they finish.
+func worker(wg *sync.WaitGroup, tokenizerConfig string, input *inputFormat, sentinalVal, sentinalSize, tokenWidth int, textJobs <-chan *inputRecord, results chan<- tokenizedDoc, errs *errorCollector) {
 	defer wg.Done()
 
 	tk, err := initTokenizer(tokenizerConfig)
@@ -29,88 +79,389 @@ func worker(wg *sync.WaitGroup, tokenizerConfig string, sentinalVal int, sentina
 	}
 	defer tk.Close()
 
-	for textP := range textJobs {
-		en, _ := tk.Encode(*textP, false)
+	for job := range textJobs {
+		skipped := tokenizedDoc{seq: job.seq, skip: true}
+
+		// keep draining the jobs after an error so the reader doesn't block
+		if errs.get() != nil {
+			results <- skipped
+			continue
+		}
+
+		doc, err := input.parse(job.text)
+		if err != nil {
+			errs.set(err)
+			results <- skipped
+			continue
+		}
+		if isAllWhitespace(&doc.text) {
+			results <- skipped
+			continue
+		}
 
-		dataBytes := make([]byte, (len(en)+sentinalSize)*2)
-		encodeSequence(dataBytes, en, sentinalVal, sentinalSize)
+		en, _ := tk.Encode(doc.text, false)
 
-		results <- dataBytes
+		dataBytes := make([]byte, (len(en)+sentinalSize)*tokenWidth)
+		if err := encodeSequence(dataBytes, en, sentinalVal, sentinalSize, tokenWidth); err != nil {
+			errs.set(err)
+			results <- skipped
+			continue
+		}
+
+		results <- tokenizedDoc{seq: job.seq, data: dataBytes, metadata: doc.metadata, source: job.source, record: job.record}
 	}
 }
 
-func writeWorker(wg *sync.WaitGroup, filename string, results <-chan []byte) error {
-	defer wg.Done()
+// Counts of what was written to the tokenized corpus.
+type corpusStats struct {
+	numDocuments  int64
+	numBytes      int64
+	metadataBytes int64
+}
+
+// Writes tokenized documents to the end of the tokenized corpus, along with the
+// starting byte position and source of each document and, optionally, their metadata.
+type corpusWriter struct {
+	data            *os.File
+	docs            *bufferedFile
+	sources         *bufferedFile
+	metadata        *bufferedFile // nil if no metadata is kept
+	metadataOffsets *bufferedFile
+	offset          int64 // current size of the tokenized corpus
+	metadataOffset  int64 // current size of the metadata
+	stats           corpusStats
+}
+
+// Opens the tokenized corpus, document offsets, document sources and, if
+// keepMetadata is set, the metadata files in outpath. If appendData is set, documents are added to the
+// end of the existing files; otherwise the files are replaced.
+func openCorpusWriter(outpath string, keepMetadata, appendData bool) (*corpusWriter, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendData {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+
+	data, err := os.OpenFile(path.Join(outpath, "data.bin"), flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	cw := &corpusWriter{data: data}
 
-	f, err := os.Create(filename)
+	info, err := data.Stat()
 	if err != nil {
+		cw.close()
+		return nil, err
+	}
+	cw.offset = info.Size()
+
+	cw.docs, err = openBufferedFile(path.Join(outpath, docOffsetsFilename), flags)
+	if err != nil {
+		cw.close()
+		return nil, err
+	}
+
+	cw.sources, err = openBufferedFile(path.Join(outpath, docSourcesFilename), flags)
+	if err != nil {
+		cw.close()
+		return nil, err
+	}
+
+	if !keepMetadata {
+		return cw, nil
+	}
+
+	cw.metadata, err = openBufferedFile(path.Join(outpath, metadataFilename), flags)
+	if err != nil {
+		cw.close()
+		return nil, err
+	}
+	info, err = cw.metadata.f.Stat()
+	if err != nil {
+		cw.close()
+		return nil, err
+	}
+	cw.metadataOffset = info.Size()
+
+	cw.metadataOffsets, err = openBufferedFile(path.Join(outpath, metadataOffsetsFilename), flags)
+	if err != nil {
+		cw.close()
+		return nil, err
+	}
+
+	return cw, nil
+}
+
+func (cw *corpusWriter) write(doc tokenizedDoc) error {
+	if _, err := cw.data.Write(doc.data); err != nil {
+		return err
+	}
+	if err := cw.docs.write(encodeDocOffset(cw.offset)); err != nil {
+		return err
+	}
+	if err := cw.sources.write(encodeDocSource(doc.source, doc.record)); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	for res := range results {
-		if _, err := f.Write(res); err != nil {
+	if cw.metadata != nil {
+		if err := cw.metadata.write(doc.metadata); err != nil {
+			return err
+		}
+		if err := cw.metadataOffsets.write(encodeDocOffset(cw.metadataOffset)); err != nil {
+			return err
+		}
+		cw.metadataOffset += int64(len(doc.metadata))
+		cw.stats.metadataBytes += int64(len(doc.metadata))
+	}
+
+	cw.offset += int64(len(doc.data))
+	cw.stats.numDocuments++
+	cw.stats.numBytes += int64(len(doc.data))
+	return nil
+}
+
+// Flushes everything written so far to disk.
+func (cw *corpusWriter) sync() error {
+	if err := cw.data.Sync(); err != nil {
+		return err
+	}
+	if err := cw.docs.sync(); err != nil {
+		return err
+	}
+	if err := cw.sources.sync(); err != nil {
+		return err
+	}
+	if cw.metadata != nil {
+		if err := cw.metadata.sync(); err != nil {
 			return err
 		}
+		return cw.metadataOffsets.sync()
 	}
 	return nil
 }
 
-// Tokenize a file from filename using numWorkers processes and writes the
-// resulting tokenized data to outpath. The tokenizer configuration file path
-// is tokenizerConfig. The sentinal value is set by sentinalVal and sentinalSize
-// Ignores documents that are all whitespace. Tokens are in uint16 format.
-// Tokenized data is streamed directly to disk.
-func tokenizeMultiprocess(filename, docSplit, outpath, tokenizerConfig string, sentinalVal, sentinalSize, numWorkers int) (string, error) {
-	// Initialize output path
+func (cw *corpusWriter) close() error {
+	err := cw.data.Close()
+	for _, bf := range []*bufferedFile{cw.docs, cw.sources, cw.metadata, cw.metadataOffsets} {
+		if bf == nil {
+			continue
+		}
+		if closeErr := bf.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Opens the corpus writer for the tokenized data in outpath. If resume has any
+// documents, the files are first truncated to it and written from there. Returns
+// a function that undoes everything written since: if appendData is set or there
+// is something to resume, the files are truncated back to where they started;
+// otherwise they are removed, so a partial file never looks like a finished corpus.
+func startCorpus(outpath string, keepMetadata, appendData bool, resume *tokenizeCheckpoint) (*corpusWriter, func(), error) {
 	if err := makeFolder(outpath); err != nil {
-		return "", err
+		return nil, nil, err
+	}
+
+	// the files written and their sizes at resume
+	outputs := []string{path.Join(outpath, "data.bin"), path.Join(outpath, docOffsetsFilename), path.Join(outpath, docSourcesFilename)}
+	resumeSizes := []int64{resume.DataBytes, resume.NumDocuments * docOffsetSize, resume.NumDocuments * docSourceSize}
+	if keepMetadata {
+		outputs = append(outputs, path.Join(outpath, metadataFilename), path.Join(outpath, metadataOffsetsFilename))
+		resumeSizes = append(resumeSizes, resume.MetadataBytes, resume.NumDocuments*docOffsetSize)
+	}
+
+	if resume.NumDocuments > 0 {
+		for i, output := range outputs {
+			if err := os.Truncate(output, resumeSizes[i]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	keepExisting := appendData || resume.NumDocuments > 0
+
+	cw, err := openCorpusWriter(outpath, keepMetadata, keepExisting)
+	if err != nil {
+		return nil, nil, err
+	}
+	originalSizes := make([]int64, len(outputs))
+	for i, output := range outputs {
+		info, err := os.Stat(output)
+		if err != nil {
+			cw.close()
+			return nil, nil, err
+		}
+		originalSizes[i] = info.Size()
+	}
+	cw.stats = corpusStats{numDocuments: resume.NumDocuments, numBytes: resume.DataBytes, metadataBytes: resume.MetadataBytes}
+
+	rollback := func() {
+		for i, output := range outputs {
+			if keepExisting {
+				os.Truncate(output, originalSizes[i])
+			} else {
+				os.Remove(output)
+			}
+		}
+	}
+	return cw, rollback, nil
+}
+
+// Writes the results of the workers in the order their records were read,
+// holding back results that finish early until everything before them is written.
+// Each result frees one of the window slots taken by the reader.
+func writeWorker(wg *sync.WaitGroup, cw *corpusWriter, results <-chan tokenizedDoc, inflight *sync.WaitGroup, window <-chan struct{}, errs *errorCollector) {
+	defer wg.Done()
+
+	pending := make(map[int64]tokenizedDoc)
+	next := int64(0)
+	for res := range results {
+		pending[res.seq] = res
+
+		for {
+			doc, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+
+			if !doc.skip && errs.get() == nil {
+				if err := cw.write(doc); err != nil {
+					errs.set(err)
+				}
+			}
+			<-window
+			inflight.Done()
+		}
+	}
+}
+
+// Tokenize the input files in order, read as described by input, using numWorkers
+// processes and writes the resulting tokenized data to outpath. Documents are
+// written in the order they are read, so the same input always gives the same
+// output. The tokenizer configuration file path is tokenizerConfig. The sentinal
+// value is set by sentinalVal and sentinalSize. Ignores documents that are all
+// whitespace. Each token takes up tokenWidth bytes; token ids that don't fit
+// return an error. Tokenized data is streamed directly to disk, along with the
+// starting position of each document and where it was read from: files[i] is
+// recorded as source firstSource+i. If appendData is set, the documents are added
+// to the end of the existing tokenized data instead of replacing it. If input
+// keeps metadata fields, they are written to the metadata files.
+//
+// If checkpoint isn't nil, it is called every tokenizeCheckpointInterval bytes of
+// input once everything read so far has been written and synced to disk. Passing
+// the last checkpoint as resume continues from it: the tokenized data is truncated
+// to the checkpoint and reading starts where it stopped. On failure, the tokenized
+// data is truncated back to where this call started. Returns the number of
+// documents and bytes written (including those before resume).
+func tokenizeMultiprocess(files []string, firstSource int, input *inputFormat, outpath, tokenizerConfig string, sentinalVal, sentinalSize, tokenWidth, numWorkers int, appendData bool, resume *tokenizeCheckpoint, checkpoint func(tokenizeCheckpoint) error) (*corpusStats, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no input files")
+	}
+
+	if resume == nil {
+		resume = &tokenizeCheckpoint{}
+	}
+
+	cw, rollback, err := startCorpus(outpath, len(input.metadataFields) > 0, appendData, resume)
+	if err != nil {
+		return nil, err
 	}
-	saPath := path.Join(outpath, "data.bin")
 
-	// Count lines for the progress bar
-	fileNumLines, err := numLines(filename, docSplit)
+	// Progress is measured in bytes read from disk across every input file
+	sources, err := statSources(files)
 	if err != nil {
-		return "", err
+		cw.close()
+		rollback()
+		return nil, err
+	}
+	totalSize := int64(0)
+	for _, source := range sources {
+		totalSize += source.Size
 	}
 
-	fmt.Println("Num lines: ", fileNumLines)
+	fmt.Printf("Num input files: %d (%d bytes)\n", len(files), totalSize)
 
 	// Initialize workers
-	textJobs := make(chan *string, numWorkers*4)
-	results := make(chan []byte, numWorkers*4)
+	textJobs := make(chan *inputRecord, numWorkers*4)
+	results := make(chan tokenizedDoc, numWorkers*4)
+
+	// records read but not yet written; bounds how many finished documents wait
+	// in the writer for a slower one before them
+	window := make(chan struct{}, numWorkers*reorderWindowPerWorker)
+
+	errs := &errorCollector{}
 
 	wgWorkers := &sync.WaitGroup{}
 	wgWriter := &sync.WaitGroup{}
+	inflight := &sync.WaitGroup{} // documents sent to the workers but not yet written
 
 	for w := 0; w < numWorkers; w++ {
 		wgWorkers.Add(1)
-		go worker(wgWorkers, tokenizerConfig, sentinalVal, sentinalSize, textJobs, results)
+		go worker(wgWorkers, tokenizerConfig, input, sentinalVal, sentinalSize, tokenWidth, textJobs, results, errs)
 	}
 
 	wgWriter.Add(1)
-	go writeWorker(wgWriter, saPath, results)
+	go writeWorker(wgWriter, cw, results, inflight, window, errs)
 
-	// Read input file and enqueue lines for processing
-	file, err := os.Open(filename)
-	if err != nil {
-		return "", err
+	bar := progressbar.DefaultBytes(totalSize, "tokenizing")
+	onRead := func(n int) { bar.Add(n) }
+	for _, source := range sources[:min(resume.InputFile, len(sources))] {
+		bar.Add64(source.Size)
 	}
-	defer file.Close()
 
-	bar := progressbar.Default(int64(fileNumLines))
+	var readErr error
+	seq := int64(0)
+	sinceCheckpoint := int64(0) // bytes of input consumed since the last checkpoint
+	for fileIdx := resume.InputFile; fileIdx < len(files) && readErr == nil; fileIdx++ {
+		filename := files[fileIdx]
 
-	err = readDocuments(filename, docSplit, func(lineP *string) error {
-		bar.Add(1)
-
-		if !isAllWhitespace(lineP) {
-			textJobs <- lineP
+		start, records := int64(0), int64(0)
+		if fileIdx == resume.InputFile {
+			start, records = resume.InputOffset, resume.InputLines
 		}
+		lastEnd := start
 
-		return nil
-	})
-	if err != nil {
-		return "", err
+		readErr = input.readFrom(filename, start, onRead, func(recordP *string, end int64) error {
+			if err := errs.get(); err != nil {
+				return err
+			}
+
+			window <- struct{}{}
+			inflight.Add(1)
+			textJobs <- &inputRecord{seq: seq, text: *recordP, source: firstSource + fileIdx, record: records}
+			seq++
+			records++
+
+			sinceCheckpoint += end - lastEnd
+			lastEnd = end
+
+			if checkpoint != nil && sinceCheckpoint >= tokenizeCheckpointInterval {
+				// wait until every document read so far is on disk
+				inflight.Wait()
+				if err := errs.get(); err != nil {
+					return err
+				}
+				if err := cw.sync(); err != nil {
+					return err
+				}
+
+				err := checkpoint(tokenizeCheckpoint{
+					InputFile:     fileIdx,
+					InputOffset:   end,
+					InputLines:    records,
+					DataBytes:     cw.offset,
+					NumDocuments:  cw.stats.numDocuments,
+					MetadataBytes: cw.metadataOffset,
+				})
+				if err != nil {
+					return err
+				}
+				sinceCheckpoint = 0
+			}
+
+			return nil
+		})
 	}
 
 	close(textJobs)
@@ -118,6 +469,18 @@ func tokenizeMultiprocess(filename, docSplit, outpath, tokenizerConfig string, s
 
 	close(results)
 	wgWriter.Wait()
+	bar.Finish()
+
+	if readErr == nil {
+		readErr = errs.get()
+	}
+	if closeErr := cw.close(); readErr == nil {
+		readErr = closeErr
+	}
+	if readErr != nil {
+		rollback()
+		return nil, readErr
+	}
 
-	return saPath, nil
+	return &cw.stats, nil
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Writes numFiles text files of random documents, one per line, to dir. Some
+// lines are blank, and some documents are much longer than the rest, so the
+// workers finish out of order.
+func writeRandomTextInput(t *testing.T, dir string, numFiles, numDocs int) []string {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	files := make([]string, numFiles)
+	for i := range files {
+		var input strings.Builder
+		for j := 0; j < numDocs; j++ {
+			length := 1 + rng.Intn(10)
+			if rng.Intn(20) == 0 {
+				length = 2000
+			}
+			if rng.Intn(15) == 0 {
+				length = 0
+			}
+			for k := 0; k < length; k++ {
+				input.WriteString(testVocab[rng.Intn(len(testVocab))] + " ")
+			}
+			input.WriteString("\n")
+		}
+		files[i] = filepath.Join(dir, fmt.Sprintf("input_%d.txt", i))
+		if err := os.WriteFile(files[i], []byte(input.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func TestTokenizationIsDeterministic(t *testing.T) {
+	files := writeRandomTextInput(t, t.TempDir(), 3, 300)
+	filenames := []string{"data.bin", docOffsetsFilename, docSourcesFilename}
+
+	var want map[string][]byte
+	for _, numWorkers := range []int{1, 8, 8} {
+		cfg := testTextBuildConfig(t, files)
+		input := cfg.inputFormat()
+		if _, err := tokenizeMultiprocess(files, 0, input, cfg.Outpath, cfg.TokenizerConfig, 0, 1, 2, numWorkers, false, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make(map[string][]byte)
+		for _, filename := range filenames {
+			data, err := os.ReadFile(filepath.Join(cfg.Outpath, filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[filename] = data
+		}
+		if want == nil {
+			want = got
+			continue
+		}
+		for _, filename := range filenames {
+			if !bytes.Equal(got[filename], want[filename]) {
+				t.Fatalf("%d workers: %s differs from that of one worker", numWorkers, filename)
+			}
+		}
+	}
+}
+
+// Writes the documents sent to writeWorker, in the order given by seqs, and
+// returns what it wrote to the tokenized corpus. If failAt isn't negative, an
+// error is reported once the document with that sequence number is sent.
+func runWriteWorker(t *testing.T, seqs []int64, skip map[int64]bool, failAt int64) ([]byte, error) {
+	t.Helper()
+	outpath := t.TempDir()
+	cw, err := openCorpusWriter(outpath, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every document takes a window slot, as if the reader had read it
+	window := make(chan struct{}, len(seqs))
+	inflight := &sync.WaitGroup{}
+	for range seqs {
+		window <- struct{}{}
+		inflight.Add(1)
+	}
+
+	results := make(chan tokenizedDoc)
+	errs := &errorCollector{}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go writeWorker(wg, cw, results, inflight, window, errs)
+
+	for _, seq := range seqs {
+		if seq == failAt {
+			errs.set(errors.New("worker failed"))
+		}
+		results <- tokenizedDoc{seq: seq, skip: skip[seq], data: []byte{byte(seq), 0}}
+	}
+	close(results)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("documents are still waiting to be written")
+	}
+	if len(window) != 0 {
+		t.Fatalf("%d window slots are still taken", len(window))
+	}
+
+	if err := cw.close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(outpath, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, errs.get()
+}
+
+func TestWriteWorkerReorders(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	seqs := make([]int64, 100)
+	for i, j := range rng.Perm(len(seqs)) {
+		seqs[i] = int64(j)
+	}
+	skip := map[int64]bool{3: true, 50: true, 99: true}
+
+	data, err := runWriteWorker(t, seqs, skip, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 0)
+	for seq := range len(seqs) {
+		if !skip[int64(seq)] {
+			want = append(want, byte(seq), 0)
+		}
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("wrote %v, want %v", data, want)
+	}
+
+	// after an error, every pending document is still taken off the window but
+	// nothing more is written
+	data, err = runWriteWorker(t, seqs, skip, seqs[len(seqs)/2])
+	if err == nil {
+		t.Fatal("the error was lost")
+	}
+	if !bytes.HasPrefix(want, data) || len(data) == len(want) {
+		t.Fatalf("wrote %v after the error, want a prefix of %v", data, want)
+	}
+}
+
+func TestTokenizationWorkerError(t *testing.T) {
+	// a record without text among many, which a worker fails to parse
+	var input strings.Builder
+	for i := 0; i < 2000; i++ {
+		if i == 1000 {
+			input.WriteString(`{"id": 1000}` + "\n")
+			continue
+		}
+		fmt.Fprintf(&input, `{"text": "the cat %d"}`+"\n", i)
+	}
+	filename := filepath.Join(t.TempDir(), "input.jsonl")
+	if err := os.WriteFile(filename, []byte(input.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testTextBuildConfig(t, []string{filename})
+	jsonl := &inputFormat{format: inputJSONL, textField: []string{"text"}}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tokenizeMultiprocess(cfg.Files, 0, jsonl, cfg.Outpath, cfg.TokenizerConfig, 0, 1, 2, 8, false, nil, nil)
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("tokenized a document without text")
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("tokenization hangs after a worker error")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Outpath, "data.bin")); !os.IsNotExist(err) {
+		t.Fatalf("the partial corpus is left behind (%v)", err)
+	}
+}
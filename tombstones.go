@@ -0,0 +1,441 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The deleted documents file is a bitmap with one bit per document id: bit
+// (id % 8) of byte (id / 8) is set if the document is deleted. Documents past the
+// end of the bitmap (e.g., appended after the last deletion) are not deleted.
+const deletedFilename = "deleted.bin"
+
+// Byte range [start, end) of a document in the tokenized corpus.
+type docRange struct {
+	start int64
+	end   int64
+}
+
+// Byte ranges of the deleted documents, used to skip suffix array entries that
+// fall inside of them.
+type tombstones struct {
+	ranges []docRange // sorted by start
+}
+
+// Returns whether byte pos of the tokenized corpus belongs to a deleted document.
+func (t *tombstones) isDeleted(pos int64) bool {
+	idx := sort.Search(len(t.ranges), func(i int) bool {
+		return t.ranges[i].end > pos
+	})
+	return idx < len(t.ranges) && t.ranges[idx].start <= pos
+}
+
+// Returns the number of bytes of [start, end) that belong to deleted documents.
+func (t *tombstones) deletedBytes(start, end int64) int64 {
+	idx := sort.Search(len(t.ranges), func(i int) bool {
+		return t.ranges[i].end > start
+	})
+
+	total := int64(0)
+	for ; idx < len(t.ranges) && t.ranges[idx].start < end; idx++ {
+		total += min(t.ranges[idx].end, end) - max(t.ranges[idx].start, start)
+	}
+	return total
+}
+
+// Returns the number of token positions of [start, end) inside deleted documents
+// at which query occurs, by comparing query with the tokenized corpus at each of
+// them. The comparison stops at byte stop: the end of vec for the binary search
+// of the suffix arrays, or the end of the chunk for the FM-indices.
+func (t *tombstones) deletedMatches(vec TokenArray, query []byte, start, end, stop int64, tokenWidth int) int64 {
+	idx := sort.Search(len(t.ranges), func(i int) bool {
+		return t.ranges[i].end > start
+	})
+
+	queryLen := int64(len(query))
+	numMatches := int64(0)
+	for ; idx < len(t.ranges) && t.ranges[idx].start < end; idx++ {
+		for pos := max(t.ranges[idx].start, start); pos < min(t.ranges[idx].end, end); pos += int64(tokenWidth) {
+			if compareSlices(vec.getSlice(pos, min(pos+queryLen, stop)), query) == 0 {
+				numMatches++
+			}
+		}
+	}
+	return numMatches
+}
+
+// Subtracts from counts the number of times each token follows query at the
+// token positions of [start, end) inside deleted documents, which countNextTokens
+// counted like any other. chunkEnd returns the end of the chunk containing a byte
+// position: occurrences without a next token before it weren't counted. Tokens
+// whose count drops to zero are removed.
+func (t *tombstones) subtractNextTokens(vec TokenArray, query []byte, start, end int64, tokenWidth int, chunkEnd func(int64) int64, counts map[uint32]int64) {
+	idx := sort.Search(len(t.ranges), func(i int) bool {
+		return t.ranges[i].end > start
+	})
+
+	queryLen := int64(len(query))
+	width := int64(tokenWidth)
+	for ; idx < len(t.ranges) && t.ranges[idx].start < end; idx++ {
+		for pos := max(t.ranges[idx].start, start); pos < min(t.ranges[idx].end, end); pos += width {
+			if pos+queryLen+width > chunkEnd(pos) || compareSlices(vec.getSlice(pos, pos+queryLen), query) != 0 {
+				continue
+			}
+			token := getToken(vec.getSlice(pos+queryLen, pos+queryLen+width), 0, tokenWidth)
+			if counts[token]--; counts[token] <= 0 {
+				delete(counts, token)
+			}
+		}
+	}
+}
+
+func isBitSet(bitmap []byte, id int64) bool {
+	return id/8 < int64(len(bitmap)) && bitmap[id/8]&(1<<(id%8)) != 0
+}
+
+// Reads the deleted documents bitmap of the index in outpath. Returns an empty
+// bitmap if no documents were deleted.
+func readDeletedBitmap(outpath string) ([]byte, error) {
+	bitmap, err := readBytesFromFile(path.Join(outpath, deletedFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return []byte{}, nil
+	}
+	return bitmap, err
+}
+
+// Loads the deleted documents of the index described by manifest: every deleted
+// document, and the deleted documents whose entries are still in the suffix
+// arrays because no compaction has dropped them yet. Occurrences are only
+// subtracted for the latter, as the others are no longer found. Either is nil
+// if there are no such documents.
+func loadTombstones(outpath string, manifest *IndexManifest) (deleted, indexed *tombstones, err error) {
+	bitmap, err := readDeletedBitmap(outpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return makeTombstones(outpath, manifest, bitmap)
+}
+
+// Same as loadTombstones, but with the deleted documents bitmap already read.
+func makeTombstones(outpath string, manifest *IndexManifest, bitmap []byte) (deleted, indexed *tombstones, err error) {
+	compacted := []byte{}
+	if manifest.CompactedPath != "" {
+		if compacted, err = readBytesFromFile(path.Join(outpath, manifest.CompactedPath)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	docs, err := openDocIndex(outpath, manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer docs.close()
+
+	deleted, indexed = &tombstones{}, &tombstones{}
+	for id := int64(0); id < min(int64(len(bitmap))*8, manifest.NumDocuments); id++ {
+		if !isBitSet(bitmap, id) {
+			continue
+		}
+		docRange := docRange{docs.start(id), docs.end(id)}
+		deleted.ranges = append(deleted.ranges, docRange)
+		if !isBitSet(compacted, id) {
+			indexed.ranges = append(indexed.ranges, docRange)
+		}
+	}
+
+	if len(indexed.ranges) == 0 {
+		indexed = nil
+	}
+	if len(deleted.ranges) == 0 {
+		deleted = nil
+	}
+	return deleted, indexed, nil
+}
+
+// Parses a comma separated list of document ids, optionally followed by the ids
+// in filename (one per line).
+func parseDocIds(idList, filename string) ([]int64, error) {
+	fields := strings.Split(idList, ",")
+	if filename != "" {
+		fileIds, err := readStringFromFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, strings.Split(fileIds, "\n")...)
+	}
+
+	ids := make([]int64, 0, len(fields))
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid document id %q", field)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Marks the documents ids of the index in outpath as deleted. Queries skip the
+// occurrences inside of them from then on, but the suffix arrays keep their
+// entries until the index is compacted.
+func runDelete(outpath string, ids []int64) error {
+	manifest, err := loadManifest(outpath)
+	if err != nil {
+		return err
+	}
+	if !manifest.Complete {
+		return fmt.Errorf("index in %s has not finished building", outpath)
+	}
+	if len(ids) == 0 {
+		return errors.New("no document ids to delete")
+	}
+
+	bitmap, err := readDeletedBitmap(outpath)
+	if err != nil {
+		return err
+	}
+	if numBytes := (manifest.NumDocuments + 7) / 8; int64(len(bitmap)) < numBytes {
+		bitmap = append(bitmap, make([]byte, numBytes-int64(len(bitmap)))...)
+	}
+
+	numDeleted := 0
+	for _, id := range ids {
+		if id < 0 || id >= manifest.NumDocuments {
+			return fmt.Errorf("document %d does not exist: the index has %d documents", id, manifest.NumDocuments)
+		}
+		if !isBitSet(bitmap, id) {
+			bitmap[id/8] |= 1 << (id % 8)
+			numDeleted++
+		}
+	}
+
+	if err := writeFileAtomic(path.Join(outpath, deletedFilename), bitmap); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted %d document(s)\n", numDeleted)
+	return nil
+}
+
+// Rewrites the suffix array of chunk to newPath without the entries that fall
+// inside deleted documents. Returns the chunk's new description, or ok=false
+// if no entries were dropped (in which case nothing is written). If the chunk
+// has an LCP array, it is rewritten as well: the LCP of two entries that end up
+// next to each other is the smallest LCP between them.
+func compactSuffixArray(outpath string, chunk ChunkInfo, newPath string, deleted *tombstones, tokenWidth int) (compacted ChunkInfo, ok bool, err error) {
+	if deleted.deletedBytes(chunk.Start, chunk.End) == 0 {
+		return chunk, false, nil
+	}
+
+	reader, err := openSAFileReader(path.Join(outpath, chunk.Path))
+	if err != nil {
+		return chunk, false, err
+	}
+	defer reader.close()
+
+	if err := reader.header.checkChunk(chunk, tokenWidth); err != nil {
+		return chunk, false, fmt.Errorf("%s: %w", chunk.Path, err)
+	}
+
+	var lcp *MMappedLCP
+	var lcpWriter *lcpFileWriter
+	if chunk.LCPPath != "" {
+		if lcp, err = makeMMappedLCP(path.Join(outpath, chunk.LCPPath)); err != nil {
+			return chunk, false, err
+		}
+		defer lcp.close()
+
+		if lcpWriter, err = createLCPFile(path.Join(outpath, lcpPath(newPath))); err != nil {
+			return chunk, false, err
+		}
+	}
+
+	saWriter, err := createSAFile(path.Join(outpath, newPath), tokenWidth, reader.header.baseOffset, reader.header.span)
+	if err != nil {
+		if lcpWriter != nil {
+			lcpWriter.abort()
+		}
+		return chunk, false, err
+	}
+	abort := func() {
+		saWriter.abort()
+		if lcpWriter != nil {
+			lcpWriter.abort()
+		}
+	}
+
+	minLCP := int64(math.MaxInt64) // smallest LCP since the last entry that was kept
+	for idx := int64(0); ; idx++ {
+		pos, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			abort()
+			return chunk, false, err
+		}
+
+		if lcp != nil {
+			minLCP = min(minLCP, lcp.get(idx))
+		}
+		if deleted.isDeleted(pos) {
+			continue
+		}
+
+		if lcpWriter != nil {
+			if saWriter.header.numEntries == 0 {
+				minLCP = 0
+			}
+			if err := lcpWriter.write(minLCP); err != nil {
+				abort()
+				return chunk, false, err
+			}
+			minLCP = math.MaxInt64
+		}
+		if err := saWriter.write(pos); err != nil {
+			abort()
+			return chunk, false, err
+		}
+	}
+
+	if err := saWriter.close(); err != nil {
+		if lcpWriter != nil {
+			lcpWriter.abort()
+		}
+		return chunk, false, err
+	}
+	if lcpWriter != nil {
+		if err := lcpWriter.close(); err != nil {
+			return chunk, false, err
+		}
+	}
+
+	if saWriter.header.numEntries == chunk.NumEntries {
+		// the entries were already dropped by an earlier compaction
+		os.Remove(path.Join(outpath, newPath))
+		if lcpWriter != nil {
+			os.Remove(path.Join(outpath, lcpPath(newPath)))
+		}
+		return chunk, false, nil
+	}
+
+	compacted = chunk
+	compacted.Path = newPath
+	compacted.NumEntries = saWriter.header.numEntries
+	if lcpWriter != nil {
+		compacted.LCPPath = lcpPath(newPath)
+	}
+	return compacted, true, nil
+}
+
+// Name of the file that a compacted suffix array is written to. The files are
+// never rewritten in place, so readers of the old manifest keep working.
+func compactedPath(saPath string, generation int) string {
+	base, _, _ := strings.Cut(saPath, ".")
+	return fmt.Sprintf("%s.c%d.bin", base, generation)
+}
+
+// Drops the entries that fall inside deleted documents from every suffix array
+// of the index in outpath (including the merged suffix array). The compacted
+// suffix arrays are written to new files and the manifest is replaced once they
+// are all done; the old files are removed afterwards.
+func runCompact(outpath string) error {
+	manifest, err := loadManifest(outpath)
+	if err != nil {
+		return err
+	}
+	if !manifest.Complete {
+		return fmt.Errorf("index in %s has not finished building", outpath)
+	}
+	if err := manifest.checkFiles(outpath); err != nil {
+		return err
+	}
+	if err := manifest.checkSuffixArrays("compacting"); err != nil {
+		return err
+	}
+
+	bitmap, err := readDeletedBitmap(outpath)
+	if err != nil {
+		return err
+	}
+	deleted, indexed, err := makeTombstones(outpath, manifest, bitmap)
+	if err != nil {
+		return err
+	}
+	if deleted == nil {
+		fmt.Println("No deleted documents to compact")
+		return nil
+	}
+	if indexed == nil {
+		fmt.Println("Suffix arrays are already compacted")
+		return nil
+	}
+
+	generation := manifest.Compactions + 1
+	updated := *manifest
+	updated.Compactions = generation
+	updated.CompactedPath = compactedPath(deletedFilename, generation)
+	updated.Chunks = append([]ChunkInfo{}, manifest.Chunks...)
+
+	oldPaths := make([]string, 0)
+	for i, chunk := range manifest.Chunks {
+		fmt.Printf("compacting chunk %d (%s)\n", i, chunk.Path)
+
+		compacted, ok, err := compactSuffixArray(outpath, chunk, compactedPath(chunk.Path, generation), indexed, manifest.TokenWidth)
+		if err != nil {
+			return err
+		}
+		if ok {
+			updated.Chunks[i] = compacted
+			oldPaths = append(oldPaths, chunk.Path)
+		}
+	}
+
+	if manifest.Merged != nil {
+		fmt.Printf("compacting merged suffix array (%s)\n", manifest.Merged.Path)
+
+		compacted, ok, err := compactSuffixArray(outpath, manifest.Merged.ChunkInfo, compactedPath(manifest.Merged.Path, generation), indexed, manifest.TokenWidth)
+		if err != nil {
+			return err
+		}
+		if ok {
+			merged := *manifest.Merged
+			merged.ChunkInfo = compacted
+			updated.Merged = &merged
+			oldPaths = append(oldPaths, manifest.Merged.Path)
+		}
+	}
+
+	// the documents deleted so far no longer have entries, so they are recorded
+	// along with the compacted suffix arrays (an index compacted before they
+	// were recorded may have nothing left to drop)
+	if err := writeFileAtomic(path.Join(outpath, updated.CompactedPath), bitmap); err != nil {
+		return err
+	}
+	if err := writeManifest(outpath, &updated); err != nil {
+		os.Remove(path.Join(outpath, updated.CompactedPath))
+		return err
+	}
+
+	for _, oldPath := range oldPaths {
+		os.Remove(path.Join(outpath, oldPath))
+		os.Remove(path.Join(outpath, lcpPath(oldPath)))
+	}
+	if manifest.CompactedPath != "" {
+		os.Remove(path.Join(outpath, manifest.CompactedPath))
+	}
+
+	fmt.Printf("Compacted %d suffix array(s)\n", len(oldPaths))
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// Encodes tokens with tokenWidth bytes each, failing the test if one doesn't fit.
+func encodeTokens(t *testing.T, tokens []uint32, tokenWidth int) []byte {
+	t.Helper()
+	valueBytes, err := intToByte(tokens, tokenWidth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return valueBytes
+}
+
+// Builds the suffix array of a chunk at the start of the tokenized corpus, in
+// byte positions, as the SA backend stores it.
+func buildTestMemSA(valueBytes []byte, tokenWidth int) *MemSA {
+	suffixArray := createTokenSuffixArray(valueBytes, tokenWidth)
+	data := make([]int64, len(suffixArray))
+	for i, pos := range suffixArray {
+		data[i] = int64(pos) * int64(tokenWidth)
+	}
+	return &MemSA{data: data}
+}
+
+// Returns numTokens random tokens from vocab. If sentinal is set, documents of
+// random length end with token 0, and so does the chunk.
+func randomTokens(rng *rand.Rand, numTokens int, vocab []uint32, sentinal bool) []uint32 {
+	tokens := make([]uint32, numTokens)
+	for i := range tokens {
+		tokens[i] = vocab[rng.Intn(len(vocab))]
+		if sentinal && (i == numTokens-1 || rng.Intn(8) == 0) {
+			tokens[i] = 0
+		}
+	}
+	return tokens
+}
+
+// Returns the byte positions at which query occurs in tokens. The empty query
+// occurs at every token.
+func naiveOccurrences(tokens, query []uint32, tokenWidth int) []int64 {
+	positions := make([]int64, 0)
+	for i := 0; i < len(tokens) && i+len(query) <= len(tokens); i++ {
+		if slices.Equal(tokens[i:i+len(query)], query) {
+			positions = append(positions, int64(i*tokenWidth))
+		}
+	}
+	return positions
+}
+
+func TestRetrieveLiveNum(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	vocab := []uint32{1, 2, 3, 300}
+	for trial := 0; trial < 20; trial++ {
+		tokens := randomTokens(rng, 50+rng.Intn(300), vocab, true)
+		valueBytes := encodeTokens(t, tokens, 2)
+		sa := buildTestMemSA(valueBytes, 2)
+		vec := &MemArray{data: valueBytes}
+		chunk := ChunkInfo{Start: 0, End: int64(len(valueBytes))}
+
+		deleted := deleteRandomDocuments(rng, tokens, 2)
+
+		for _, query := range testQueries(rng, tokens, vocab) {
+			want := 0
+			for _, pos := range naiveOccurrences(tokens, query, 2) {
+				if !deleted.isDeleted(pos) {
+					want++
+				}
+			}
+			if got := retrieveLiveNum(sa, vec, encodeTokens(t, query, 2), chunk, 2, deleted); got != want {
+				t.Fatalf("tokens %v, deleted %v, query %v: %d live occurrences, want %d", tokens, deleted.ranges, query, got, want)
+			}
+		}
+	}
+}
+
+// Deletes about a third of the documents of tokens, each of which ends with the
+// sentinal 0.
+func deleteRandomDocuments(rng *rand.Rand, tokens []uint32, tokenWidth int) *tombstones {
+	deleted := &tombstones{}
+	docStart := int64(0)
+	for i, token := range tokens {
+		if token == 0 {
+			docEnd := int64(i+1) * int64(tokenWidth)
+			if rng.Intn(3) == 0 {
+				deleted.ranges = append(deleted.ranges, docRange{docStart, docEnd})
+			}
+			docStart = docEnd
+		}
+	}
+	return deleted
+}
+
+func TestCountAfterCompaction(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	vocab := []uint32{1, 2, 3, 4}
+	for _, merge := range []bool{false, true} {
+		docs := randomDocuments(rng, 60, 12, 5)
+		cfg := testBuildConfig(t, docs)
+		cfg.ChunkSize = 200
+		buildTestIndex(t, cfg)
+		if merge {
+			if err := runMerge(cfg.Outpath); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the corpus, and whether each of its tokens is in a deleted document
+		tokens, docIds := make([]uint32, 0), make([]int64, 0)
+		for id, doc := range docs {
+			for range len(doc) + 1 {
+				docIds = append(docIds, int64(id))
+			}
+			tokens = append(append(tokens, doc...), 0)
+		}
+		isDeleted := make(map[int64]bool)
+
+		// documents deleted before the compaction no longer have entries, those
+		// deleted after it still do
+		for _, step := range []string{"delete", "compact", "delete"} {
+			if step == "compact" {
+				if err := runCompact(cfg.Outpath); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			ids := []int64{rng.Int63n(int64(len(docs))), rng.Int63n(int64(len(docs))), rng.Int63n(int64(len(docs)))}
+			if err := runDelete(cfg.Outpath, ids); err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range ids {
+				isDeleted[id] = true
+			}
+		}
+
+		m := buildTestIndex(t, cfg)
+		for _, query := range testQueries(rng, tokens, vocab) {
+			// without sentinals, occurrences stay inside of a document and so
+			// inside of a chunk
+			if slices.Contains(query, 0) {
+				continue
+			}
+			want := int64(0)
+			for _, pos := range naiveOccurrences(tokens, query, 2) {
+				if !isDeleted[docIds[pos/2]] {
+					want++
+				}
+			}
+			if got, err := m.Count(query); err != nil || got != want {
+				t.Fatalf("merged %v, deleted %v, query %v: count %d (%v), want %d", merge, isDeleted, query, got, err, want)
+			}
+		}
+	}
+}
+
+// Counts the reads of the tokenized corpus.
+type countingArray struct {
+	TokenArray
+	numReads int
+}
+
+func (a *countingArray) getSlice(start, stop int64) []byte {
+	a.numReads++
+	return a.TokenArray.getSlice(start, stop)
+}
+
+func TestNextTokenCountsNextToLargeDeletedDocument(t *testing.T) {
+	// a query that occurs three times, once in a deleted document, next to a
+	// much larger deleted document
+	rng := rand.New(rand.NewSource(1))
+	tokens := []uint32{5, 6, 0}
+	largeStart := int64(len(tokens)) * 2
+	tokens = append(append(tokens, randomTokens(rng, 5000, []uint32{1, 2, 3}, false)...), 0)
+	largeEnd := int64(len(tokens)) * 2
+	tokens = append(tokens, 5, 7, 0, 5, 6, 0)
+	deleted := &tombstones{ranges: []docRange{{largeStart, largeEnd}, {largeEnd, largeEnd + 6}}}
+
+	valueBytes := encodeTokens(t, tokens, 2)
+	chunk := ChunkInfo{Start: 0, End: int64(len(valueBytes))}
+	arrays := []SuffixArray{
+		&MultiSuffixArray{
+			suffixArrays: []SuffixArrayData{buildTestMemSA(valueBytes, 2)},
+			chunks:       []ChunkInfo{chunk},
+			chunkEnd:     func(int64) int64 { return chunk.End },
+			tokenWidth:   2,
+			deleted:      deleted,
+		},
+		&MultiFMIndex{indices: []*FMIndex{buildTestFMIndex(valueBytes, 2, 4)}, tokenWidth: 2, deleted: deleted},
+	}
+
+	for i, arr := range arrays {
+		vec := &countingArray{TokenArray: &MemArray{data: valueBytes}}
+		counts := arr.retrieveNextTokenCounts(vec, encodeTokens(t, []uint32{5}, 2))
+		if want := map[uint32]int64{6: 2}; !maps.Equal(counts, want) {
+			t.Fatalf("array %d: next tokens %v, want %v", i, counts, want)
+		}
+		// only the occurrences are checked, not every position of the deleted documents
+		if vec.numReads > 100 {
+			t.Fatalf("array %d: %d reads of the corpus for 3 occurrences", i, vec.numReads)
+		}
+	}
+}
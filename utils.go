@@ -3,23 +3,73 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 	"sort"
 	"strings"
 )
 
-// Puts the value into the byte slice at the given index.
-func putByte(vec []byte, val uint16, idx int) {
-	binary.LittleEndian.PutUint16(vec[idx*2:], val)
+// Number of bytes used to store each token when none is specified.
+const defaultTokenWidth = 2
+
+// Checks that tokens can be stored using tokenWidth bytes. Only uint16 (2)
+// and uint32 (4) tokens are supported.
+func validateTokenWidth(tokenWidth int) error {
+	if tokenWidth != 2 && tokenWidth != 4 {
+		return fmt.Errorf("unsupported token width %d: must be 2 or 4", tokenWidth)
+	}
+	return nil
+}
+
+// Largest token id that can be stored using tokenWidth bytes.
+func maxTokenValue(tokenWidth int) uint64 {
+	if tokenWidth == 2 {
+		return math.MaxUint16
+	}
+	return math.MaxUint32
 }
 
-func intToByte(vec []uint32) []byte {
-	result := make([]byte, len(vec)*2)
+// Checks that val fits in tokenWidth bytes.
+func checkTokenValue(val uint64, tokenWidth int) error {
+	if val > maxTokenValue(tokenWidth) {
+		return fmt.Errorf("token id %d does not fit in %d bytes", val, tokenWidth)
+	}
+	return nil
+}
+
+// Puts the value into the byte slice at the given index. Returns an error
+// instead of truncating if the value does not fit in tokenWidth bytes.
+func putByte(vec []byte, val uint32, idx int, tokenWidth int) error {
+	if err := checkTokenValue(uint64(val), tokenWidth); err != nil {
+		return err
+	}
+
+	if tokenWidth == 2 {
+		binary.LittleEndian.PutUint16(vec[idx*2:], uint16(val))
+	} else {
+		binary.LittleEndian.PutUint32(vec[idx*4:], val)
+	}
+
+	return nil
+}
+
+// Reads the token at the given index of the byte slice.
+func getToken(vec []byte, idx int, tokenWidth int) uint32 {
+	if tokenWidth == 2 {
+		return uint32(binary.LittleEndian.Uint16(vec[idx*2:]))
+	}
+	return binary.LittleEndian.Uint32(vec[idx*4:])
+}
+
+func intToByte(vec []uint32, tokenWidth int) ([]byte, error) {
+	result := make([]byte, len(vec)*tokenWidth)
 
 	for i, val := range vec {
-		putByte(result, uint16(val), i)
+		if err := putByte(result, val, i, tokenWidth); err != nil {
+			return nil, err
+		}
 	}
 
-	return result
+	return result, nil
 }
 
 func intToUint32(vec []int) []uint32 {
@@ -42,12 +92,12 @@ func uint32ToInt(vec []uint32) []int {
 	return result
 }
 
-func byteToInt(vec []byte) []int {
-	n := len(vec) / 2
+func byteToInt(vec []byte, tokenWidth int) []int {
+	n := len(vec) / tokenWidth
 	result := make([]int, n)
 
 	for i := 0; i < n; i++ {
-		result[i] = int(binary.LittleEndian.Uint16(vec[i*2:]))
+		result[i] = int(getToken(vec, i, tokenWidth))
 	}
 
 	return result
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Words of the tokenizers written by writeWordLevelTokenizer; words outside of
+// the vocabulary are [UNK].
+var testVocab = []string{"[UNK]", "the", "cat", "sat", "on", "mat", "dog", "ran", "a", "log"}
+
+// Writes a word-level tokenizer over testVocab that splits text at whitespace
+// and in which word i has token id firstID+i to filename.
+func writeWordLevelTokenizer(t *testing.T, filename string, firstID int) {
+	t.Helper()
+	vocab := make(map[string]int)
+	for i, word := range testVocab {
+		vocab[word] = firstID + i
+	}
+	writeVocabTokenizer(t, filename, vocab)
+}
+
+// Writes a word-level tokenizer with the token ids of vocab that splits text at
+// whitespace to filename. vocab must have an [UNK] word.
+func writeVocabTokenizer(t *testing.T, filename string, vocab map[string]int) {
+	t.Helper()
+	config := map[string]any{
+		"version":        "1.0",
+		"truncation":     nil,
+		"padding":        nil,
+		"added_tokens":   []any{},
+		"normalizer":     nil,
+		"pre_tokenizer":  map[string]any{"type": "WhitespaceSplit"},
+		"post_processor": nil,
+		"decoder":        nil,
+		"model":          map[string]any{"type": "WordLevel", "vocab": vocab, "unk_token": "[UNK]"},
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Token ids of text as tokenized by the tokenizer of writeWordLevelTokenizer
+// with word ids starting from 1, so no word is the sentinal 0.
+func testTokenize(text string) []uint32 {
+	tokens := make([]uint32, 0)
+	for _, word := range strings.Fields(text) {
+		id := slices.Index(testVocab, word)
+		tokens = append(tokens, uint32(max(id, 0)+1))
+	}
+	return tokens
+}
+
+func TestTokenValues(t *testing.T) {
+	tests := []struct {
+		val        uint64
+		tokenWidth int
+		fits       bool
+	}{
+		{65535, 2, true},
+		{65536, 2, false},
+		{70000, 2, false},
+		{70000, 4, true},
+		{1<<32 - 1, 4, true},
+		{1 << 32, 4, false},
+	}
+	for _, tt := range tests {
+		if err := checkTokenValue(tt.val, tt.tokenWidth); (err == nil) != tt.fits {
+			t.Errorf("token %d in %d bytes: %v", tt.val, tt.tokenWidth, err)
+		}
+	}
+
+	// a token that doesn't fit is an error rather than truncated
+	buf := make([]byte, 4)
+	if err := putByte(buf, 70000, 1, 2); err == nil || !slices.Equal(buf, make([]byte, 4)) {
+		t.Fatalf("put 70000 into 2 bytes as %v (%v)", buf, err)
+	}
+	if _, err := intToByte([]uint32{1, 70000}, 2); err == nil {
+		t.Fatal("encoded 70000 in 2 bytes")
+	}
+	if err := encodeSequence(make([]byte, 8), []uint32{1, 2}, 70000, 2, 2); err == nil {
+		t.Fatal("encoded a sentinal of 70000 in 2 bytes")
+	}
+
+	tokens := []uint32{0, 1, 255, 256, 65535, 65536, 70000, 1 << 24, 1<<32 - 1, 70000, 70000}
+	valueBytes, err := intToByte(tokens, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := byteToInt(valueBytes, 4); !slices.Equal(got, uint32ToInt(tokens)) {
+		t.Fatalf("tokens %v come back as %v", tokens, got)
+	}
+	if !hasSentinal(valueBytes, len(valueBytes), 2, 70000, 4) {
+		t.Fatal("the two sentinals of 70000 aren't found")
+	}
+	// 70000 truncated to 2 bytes
+	if hasSentinal(valueBytes, len(valueBytes), 2, 70000-65536, 4) {
+		t.Fatal("truncated sentinals are found")
+	}
+	if hasSentinal(valueBytes, len(valueBytes), 3, 70000, 4) {
+		t.Fatal("three sentinals are found")
+	}
+	if hasSentinal(valueBytes, len(valueBytes)-2, 2, 70000, 4) {
+		t.Fatal("sentinals are found in a corpus of partial tokens")
+	}
+}
+
+func TestWideTokens(t *testing.T) {
+	texts := []string{"the cat sat on the mat", "the dog ran", "a cat sat on a log"}
+	filename := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(filename, []byte(strings.Join(texts, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// every token id needs more than 2 bytes
+	const firstID = 70000
+	wide := func(text string) []uint32 {
+		tokens := testTokenize(text)
+		for i := range tokens {
+			tokens[i] += firstID - 1
+		}
+		return tokens
+	}
+
+	cfg := testTextBuildConfig(t, []string{filename})
+	writeWordLevelTokenizer(t, cfg.TokenizerConfig, firstID)
+	cfg.TokenWidth = 4
+	cfg.VocabSize = firstID + len(testVocab)
+	m := buildTestIndex(t, cfg)
+
+	for id, text := range texts {
+		if got, err := m.GetDocument(int64(id)); err != nil || !slices.Equal(got, wide(text)) {
+			t.Fatalf("document %d is %v (%v), want %v", id, got, err, wide(text))
+		}
+	}
+	if count, err := m.Count(wide("cat sat on")); err != nil || count != 2 {
+		t.Fatalf("query %v: %d occurrences (%v), want 2", wide("cat sat on"), count, err)
+	}
+	prediction, err := m.NextTokenDistribution(wide("cat sat on"), 1, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32]int64{wide("the")[0]: 1, wide("a")[0]: 1}
+	if prediction.effectiveN != 3 || !maps.Equal(prediction.counts, want) {
+		t.Fatalf("next tokens %v after %d tokens, want %v after 3", prediction.counts, prediction.effectiveN, want)
+	}
+	// the ids truncated to 2 bytes don't occur
+	if count, err := m.Count([]uint32{wide("cat")[0] - 65536}); err != nil || count != 0 {
+		t.Fatalf("truncated id: %d occurrences (%v), want 0", count, err)
+	}
+
+	// the same tokenizer fails to build an index of 2-byte tokens
+	cfg.Outpath = filepath.Join(t.TempDir(), "index")
+	cfg.TokenWidth = 2
+	cfg.VocabSize = 0
+	if _, err := InitializeModel(cfg); err == nil || !strings.Contains(err.Error(), "does not fit in 2 bytes") {
+		t.Fatalf("built an index of 2-byte tokens from ids of at least %d (%v)", firstID, err)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path"
+)
+
+// An entry of the index that failed verification.
+type verifyViolation struct {
+	array   string // which suffix array, e.g. "chunk 3"
+	index   int64  // suffix array index, or -1 if the violation is about the whole array
+	pos     int64  // byte position in the tokenized corpus, or -1 if unknown
+	message string
+}
+
+func (v verifyViolation) String() string {
+	s := v.array
+	if v.index >= 0 {
+		s += fmt.Sprintf(", entry %d", v.index)
+	}
+	if v.pos >= 0 {
+		s += fmt.Sprintf(", byte %d", v.pos)
+	}
+	return s + ": " + v.message
+}
+
+// Result of verifying an index.
+type verifyReport struct {
+	entriesChecked int64
+	numViolations  int64             // total number of violations found
+	violations     []verifyViolation // the first maxViolations violations
+	maxViolations  int
+}
+
+func (r *verifyReport) add(array string, index, pos int64, format string, args ...any) {
+	r.numViolations++
+	if len(r.violations) < r.maxViolations {
+		r.violations = append(r.violations, verifyViolation{array, index, pos, fmt.Sprintf(format, args...)})
+	}
+}
+
+// Checks the suffix arrays of the index in outpath against the tokenized corpus.
+// For every chunk, the entries must be in bounds and token-aligned, neighbouring
+// suffixes must be in lexicographic order and the entries must cover every token
+// of the chunk (except those inside deleted documents, which may have been dropped
+// by compaction), which must end on a document boundary. The merged suffix array,
+// if any, is checked the same way over the chunks it covers. The document offsets
+// must be increasing and each document must end with a sentinal. If numSamples is positive,
+// only numSamples random pairs of neighbouring entries are checked per suffix array
+// (using seed); otherwise every entry is checked along with each file's checksum.
+// Stops recording violations after the first maxViolations.
+func verifyIndex(outpath string, numSamples, maxViolations int, seed int64) (*verifyReport, error) {
+	manifest, err := loadManifest(outpath)
+	if err != nil {
+		return nil, err
+	}
+	if !manifest.Complete {
+		return nil, fmt.Errorf("index in %s has not finished building", outpath)
+	}
+	if err := manifest.checkFiles(outpath); err != nil {
+		return nil, err
+	}
+	if err := manifest.checkSuffixArrays("verification"); err != nil {
+		return nil, err
+	}
+
+	vec, err := manifest.openCorpus(outpath)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, _, err := loadTombstones(outpath, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if deleted == nil {
+		deleted = &tombstones{}
+	}
+
+	report := &verifyReport{maxViolations: maxViolations}
+	rng := rand.New(rand.NewSource(seed))
+	tokenWidth := int64(manifest.TokenWidth)
+
+	fmt.Printf("verifying document offsets (%s)\n", manifest.DocOffsetsPath)
+	if err := verifyDocOffsets(report, outpath, manifest, vec, numSamples, rng); err != nil {
+		return nil, err
+	}
+
+	if len(manifest.MetadataFields) > 0 {
+		fmt.Printf("verifying metadata (%s)\n", manifest.MetadataPath)
+		if err := verifyMetadata(report, outpath, manifest, numSamples, rng); err != nil {
+			return nil, err
+		}
+	}
+
+	expectedStart := int64(0)
+	for i, chunk := range manifest.Chunks {
+		label := fmt.Sprintf("chunk %d", i)
+		fmt.Printf("verifying %s (%s)\n", label, chunk.Path)
+
+		// the chunks must tile the corpus and end on document boundaries
+		if chunk.Start != expectedStart {
+			report.add(label, -1, chunk.Start, "chunk starts at byte %d but the previous chunk ends at byte %d", chunk.Start, expectedStart)
+		}
+		expectedStart = chunk.End
+
+		chunkLength := chunk.End - chunk.Start
+		if chunkLength%tokenWidth != 0 {
+			report.add(label, -1, chunk.End, "chunk length %d is not a multiple of the token width", chunkLength)
+			continue
+		}
+
+		lastTokens := vec.getSlice(max(chunk.End-int64(manifest.SentinalSize)*tokenWidth, chunk.Start), chunk.End)
+		if !hasSentinal(lastTokens, len(lastTokens), manifest.SentinalSize, manifest.SentinalVal, manifest.TokenWidth) {
+			report.add(label, -1, chunk.End, "chunk does not end with a sentinal")
+		}
+
+		verifySuffixArray(report, label, outpath, chunk, manifest, vec, deleted, numSamples, rng)
+	}
+
+	if expectedStart != manifest.DataBytes {
+		report.add(fmt.Sprintf("chunk %d", len(manifest.Chunks)-1), -1, expectedStart, "chunks end at byte %d but the corpus has %d bytes", expectedStart, manifest.DataBytes)
+	}
+
+	if merged := manifest.Merged; merged != nil {
+		fmt.Printf("verifying merged suffix array (%s)\n", merged.Path)
+
+		if merged.NumChunks < 1 || merged.NumChunks > len(manifest.Chunks) {
+			report.add("merged", -1, -1, "merged suffix array covers %d chunks but the index has %d", merged.NumChunks, len(manifest.Chunks))
+		} else if merged.Start != 0 || merged.End != manifest.Chunks[merged.NumChunks-1].End {
+			report.add("merged", -1, -1, "merged suffix array covers bytes [%d, %d) but its chunks cover [0, %d)", merged.Start, merged.End, manifest.Chunks[merged.NumChunks-1].End)
+		} else {
+			verifySuffixArray(report, "merged", outpath, merged.ChunkInfo, manifest, vec, deleted, numSamples, rng)
+		}
+	}
+
+	return report, nil
+}
+
+// Checks that the document offsets start at 0, are increasing, that every
+// document ends with a sentinal and comes from one of the index's input files.
+// If numSamples is positive, only numSamples random
+// documents are checked.
+func verifyDocOffsets(report *verifyReport, outpath string, manifest *IndexManifest, vec TokenArray, numSamples int, rng *rand.Rand) error {
+	docs, err := openDocIndex(outpath, manifest)
+	if err != nil {
+		return err
+	}
+	defer docs.close()
+
+	sources, err := openSourceIndex(outpath, manifest)
+	if err != nil {
+		return err
+	}
+	defer sources.close()
+
+	sentinalBytes := int64(manifest.SentinalSize * manifest.TokenWidth)
+	checkDoc := func(id int64) {
+		if source, _ := sources.get(id); source >= len(manifest.Sources) {
+			report.add("documents", id, -1, "document comes from input %d but the index has %d inputs", source, len(manifest.Sources))
+		}
+
+		start, end := docs.start(id), docs.end(id)
+		if id == 0 && start != 0 {
+			report.add("documents", id, start, "first document starts at byte %d", start)
+		}
+		if end-start < sentinalBytes || start%int64(manifest.TokenWidth) != 0 {
+			report.add("documents", id, start, "document spans bytes [%d, %d)", start, end)
+			return
+		}
+
+		lastTokens := vec.getSlice(end-sentinalBytes, end)
+		if !hasSentinal(lastTokens, len(lastTokens), manifest.SentinalSize, manifest.SentinalVal, manifest.TokenWidth) {
+			report.add("documents", id, start, "document does not end with a sentinal")
+		}
+	}
+
+	if manifest.NumDocuments == 0 {
+		return nil
+	}
+
+	if numSamples > 0 {
+		for i := 0; i < numSamples; i++ {
+			checkDoc(rng.Int63n(manifest.NumDocuments))
+		}
+	} else {
+		for id := int64(0); id < manifest.NumDocuments; id++ {
+			checkDoc(id)
+		}
+	}
+	return nil
+}
+
+// Checks that the metadata of every document is a JSON object. If numSamples is
+// positive, only numSamples random documents are checked.
+func verifyMetadata(report *verifyReport, outpath string, manifest *IndexManifest, numSamples int, rng *rand.Rand) error {
+	metadata, err := openMetadataIndex(outpath, manifest)
+	if err != nil {
+		return err
+	}
+	defer metadata.close()
+
+	checkDoc := func(id int64) {
+		md, err := metadata.get(id)
+		if err != nil {
+			report.add("metadata", id, -1, "%v", err)
+		} else if len(md) == 0 || md[0] != '{' {
+			report.add("metadata", id, -1, "metadata is not a JSON object: %s", md)
+		}
+	}
+
+	if numSamples > 0 && manifest.NumDocuments > 0 {
+		for i := 0; i < numSamples; i++ {
+			checkDoc(rng.Int63n(manifest.NumDocuments))
+		}
+	} else {
+		for id := int64(0); id < manifest.NumDocuments; id++ {
+			checkDoc(id)
+		}
+	}
+	return nil
+}
+
+// Checks the suffix array file of a single chunk (or the merged suffix array).
+// Entries inside deleted documents may be missing.
+func verifySuffixArray(report *verifyReport, label, outpath string, chunk ChunkInfo, manifest *IndexManifest, vec TokenArray, deleted *tombstones, numSamples int, rng *rand.Rand) {
+	tokenWidth := int64(manifest.TokenWidth)
+
+	sa, err := makeMMappedSA(path.Join(outpath, chunk.Path))
+	if err != nil {
+		report.add(label, -1, -1, "%v", err)
+		return
+	}
+	defer sa.close()
+
+	if err := sa.header.checkChunk(chunk, manifest.TokenWidth); err != nil {
+		report.add(label, -1, -1, "%v", err)
+	}
+	if chunk.LCPPath != "" {
+		if err := sa.openLCP(path.Join(outpath, chunk.LCPPath)); err != nil {
+			report.add(label, -1, -1, "%v", err)
+		}
+	}
+
+	numTokens := (chunk.End - chunk.Start) / tokenWidth
+	numDeleted := deleted.deletedBytes(chunk.Start, chunk.End) / tokenWidth
+	if sa.length() > numTokens || sa.length() < numTokens-numDeleted {
+		report.add(label, -1, -1, "%d tokens (%d deleted) but %d suffix array entries", numTokens, numDeleted, sa.length())
+	}
+
+	if numSamples > 0 {
+		verifySampledEntries(report, label, sa, vec, chunk, manifest, numSamples, rng)
+	} else {
+		if err := sa.verifyChecksum(); err != nil {
+			report.add(label, -1, -1, "%v", err)
+		}
+		verifyAllEntries(report, label, sa, vec, chunk, manifest, deleted)
+	}
+}
+
+// Checks that entry idx is in bounds and aligned. Returns false if it isn't.
+func verifyEntry(report *verifyReport, label string, idx, pos int64, chunk ChunkInfo, tokenWidth int64) bool {
+	if pos < chunk.Start || pos >= chunk.End {
+		report.add(label, idx, pos, "entry is outside of [%d, %d)", chunk.Start, chunk.End)
+		return false
+	}
+	if pos%tokenWidth != 0 {
+		report.add(label, idx, pos, "entry is not aligned to a token boundary")
+		return false
+	}
+	report.entriesChecked++
+	return true
+}
+
+// Checks that the suffix at prevPos is smaller than the suffix at pos. Each
+// suffix stops at the end of its chunk.
+func verifyOrder(report *verifyReport, label string, idx, prevPos, pos int64, vec TokenArray, manifest *IndexManifest) {
+	if compareSuffixes(vec, prevPos, manifest.chunkEnd(prevPos), pos, manifest.chunkEnd(pos)) > 0 {
+		report.add(label, idx, pos, "suffix is smaller than the previous suffix at byte %d", prevPos)
+	}
+}
+
+// Checks that the LCP of entry idx, if the suffix array has an LCP array, is the
+// length (in tokens) of the common prefix of the suffixes at prevPos and pos.
+func verifyLCP(report *verifyReport, label string, sa *MMappedSA, idx, prevPos, pos int64, vec TokenArray, manifest *IndexManifest) {
+	if !sa.hasLCP() {
+		return
+	}
+
+	expected := commonPrefixLength(vec, prevPos, manifest.chunkEnd(prevPos), pos, manifest.chunkEnd(pos)) / int64(manifest.TokenWidth)
+	if lcp := sa.lcp(idx); lcp != expected {
+		report.add(label, idx, pos, "LCP is %d but the suffix has %d tokens in common with the previous suffix at byte %d", lcp, expected, prevPos)
+	}
+}
+
+// Checks every entry of the suffix array, and that each token appears exactly once
+// (or not at all, if it is inside a deleted document).
+func verifyAllEntries(report *verifyReport, label string, sa *MMappedSA, vec TokenArray, chunk ChunkInfo, manifest *IndexManifest, deleted *tombstones) {
+	tokenWidth := int64(manifest.TokenWidth)
+	numTokens := (chunk.End - chunk.Start) / tokenWidth
+	seen := make([]uint64, (numTokens+63)/64)
+
+	prevPos := int64(-1)
+	for idx := int64(0); idx < sa.length(); idx++ {
+		pos := sa.get(idx)
+		if !verifyEntry(report, label, idx, pos, chunk, tokenWidth) {
+			prevPos = -1
+			continue
+		}
+
+		tokenIdx := (pos - chunk.Start) / tokenWidth
+		if seen[tokenIdx/64]&(1<<(tokenIdx%64)) != 0 {
+			report.add(label, idx, pos, "position appears more than once")
+		}
+		seen[tokenIdx/64] |= 1 << (tokenIdx % 64)
+
+		if prevPos >= 0 {
+			verifyOrder(report, label, idx, prevPos, pos, vec, manifest)
+			verifyLCP(report, label, sa, idx, prevPos, pos, vec, manifest)
+		} else if idx == 0 && sa.hasLCP() && sa.lcp(0) != 0 {
+			report.add(label, 0, pos, "LCP of the first entry is %d instead of 0", sa.lcp(0))
+		}
+		prevPos = pos
+	}
+
+	for tokenIdx := int64(0); tokenIdx < numTokens; tokenIdx++ {
+		if seen[tokenIdx/64]&(1<<(tokenIdx%64)) == 0 && !deleted.isDeleted(chunk.Start+tokenIdx*tokenWidth) {
+			report.add(label, -1, chunk.Start+tokenIdx*tokenWidth, "position is missing from the suffix array")
+		}
+	}
+}
+
+// Checks numSamples random pairs of neighbouring entries of the suffix array.
+func verifySampledEntries(report *verifyReport, label string, sa *MMappedSA, vec TokenArray, chunk ChunkInfo, manifest *IndexManifest, numSamples int, rng *rand.Rand) {
+	tokenWidth := int64(manifest.TokenWidth)
+
+	saLen := sa.length()
+	if saLen == 0 {
+		return
+	}
+	if saLen == 1 {
+		verifyEntry(report, label, 0, sa.get(0), chunk, tokenWidth)
+		return
+	}
+
+	for i := 0; i < numSamples; i++ {
+		idx := 1 + rng.Int63n(saLen-1)
+		prevPos, pos := sa.get(idx-1), sa.get(idx)
+
+		prevOk := verifyEntry(report, label, idx-1, prevPos, chunk, tokenWidth)
+		ok := verifyEntry(report, label, idx, pos, chunk, tokenWidth)
+		if prevOk && ok {
+			verifyOrder(report, label, idx, prevPos, pos, vec, manifest)
+			verifyLCP(report, label, sa, idx, prevPos, pos, vec, manifest)
+		}
+	}
+}
+
+// Verifies the index in outpath and prints the result. Returns whether the
+// index passed verification.
+func runVerify(outpath string, numSamples, maxViolations int, seed int64) (bool, error) {
+	report, err := verifyIndex(outpath, numSamples, maxViolations, seed)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("checked %d entries\n", report.entriesChecked)
+
+	if report.numViolations == 0 {
+		fmt.Println("index ok")
+		return true, nil
+	}
+
+	fmt.Printf("found %d violation(s)", report.numViolations)
+	if report.numViolations > int64(len(report.violations)) {
+		fmt.Printf(", showing the first %d", len(report.violations))
+	}
+	fmt.Println(":")
+	for _, v := range report.violations {
+		fmt.Println(" ", v)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Documents of random tokens from 1 to vocabSize-1, with lengths up to maxLength.
+func randomDocuments(rng *rand.Rand, numDocs, maxLength, vocabSize int) [][]uint32 {
+	docs := make([][]uint32, numDocs)
+	for i := range docs {
+		docs[i] = make([]uint32, 1+rng.Intn(maxLength))
+		for j := range docs[i] {
+			docs[i][j] = uint32(1 + rng.Intn(vocabSize-1))
+		}
+	}
+	return docs
+}
+
+// Reads every entry of the suffix array at saPath.
+func readSuffixArray(t *testing.T, saPath string) []int64 {
+	t.Helper()
+	sa, err := makeMMappedSA(saPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sa.close()
+
+	entries := make([]int64, sa.length())
+	for i := range entries {
+		entries[i] = sa.get(int64(i))
+	}
+	return entries
+}
+
+// Replaces the entries of the suffix array of chunk with entries, writing a
+// header (and checksum) that matches them.
+func rewriteSuffixArray(t *testing.T, outpath string, chunk ChunkInfo, entries []int64) {
+	t.Helper()
+	w, err := createSAFile(filepath.Join(outpath, chunk.Path), 2, chunk.Start, chunk.End-chunk.Start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range entries {
+		if err := w.write(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Checks that the first violations of report are want, matching their message
+// by substring.
+func checkViolations(t *testing.T, name string, report *verifyReport, want []verifyViolation) {
+	t.Helper()
+	if len(report.violations) < len(want) {
+		t.Fatalf("%s: violations %v, want %v first", name, report.violations, want)
+	}
+	for i, w := range want {
+		got := report.violations[i]
+		if got.array != w.array || got.index != w.index || got.pos != w.pos || !strings.Contains(got.message, w.message) {
+			t.Fatalf("%s: violation %d is %q, want %q", name, i, got, w)
+		}
+	}
+}
+
+func TestVerifyIndex(t *testing.T) {
+	docs := randomDocuments(rand.New(rand.NewSource(1)), 60, 12, 5)
+	cfg := testBuildConfig(t, docs)
+	cfg.ChunkSize = 200
+	buildTestIndex(t, cfg)
+
+	for _, numSamples := range []int{0, 1000} {
+		report, err := verifyIndex(cfg.Outpath, numSamples, 10, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.numViolations != 0 || report.entriesChecked == 0 {
+			t.Fatalf("%d samples: %d entries checked, violations %v", numSamples, report.entriesChecked, report.violations)
+		}
+	}
+
+	manifest, err := loadManifest(cfg.Outpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Chunks) < 2 {
+		t.Fatalf("%d chunks, the corpus should need several", len(manifest.Chunks))
+	}
+	chunk := manifest.Chunks[1]
+	saPath := filepath.Join(cfg.Outpath, chunk.Path)
+	original := readSuffixArray(t, saPath)
+	originalBytes, err := os.ReadFile(saPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := len(original) / 2
+	tests := []struct {
+		name    string
+		corrupt func() []int64
+		full    []verifyViolation // the first violations with every entry checked
+		sampled []verifyViolation // and with samples
+		exact   bool              // whether sampling finds nothing besides sampled
+	}{
+		{
+			name: "out of bounds",
+			corrupt: func() []int64 {
+				entries := slices.Clone(original)
+				entries[i] = chunk.Start - 2
+				return entries
+			},
+			full:    []verifyViolation{{array: "chunk 1", index: int64(i), pos: chunk.Start - 2, message: "outside of"}},
+			sampled: []verifyViolation{{array: "chunk 1", index: int64(i), pos: chunk.Start - 2, message: "outside of"}},
+		},
+		{
+			name: "odd aligned",
+			corrupt: func() []int64 {
+				entries := slices.Clone(original)
+				entries[i]++
+				return entries
+			},
+			full:    []verifyViolation{{array: "chunk 1", index: int64(i), pos: original[i] + 1, message: "not aligned"}},
+			sampled: []verifyViolation{{array: "chunk 1", index: int64(i), pos: original[i] + 1, message: "not aligned"}},
+		},
+		{
+			name: "swapped",
+			corrupt: func() []int64 {
+				entries := slices.Clone(original)
+				entries[i], entries[i+1] = entries[i+1], entries[i]
+				return entries
+			},
+			full:    []verifyViolation{{array: "chunk 1", index: int64(i + 1), pos: original[i], message: "smaller than the previous suffix"}},
+			sampled: []verifyViolation{{array: "chunk 1", index: int64(i + 1), pos: original[i], message: "smaller than the previous suffix"}},
+		},
+		{
+			// only checking every entry finds which position is missing
+			name: "gap",
+			corrupt: func() []int64 {
+				return slices.Delete(slices.Clone(original), i, i+1)
+			},
+			full: []verifyViolation{
+				{array: "chunk 1", index: -1, pos: -1, message: "entries but the chunk has"},
+				{array: "chunk 1", index: -1, pos: -1, message: "suffix array entries"},
+				{array: "chunk 1", index: -1, pos: original[i], message: "missing"},
+			},
+			sampled: []verifyViolation{
+				{array: "chunk 1", index: -1, pos: -1, message: "entries but the chunk has"},
+				{array: "chunk 1", index: -1, pos: -1, message: "suffix array entries"},
+			},
+			exact: true,
+		},
+	}
+
+	for _, tt := range tests {
+		rewriteSuffixArray(t, cfg.Outpath, chunk, tt.corrupt())
+
+		for _, numSamples := range []int{0, 1000} {
+			report, err := verifyIndex(cfg.Outpath, numSamples, 10, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.full
+			if numSamples > 0 {
+				want = tt.sampled
+			}
+			checkViolations(t, tt.name, report, want)
+			if numSamples > 0 && tt.exact && report.numViolations != int64(len(want)) {
+				t.Fatalf("%s: sampled violations %v, want %v", tt.name, report.violations, want)
+			}
+		}
+	}
+
+	// entries corrupted in place only fail the checksum, which sampling skips
+	corrupted := slices.Clone(originalBytes)
+	corrupted[saHeaderSize] ^= 0xff
+	if err := os.WriteFile(saPath, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err := verifyIndex(cfg.Outpath, 0, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkViolations(t, "checksum", report, []verifyViolation{{array: "chunk 1", index: -1, pos: -1, message: "checksum mismatch"}})
+
+	corrupted = slices.Clone(originalBytes)
+	corrupted[saChecksumOffset] ^= 0xff
+	if err := os.WriteFile(saPath, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = verifyIndex(cfg.Outpath, 1000, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.numViolations != 0 {
+		t.Fatalf("sampled verification of a wrong checksum: violations %v", report.violations)
+	}
+}
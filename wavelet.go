@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math/bits"
+)
+
+// Number of 64-bit words between the rank samples of a bit vector.
+const rankBlockWords = 8
+
+// Bit vector that counts the ones before any position in constant time, using
+// the number of ones before every rankBlockWords words.
+type rankBitVector struct {
+	words  []uint64
+	blocks []int64 // blocks[k]: number of ones in words[:k*rankBlockWords]
+	length int64
+}
+
+func newRankBitVector(length int64) *rankBitVector {
+	return &rankBitVector{words: make([]uint64, (length+63)/64), length: length}
+}
+
+func (bv *rankBitVector) set(i int64) {
+	bv.words[i/64] |= 1 << (i % 64)
+}
+
+func (bv *rankBitVector) get(i int64) bool {
+	return bv.words[i/64]&(1<<(i%64)) != 0
+}
+
+// Computes the rank samples; must be called once every bit is set.
+func (bv *rankBitVector) finish() {
+	bv.blocks = make([]int64, len(bv.words)/rankBlockWords+1)
+	ones := int64(0)
+	for w, word := range bv.words {
+		if w%rankBlockWords == 0 {
+			bv.blocks[w/rankBlockWords] = ones
+		}
+		ones += int64(bits.OnesCount64(word))
+	}
+	if len(bv.words)%rankBlockWords == 0 {
+		bv.blocks[len(bv.blocks)-1] = ones
+	}
+}
+
+// Returns the number of ones in [0, i).
+func (bv *rankBitVector) rank1(i int64) int64 {
+	w := i / 64
+	ones := bv.blocks[w/rankBlockWords]
+	for k := w / rankBlockWords * rankBlockWords; k < w; k++ {
+		ones += int64(bits.OnesCount64(bv.words[k]))
+	}
+	if i%64 != 0 {
+		ones += int64(bits.OnesCount64(bv.words[w] & (1<<(i%64) - 1)))
+	}
+	return ones
+}
+
+// Returns the number of zeros in [0, i).
+func (bv *rankBitVector) rank0(i int64) int64 {
+	return i - bv.rank1(i)
+}
+
+// Wavelet tree over a sequence of symbols, stored level by level (as a wavelet
+// matrix): level l holds bit l of every symbol, counting from the most
+// significant, with the symbols reordered so that those whose previous bits are
+// zero come first. Answers how many times a symbol occurs before a position with
+// one rank query per level.
+type waveletTree struct {
+	levels []*rankBitVector
+	zeros  []int64 // number of zeros at each level
+	length int64
+}
+
+// Builds the wavelet tree of symbols, each of which must fit in numBits bits.
+// symbols is reordered in the process.
+func newWaveletTree(symbols []uint32, numBits int) *waveletTree {
+	length := int64(len(symbols))
+	wt := &waveletTree{
+		levels: make([]*rankBitVector, numBits),
+		zeros:  make([]int64, numBits),
+		length: length,
+	}
+
+	scratch := make([]uint32, len(symbols))
+	for l := 0; l < numBits; l++ {
+		shift := numBits - 1 - l
+		level := newRankBitVector(length)
+
+		// stable partition: symbols with a zero bit first, then those with a one
+		numZeros := 0
+		for _, s := range symbols {
+			if s>>shift&1 == 0 {
+				numZeros++
+			}
+		}
+		zeroIdx, oneIdx := 0, numZeros
+		for i, s := range symbols {
+			if s>>shift&1 == 0 {
+				scratch[zeroIdx] = s
+				zeroIdx++
+			} else {
+				level.set(int64(i))
+				scratch[oneIdx] = s
+				oneIdx++
+			}
+		}
+
+		level.finish()
+		wt.levels[l] = level
+		wt.zeros[l] = int64(numZeros)
+		symbols, scratch = scratch, symbols
+	}
+
+	return wt
+}
+
+// Returns the number of occurrences of symbol in [0, i).
+func (wt *waveletTree) rank(symbol uint32, i int64) int64 {
+	numBits := len(wt.levels)
+	start := int64(0)
+	for l, level := range wt.levels {
+		if symbol>>(numBits-1-l)&1 == 0 {
+			start, i = level.rank0(start), level.rank0(i)
+		} else {
+			start, i = wt.zeros[l]+level.rank1(start), wt.zeros[l]+level.rank1(i)
+		}
+	}
+	return i - start
+}
+
+// Returns the symbol at position i and the number of times it occurs in [0, i).
+func (wt *waveletTree) accessRank(i int64) (uint32, int64) {
+	symbol := uint32(0)
+	start := int64(0)
+	for l, level := range wt.levels {
+		symbol <<= 1
+		if !level.get(i) {
+			start, i = level.rank0(start), level.rank0(i)
+		} else {
+			symbol |= 1
+			start, i = wt.zeros[l]+level.rank1(start), wt.zeros[l]+level.rank1(i)
+		}
+	}
+	return symbol, i - start
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestRankBitVector(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, length := range []int64{0, 1, 63, 64, 65, 511, 512, 513, 2000} {
+		bits := make([]bool, length)
+		bv := newRankBitVector(length)
+		for i := range bits {
+			if rng.Intn(3) == 0 {
+				bits[i] = true
+				bv.set(int64(i))
+			}
+		}
+		bv.finish()
+
+		ones := int64(0)
+		for i := int64(0); i <= length; i++ {
+			if got := bv.rank1(i); got != ones {
+				t.Fatalf("length %d: rank1(%d) = %d, want %d", length, i, got, ones)
+			}
+			if got := bv.rank0(i); got != i-ones {
+				t.Fatalf("length %d: rank0(%d) = %d, want %d", length, i, got, i-ones)
+			}
+			if i < length {
+				if bv.get(i) != bits[i] {
+					t.Fatalf("length %d: get(%d) = %v", length, i, bv.get(i))
+				}
+				if bits[i] {
+					ones++
+				}
+			}
+		}
+	}
+}
+
+func TestWaveletTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for _, alphabetSize := range []int{1, 2, 5, 64, 1000} {
+		for _, length := range []int{1, 100, 1500} {
+			symbols := make([]uint32, length)
+			for i := range symbols {
+				symbols[i] = uint32(rng.Intn(alphabetSize))
+			}
+			wt := newWaveletTree(append([]uint32{}, symbols...), fmSymbolBits(alphabetSize))
+
+			counts := make(map[uint32]int64)
+			for i := 0; i <= length; i++ {
+				for s := uint32(0); s < uint32(min(alphabetSize, 8)); s++ {
+					if got := wt.rank(s, int64(i)); got != counts[s] {
+						t.Fatalf("alphabet %d, length %d: rank(%d, %d) = %d, want %d", alphabetSize, length, s, i, got, counts[s])
+					}
+				}
+				if i == length {
+					break
+				}
+
+				symbol, rank := wt.accessRank(int64(i))
+				if symbol != symbols[i] || rank != counts[symbols[i]] {
+					t.Fatalf("alphabet %d, length %d: accessRank(%d) = (%d, %d), want (%d, %d)", alphabetSize, length, i, symbol, rank, symbols[i], counts[symbols[i]])
+				}
+				if got := wt.rank(symbols[i], int64(i)); got != counts[symbols[i]] {
+					t.Fatalf("alphabet %d, length %d: rank(%d, %d) = %d, want %d", alphabetSize, length, symbols[i], i, got, counts[symbols[i]])
+				}
+				counts[symbols[i]]++
+			}
+		}
+	}
+}